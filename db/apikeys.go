@@ -0,0 +1,178 @@
+package db
+
+/*
+ * API keys for the broker's own routes.  Only a SHA-256 hash of each key
+ * is stored; the key itself is returned once, when it is created.
+ */
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/nu7hatch/gouuid"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const apiKeysCollection string = "apikeys"
+
+var (
+    ErrApiKeyNotFound = errors.New("API key not found")
+    ErrApiKeyExists   = errors.New("API key already exists")
+)
+
+var apiKeyScopes = []string{
+    model.ScopeReadInventory,
+    model.ScopeProvision,
+    model.ScopeDelete,
+    model.ScopeAdmin,
+}
+
+func apiKeysInit() error {
+    err := BrokerDB.C(apiKeysCollection).EnsureIndex(mgo.Index{
+        Key:    []string{"hash"},
+        Unique: true,
+    })
+    if err != nil {
+        return err
+    }
+
+    return BrokerDB.C(apiKeysCollection).EnsureIndex(mgo.Index{
+        Key:    []string{"name"},
+        Unique: true,
+    })
+}
+
+func hashApiKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hex.EncodeToString(sum[:])
+}
+
+func validScope(scope string) bool {
+    for _, s := range apiKeyScopes {
+        if s == scope {
+            return true
+        }
+    }
+    return false
+}
+
+/*
+ * HasScope reports whether a key may use routes needing scope.  Admin
+ * keys may use every route.
+ */
+func HasScope(kSpec *model.ApiKeySpec, scope string) bool {
+    for _, s := range kSpec.Scopes {
+        if s == scope || s == model.ScopeAdmin {
+            return true
+        }
+    }
+    return false
+}
+
+func CreateApiKey(ctx context.Context, in model.ApiKeyRequest) (*model.NewApiKeySpec, error) {
+    log := logger.FromContext(ctx)
+
+    var kSpec model.NewApiKeySpec
+
+    if in.Name == "" {
+        return &kSpec, errors.New("API key name not set")
+    }
+    if len(in.Scopes) == 0 {
+        return &kSpec, errors.New("API key scopes not set")
+    }
+    for _, scope := range in.Scopes {
+        if !validScope(scope) {
+            return &kSpec, errors.New("Invalid scope " + scope)
+        }
+    }
+
+    id, err := uuid.NewV4()
+    if err != nil {
+        return &kSpec, &OpError{Op: "create api key", Name: in.Name, Err: err, RolledBack: true}
+    }
+
+    secret := make([]byte, 32)
+    _, err = rand.Read(secret)
+    if err != nil {
+        return &kSpec, &OpError{Op: "create api key", Name: in.Name, Err: err, RolledBack: true}
+    }
+
+    kSpec.Id = id.String()
+    kSpec.Name = in.Name
+    kSpec.Scopes = in.Scopes
+    kSpec.Created = time.Now()
+    kSpec.Key = hex.EncodeToString(secret)
+    kSpec.Hash = hashApiKey(kSpec.Key)
+
+    kSession := BrokerDB.Session.Copy()
+    defer kSession.Close()
+
+    err = kSession.DB(brokerDbName).C(apiKeysCollection).Insert(&kSpec.ApiKeySpec)
+    if mgo.IsDup(err) {
+        return &kSpec, ErrApiKeyExists
+    } else if err != nil {
+        log.Errorf("inserting %s: %s", in.Name, err)
+        return &kSpec, &OpError{Op: "create api key", Name: in.Name, Err: err, RolledBack: true}
+    }
+
+    log.Infof("created key %s (%s) with scopes %v", kSpec.Name, kSpec.Id, kSpec.Scopes)
+    return &kSpec, nil
+}
+
+func GetApiKeys(ctx context.Context) (*[]model.ApiKeySpec, error) {
+    log := logger.FromContext(ctx)
+
+    lKSpec := []model.ApiKeySpec{}
+
+    kSession := BrokerDB.Session.Copy()
+    defer kSession.Close()
+
+    err := kSession.DB(brokerDbName).C(apiKeysCollection).Find(nil).Sort("name").All(&lKSpec)
+    if err != nil {
+        log.Errorf("%v", err)
+        return &lKSpec, &OpError{Op: "list api keys", Err: err, RolledBack: true}
+    }
+    return &lKSpec, nil
+}
+
+func DeleteApiKey(ctx context.Context, id string) error {
+    log := logger.FromContext(ctx)
+
+    kSession := BrokerDB.Session.Copy()
+    defer kSession.Close()
+
+    err := kSession.DB(brokerDbName).C(apiKeysCollection).Remove(bson.M{"id": id})
+    if err == mgo.ErrNotFound {
+        return ErrApiKeyNotFound
+    } else if err != nil {
+        log.Errorf("removing %s: %s", id, err)
+        return &OpError{Op: "delete api key", Name: id, Err: err, RolledBack: true}
+    }
+
+    log.Infof("deleted key %v", id)
+    return nil
+}
+
+/*
+ * FindApiKey returns the stored key matching key.
+ */
+func FindApiKey(ctx context.Context, key string) (*model.ApiKeySpec, error) {
+    var kSpec model.ApiKeySpec
+
+    kSession := BrokerDB.Session.Copy()
+    defer kSession.Close()
+
+    err := kSession.DB(brokerDbName).C(apiKeysCollection).Find(bson.M{"hash": hashApiKey(key)}).One(&kSpec)
+    if err == mgo.ErrNotFound {
+        return &kSpec, ErrApiKeyNotFound
+    }
+    return &kSpec, err
+}
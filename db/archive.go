@@ -0,0 +1,206 @@
+package db
+
+/*
+ * Backup archives are gzipped tar files holding, for every collection, a
+ * <collection>.metadata.bson document with its index definitions and a
+ * <collection>.bson file of concatenated documents.  This is the layout
+ * mongodump uses for a directory dump.
+ */
+
+import (
+    "archive/tar"
+    "bytes"
+    "compress/gzip"
+    "encoding/binary"
+    "errors"
+    "io"
+    "io/ioutil"
+    "os"
+    "strings"
+    "time"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const (
+    archiveMetaSuffix = ".metadata.bson"
+    archiveDataSuffix = ".bson"
+)
+
+type archiveMeta struct {
+    Collection string      `bson:"collection"`
+    Indexes    []mgo.Index `bson:"indexes"`
+}
+
+/*
+ * writeArchive dumps every collection of d to w and returns the
+ * collections written and the number of documents.
+ */
+func writeArchive(d *mgo.Database, w io.Writer) ([]string, int, error) {
+    var colls []string
+    var docs int
+
+    names, err := d.CollectionNames()
+    if err != nil {
+        return colls, docs, err
+    }
+
+    gz := gzip.NewWriter(w)
+    tw := tar.NewWriter(gz)
+
+    for _, name := range names {
+        if strings.HasPrefix(name, "system.") {
+            continue
+        }
+
+        c := d.C(name)
+
+        indexes, err := c.Indexes()
+        if err != nil {
+            return colls, docs, err
+        }
+
+        meta, err := bson.Marshal(archiveMeta{Collection: name, Indexes: indexes})
+        if err != nil {
+            return colls, docs, err
+        }
+
+        err = writeTarEntry(tw, name+archiveMetaSuffix, bytes.NewReader(meta), int64(len(meta)))
+        if err != nil {
+            return colls, docs, err
+        }
+
+        n, err := writeCollection(tw, c)
+        docs += n
+        if err != nil {
+            return colls, docs, err
+        }
+
+        colls = append(colls, name)
+    }
+
+    err = tw.Close()
+    if err != nil {
+        return colls, docs, err
+    }
+    return colls, docs, gz.Close()
+}
+
+/*
+ * Tar entries need their size up front, so documents are spooled to a
+ * temporary file rather than held in memory.
+ */
+func writeCollection(tw *tar.Writer, c *mgo.Collection) (int, error) {
+    var raw bson.Raw
+    var n int
+
+    tmp, err := ioutil.TempFile("", "mongodb-api-dump-")
+    if err != nil {
+        return n, err
+    }
+    defer os.Remove(tmp.Name())
+    defer tmp.Close()
+
+    iter := c.Find(nil).Iter()
+    for iter.Next(&raw) {
+        _, err = tmp.Write(raw.Data)
+        if err != nil {
+            iter.Close()
+            return n, err
+        }
+        n++
+    }
+    err = iter.Close()
+    if err != nil {
+        return n, err
+    }
+
+    size, err := tmp.Seek(0, io.SeekCurrent)
+    if err != nil {
+        return n, err
+    }
+    _, err = tmp.Seek(0, io.SeekStart)
+    if err != nil {
+        return n, err
+    }
+
+    return n, writeTarEntry(tw, c.Name+archiveDataSuffix, tmp, size)
+}
+
+func writeTarEntry(tw *tar.Writer, name string, r io.Reader, size int64) error {
+    err := tw.WriteHeader(&tar.Header{
+        Name:    name,
+        Mode:    0600,
+        Size:    size,
+        ModTime: time.Now(),
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = io.Copy(tw, r)
+    return err
+}
+
+/*
+ * readArchive calls fn with the name and contents of every entry of an
+ * archive written by writeArchive, in order.
+ */
+func readArchive(r io.Reader, fn func(name string, r io.Reader) error) error {
+    gz, err := gzip.NewReader(r)
+    if err != nil {
+        return err
+    }
+    defer gz.Close()
+
+    tr := tar.NewReader(gz)
+    for {
+        hdr, err := tr.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+
+        err = fn(hdr.Name, tr)
+        if err != nil {
+            return err
+        }
+    }
+}
+
+/*
+ * readDocuments splits a stream of concatenated BSON documents.
+ */
+func readDocuments(r io.Reader, fn func(doc bson.Raw) error) error {
+    var size [4]byte
+
+    for {
+        _, err := io.ReadFull(r, size[:])
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+
+        n := int(binary.LittleEndian.Uint32(size[:]))
+        if n < 5 {
+            return errors.New("invalid document size in archive")
+        }
+
+        data := make([]byte, n)
+        copy(data, size[:])
+        _, err = io.ReadFull(r, data[4:])
+        if err != nil {
+            return err
+        }
+
+        err = fn(bson.Raw{Kind: 0x03, Data: data})
+        if err != nil {
+            return err
+        }
+    }
+}
@@ -0,0 +1,194 @@
+package db
+
+/*
+ * Logical backups of instance databases.  Archives go to the configured
+ * storage backend and their metadata to the backups collection.
+ */
+
+import (
+    "context"
+    "errors"
+    "io"
+    "os"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+    "mongodb-api/storage"
+
+    "github.com/nu7hatch/gouuid"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const backupsCollection string = "backups"
+
+var backupStore storage.Store
+
+/*
+ * ErrNoBackupStore is returned by backups and restores when the storage
+ * backend could not be set up at startup.
+ */
+var ErrNoBackupStore = errors.New("Backup storage is not configured")
+
+func backupsInit() error {
+    var err error
+
+    backupStore, err = storage.New(os.Getenv("BACKUP_STORAGE"), os.Getenv("BACKUP_DIR"))
+    if err != nil {
+        return err
+    }
+
+    return BrokerDB.C(backupsCollection).EnsureIndex(mgo.Index{
+        Key: []string{"database", "-created"},
+    })
+}
+
+type archiveResult struct {
+    collections []string
+    documents   int
+    err         error
+}
+
+/*
+ * CreateBackup dumps dbName to the backup store and waits for it to
+ * finish.  A failed dump is kept as a failed backup with the reason.
+ */
+func CreateBackup(ctx context.Context, dbName string) (*model.BackupSpec, error) {
+    log := logger.FromContext(ctx)
+
+    var bSpec model.BackupSpec
+
+    if backupStore == nil {
+        return &bSpec, ErrNoBackupStore
+    }
+
+    dbSpec, err := GetDbInfo(ctx, dbName)
+    if err != nil {
+        log.Errorf("unable to find: %v", dbName)
+        return &bSpec, err
+    }
+    if dbSpec.Status != model.StatusActive {
+        return &bSpec, errors.New("Instance is " + dbSpec.Status)
+    }
+
+    id, err := uuid.NewV4()
+    if err != nil {
+        return &bSpec, &OpError{Op: "backup", Name: dbName, Err: err, RolledBack: true}
+    }
+
+    bSpec.Id = id.String()
+    bSpec.Database = dbName
+    bSpec.Status = model.BackupRunning
+    bSpec.Created = time.Now()
+    bSpec.Key = dbName + "/" + bSpec.Id + ".tar.gz"
+
+    iSession, err := instanceSession(dbSpec)
+    if err != nil {
+        return &bSpec, &OpError{Op: "backup", Name: dbName, Err: err, RolledBack: true}
+    }
+    defer iSession.Close()
+
+    bSession := BrokerDB.Session.Copy()
+    defer bSession.Close()
+
+    c := bSession.DB(brokerDbName).C(backupsCollection)
+
+    err = c.Insert(&bSpec)
+    if err != nil {
+        log.Errorf("inserting backup for %s: %s", dbName, err)
+        return &bSpec, &OpError{Op: "backup", Name: dbName, Err: err, RolledBack: true}
+    }
+
+    log.Infof("dump %s to %s", dbName, bSpec.Key)
+
+    pr, pw := io.Pipe()
+    done := make(chan archiveResult, 1)
+
+    go func() {
+        colls, docs, err := writeArchive(iSession.DB(dbName), pw)
+        pw.CloseWithError(err)
+        done <- archiveResult{colls, docs, err}
+    }()
+
+    size, err := backupStore.Put(bSpec.Key, pr)
+    pr.Close()
+    result := <-done
+    if err == nil {
+        err = result.err
+    }
+
+    bSpec.Collections = result.collections
+    bSpec.Documents = result.documents
+    finished := time.Now()
+    bSpec.Finished = &finished
+
+    if err != nil {
+        log.Errorf("dumping %s: %s", dbName, err)
+        backupStore.Delete(bSpec.Key)
+        bSpec.Status = model.BackupFailed
+        bSpec.Error = err.Error()
+        c.Update(bson.M{"id": bSpec.Id}, &bSpec)
+        return &bSpec, &OpError{Op: "backup", Name: dbName, Err: err, RolledBack: true}
+    }
+
+    bSpec.Status = model.BackupCompleted
+    bSpec.Size = size
+
+    err = c.Update(bson.M{"id": bSpec.Id}, &bSpec)
+    if err != nil {
+        log.Errorf("updating backup %s: %s", bSpec.Id, err)
+        return &bSpec, &OpError{Op: "backup", Name: dbName, Err: err, RolledBack: false}
+    }
+
+    log.Infof("%s: %d collections, %d documents, %d bytes", bSpec.Id, len(bSpec.Collections), bSpec.Documents, bSpec.Size)
+    return &bSpec, nil
+}
+
+func GetBackups(ctx context.Context, dbName string) (*[]model.BackupSpec, error) {
+    log := logger.FromContext(ctx)
+
+    lBSpec := []model.BackupSpec{}
+
+    bSession := BrokerDB.Session.Copy()
+    defer bSession.Close()
+
+    c := bSession.DB(brokerDbName).C(backupsCollection)
+
+    err := c.Find(bson.M{"database": dbName}).Sort("-created").All(&lBSpec)
+    if err != nil {
+        log.Errorf("listing for %s: %s", dbName, err)
+    }
+    return &lBSpec, err
+}
+
+func GetBackup(ctx context.Context, dbName string, id string) (*model.BackupSpec, error) {
+    log := logger.FromContext(ctx)
+
+    var bSpec model.BackupSpec
+
+    bSession := BrokerDB.Session.Copy()
+    defer bSession.Close()
+
+    c := bSession.DB(brokerDbName).C(backupsCollection)
+
+    err := c.Find(bson.M{"database": dbName, "id": id}).One(&bSpec)
+    if err != nil {
+        log.Errorf("finding %s for %s: %s", id, dbName, err)
+    }
+    return &bSpec, err
+}
+
+/*
+ * OpenBackup returns the archive of a completed backup.  The caller
+ * closes it.
+ */
+func OpenBackup(ctx context.Context, bSpec *model.BackupSpec) (io.ReadCloser, error) {
+    if backupStore == nil {
+        return nil, ErrNoBackupStore
+    }
+    if bSpec.Status != model.BackupCompleted {
+        return nil, errors.New("Backup is " + bSpec.Status)
+    }
+    return backupStore.Get(bSpec.Key)
+}
@@ -0,0 +1,144 @@
+package db
+
+/*
+ * Usage snapshots taken by the usage monitor, and the billing report
+ * built from them.
+ */
+
+import (
+    "context"
+    "sort"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const usageCollection string = "usage"
+
+/*
+ * Snapshots older than USAGE_RETENTION are removed by the server.  The
+ * index is changed in place when the retention is, since creating it again
+ * with another expiry fails.
+ */
+func usageInit() error {
+    c := BrokerDB.C(usageCollection)
+
+    err := c.EnsureIndex(mgo.Index{
+        Key: []string{"time", "billingcode"},
+    })
+    if err != nil {
+        return err
+    }
+
+    if usageRetention <= 0 {
+        log.Warnf("USAGE_RETENTION is %s, usage snapshots are kept forever", usageRetention)
+        return nil
+    }
+
+    err = c.EnsureIndex(mgo.Index{
+        Key:         []string{"time"},
+        ExpireAfter: usageRetention,
+    })
+    if err == nil {
+        return nil
+    }
+
+    log.Infof("changing usage expiry to %s: %v", usageRetention, err)
+    return BrokerDB.Run(bson.D{
+        {Name: "collMod", Value: usageCollection},
+        {Name: "index", Value: bson.M{
+            "keyPattern":         bson.M{"time": 1},
+            "expireAfterSeconds": int(usageRetention.Seconds()),
+        }},
+    }, nil)
+}
+
+func recordUsage(s *mgo.Session, dbSpec *model.DatabaseSpec, usage int64, at time.Time) error {
+    return s.DB(brokerDbName).C(usageCollection).Insert(&model.UsageSnapshot{
+        Name:        dbSpec.Name,
+        BillingCode: dbSpec.BillingCode,
+        Plan:        dbSpec.Plan,
+        Usage:       usage,
+        Time:        at,
+    })
+}
+
+/*
+ * GetBillingReport groups the snapshots taken in [from, to) by billing
+ * code.  An instance's usage is the largest it reached in the period, its
+ * plan the last one it was on, and it is billed for every UTC day on
+ * which it was measured.
+ */
+func GetBillingReport(ctx context.Context, from time.Time, to time.Time) (*[]model.BillingReport, error) {
+    log := logger.FromContext(ctx)
+
+    var snap model.UsageSnapshot
+
+    type instanceUsage struct {
+        model.BillingInstance
+        billingCode string
+        days        map[string]bool
+    }
+
+    rSession := BrokerDB.Session.Copy()
+    defer rSession.Close()
+
+    c := rSession.DB(brokerDbName).C(usageCollection)
+
+    instances := map[string]*instanceUsage{}
+    iter := c.Find(bson.M{"time": bson.M{"$gte": from, "$lt": to}}).Sort("time").Iter()
+    for iter.Next(&snap) {
+        iu, ok := instances[snap.Name]
+        if !ok {
+            iu = &instanceUsage{days: map[string]bool{}}
+            iu.Name = snap.Name
+            instances[snap.Name] = iu
+        }
+        iu.billingCode = snap.BillingCode
+        iu.Plan = snap.Plan
+        if snap.Usage > iu.Usage {
+            iu.Usage = snap.Usage
+        }
+        iu.days[snap.Time.UTC().Format("2006-01-02")] = true
+        snap = model.UsageSnapshot{}
+    }
+
+    if err := iter.Close(); err != nil {
+        log.Errorf("%v", err)
+        return nil, &OpError{Op: "billing report", Name: from.Format(time.RFC3339) + " to " + to.Format(time.RFC3339), Err: err, RolledBack: true}
+    }
+
+    byCode := map[string]*model.BillingReport{}
+    for _, iu := range instances {
+        iu.InstanceDays = len(iu.days)
+
+        report, ok := byCode[iu.billingCode]
+        if !ok {
+            report = &model.BillingReport{
+                BillingCode: iu.billingCode,
+                Instances:   []model.BillingInstance{},
+            }
+            byCode[iu.billingCode] = report
+        }
+        report.Instances = append(report.Instances, iu.BillingInstance)
+        report.Usage += iu.Usage
+        report.InstanceDays += iu.InstanceDays
+    }
+
+    reports := []model.BillingReport{}
+    for _, report := range byCode {
+        sort.Slice(report.Instances, func(i, j int) bool {
+            return report.Instances[i].Name < report.Instances[j].Name
+        })
+        reports = append(reports, *report)
+    }
+    sort.Slice(reports, func(i, j int) bool {
+        return reports[i].BillingCode < reports[j].BillingCode
+    })
+
+    return &reports, nil
+}
@@ -0,0 +1,353 @@
+package db
+
+/*
+ * Moving an instance between plans.  When the target plan is placed on
+ * other clusters the data, users and credentials are copied across first.
+ */
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+var ErrInstanceBusy = errors.New("Instance is busy, try again")
+
+/*
+ * ChangePlan moves dbName to plan.  A change is refused when the data
+ * already stored is over the size of the target plan.
+ */
+func ChangePlan(ctx context.Context, dbName string, plan string) (*model.DatabaseSpec, error) {
+    log := logger.FromContext(ctx)
+
+    if plan == "" {
+        return nil, errors.New("Plan not set")
+    }
+
+    target, ok := lookupPlan(plan)
+    if !ok {
+        return nil, errors.New("Invalid Plan")
+    }
+
+    dbSpec, err := GetDbInfo(ctx, dbName)
+    if err != nil {
+        log.Errorf("unable to find: %v", dbName)
+        return dbSpec, err
+    }
+    ilog := instanceLog(ctx, dbSpec)
+
+    if dbSpec.Plan == plan {
+        return dbSpec, nil
+    }
+    if dbSpec.Status != model.StatusActive {
+        return dbSpec, errors.New("Instance is " + dbSpec.Status)
+    }
+
+    limit, limited, err := parseSize(target.Size)
+    if err != nil {
+        return dbSpec, err
+    }
+
+    cSession := BrokerDB.Session.Copy()
+    defer cSession.Close()
+
+    iSession, err := instanceSession(dbSpec)
+    if err != nil {
+        return dbSpec, &OpError{Op: "change plan", Name: dbName, Err: err, RolledBack: true}
+    }
+    defer iSession.Close()
+
+    stats, err := getDbStats(iSession.DB(dbName))
+    if err != nil {
+        ilog.Errorf("getting stats for %s: %s", dbName, err)
+        return dbSpec, &OpError{Op: "change plan", Name: dbName, Err: err, RolledBack: true}
+    }
+
+    if limited && stats.DataSize > limit {
+        return dbSpec, fmt.Errorf("Database size %d bytes exceeds the %s limit of plan %s",
+            stats.DataSize, target.Size, plan)
+    }
+
+    /*
+     * Only one change may start from the active instance, another change,
+     * a rotation or a delete that got there first makes it busy.  The
+     * target plan is recorded before it is checked again, so a DeletePlan
+     * either counts this change or has already marked the plan.
+     */
+    active := bson.M{"$in": []interface{}{model.StatusActive, "", nil}}
+    err = cSession.DB(brokerDbName).C(provisionCollection).Update(bson.M{"name": dbName, "status": active}, bson.M{
+        "$set": bson.M{
+            "status":        model.StatusUpdating,
+            "message":       "changing plan to " + plan,
+            "lasterror":     "",
+            "changingto":    plan,
+            "updated":       time.Now(),
+            "lastrequestid": logger.RequestId(ctx),
+        },
+    })
+    if err == mgo.ErrNotFound {
+        return dbSpec, ErrInstanceBusy
+    }
+    if err != nil {
+        ilog.Errorf("updating %s: %s", dbName, err)
+        return dbSpec, &OpError{Op: "change plan", Name: dbName, Err: err, RolledBack: true}
+    }
+
+    usable, err := planUsable(cSession, plan)
+    if err != nil {
+        opErr := &OpError{Op: "change plan", Name: dbName, Err: err, RolledBack: true}
+        endPlanChange(ctx, cSession, dbName, model.StatusActive, opErr.Error())
+        return dbSpec, opErr
+    }
+    if !usable {
+        endPlanChange(ctx, cSession, dbName, model.StatusActive, "")
+        return dbSpec, errors.New("Invalid Plan")
+    }
+
+    var migrated *migration
+
+    cluster, err := getCluster(dbSpec.Cluster)
+    if err == nil && !clusterIn(cluster.Name, planClusters(target)) {
+        cluster, err = placeInstance(ctx, cSession, target)
+        if err == nil {
+            migrated, err = migrateDatabase(ctx, dbSpec, iSession, cluster)
+        }
+    }
+    if err != nil {
+        ilog.Errorf("migrating %s: %s", dbName, err)
+        opErr := &OpError{Op: "change plan", Name: dbName, Err: err, RolledBack: true}
+        endPlanChange(ctx, cSession, dbName, model.StatusActive, opErr.Error())
+        return dbSpec, opErr
+    }
+
+    newSpec := *dbSpec
+    newSpec.Plan = plan
+    newSpec.Cluster = cluster.Name
+    newSpec.Host = cluster.Conn.DbHosts[0]
+    newSpec.Port = cluster.Conn.DbPort
+    newSpec.Status = model.StatusActive
+    newSpec.Message = ""
+    newSpec.LastError = ""
+    newSpec.Updated = time.Now()
+
+    update := bson.M{
+        "plan":      newSpec.Plan,
+        "cluster":   newSpec.Cluster,
+        "host":      newSpec.Host,
+        "port":      newSpec.Port,
+        "status":    newSpec.Status,
+        "message":   newSpec.Message,
+        "lasterror": newSpec.LastError,
+        "updated":   newSpec.Updated,
+    }
+    if migrated != nil {
+        newSpec.RetiredUsers = migrated.retired
+        update["retiredusers"] = migrated.retired
+    }
+
+    err = cSession.DB(brokerDbName).C(provisionCollection).Update(bson.M{"name": dbName}, bson.M{
+        "$set":   update,
+        "$unset": bson.M{"changingto": ""},
+    })
+    if err != nil {
+        ilog.Errorf("updating %s: %s", dbName, err)
+        opErr := &OpError{Op: "change plan", Name: dbName, Err: err, RolledBack: true}
+        if migrated != nil && !migrated.undo() {
+            opErr.RolledBack = false
+        }
+        status := model.StatusActive
+        if !opErr.RolledBack {
+            status = model.StatusFailed
+        }
+        endPlanChange(ctx, cSession, dbName, status, opErr.Error())
+        return dbSpec, opErr
+    }
+
+    /*
+     * The record now points at the new copy, only then is the old one
+     * removed.  What cannot be removed is left for the drift report.
+     */
+    if migrated != nil {
+        migrated.dropSource()
+    }
+
+    ilog.Infof("%s now on plan %s", dbName, plan)
+    return &newSpec, nil
+}
+
+/*
+ * endPlanChange sets the status a plan change that did not happen ended
+ * with, and lets DeletePlan forget the plan it was changing to.
+ */
+func endPlanChange(ctx context.Context, s *mgo.Session, dbName string, status string, lastError string) {
+    setStatus(ctx, dbName, status, "", lastError)
+
+    err := s.DB(brokerDbName).C(provisionCollection).Update(bson.M{"name": dbName}, bson.M{
+        "$unset": bson.M{"changingto": ""},
+    })
+    if err != nil {
+        logger.FromContext(ctx).Errorf("updating %s: %s", dbName, err)
+    }
+}
+
+/*
+ * A database copied to another cluster, with the source kept read only
+ * until the record points at the copy.
+ */
+type migration struct {
+    ctx     context.Context
+    dbSpec  *model.DatabaseSpec
+    src     *mgo.Session
+    dst     *mgo.Session
+    creds   []model.CredentialSpec
+    retired []model.RetiredUser
+}
+
+/*
+ * migrateDatabase makes the users of dbSpec read only on src, then copies
+ * the database and its users, rotated users still in their grace period
+ * included, to cluster.  If the copy fails the new copy is removed and the
+ * original users get their roles back.
+ */
+func migrateDatabase(ctx context.Context, dbSpec *model.DatabaseSpec, src *mgo.Session, cluster *Cluster) (*migration, error) {
+    ilog := instanceLog(ctx, dbSpec)
+
+    creds, err := GetCredentials(ctx, dbSpec.Name)
+    if err != nil {
+        return nil, err
+    }
+
+    m := &migration{
+        ctx:    ctx,
+        dbSpec: dbSpec,
+        src:    src,
+        dst:    cluster.Session.Copy(),
+        creds:  *creds,
+    }
+
+    /*
+     * Nothing may be written to the source while it is copied.
+     */
+    err = setUserRoles(ctx, src, dbSpec, overQuotaRoles)
+    if err != nil {
+        m.undo()
+        return nil, err
+    }
+
+    err = m.dst.DB(dbSpec.Name).UpsertUser(instanceUser(dbSpec))
+    if err != nil {
+        m.undo()
+        return nil, err
+    }
+    for i := range m.creds {
+        err = m.dst.DB(dbSpec.Name).UpsertUser(credentialUser(dbSpec, &m.creds[i]))
+        if err != nil {
+            m.undo()
+            return nil, err
+        }
+    }
+
+    /*
+     * Rotated users from before their passwords were kept cannot be
+     * copied, they expire with the move.
+     */
+    m.retired = []model.RetiredUser{}
+    for _, ru := range dbSpec.RetiredUsers {
+        if ru.Password == "" {
+            ilog.Warnf("retired user %s expires with the move to %s", ru.Username, cluster.Name)
+            continue
+        }
+
+        rSpec := *dbSpec
+        rSpec.Username = ru.Username
+        rSpec.Password, err = decryptPassword(ru.Password)
+        if err == nil {
+            err = m.dst.DB(dbSpec.Name).UpsertUser(instanceUser(&rSpec))
+        }
+        if err != nil {
+            m.undo()
+            return nil, err
+        }
+        m.retired = append(m.retired, ru)
+    }
+
+    ilog.Infof("copy %s to cluster %s", dbSpec.Name, cluster.Name)
+
+    pr, pw := io.Pipe()
+    go func() {
+        _, _, err := writeArchive(src.DB(dbSpec.Name), pw)
+        pw.CloseWithError(err)
+    }()
+
+    err = replayArchive(m.dst.DB(dbSpec.Name), pr, &model.RestoreSpec{Drop: true}, func() {})
+    pr.Close()
+    if err != nil {
+        m.undo()
+        return nil, err
+    }
+
+    return m, nil
+}
+
+/*
+ * undo removes the copy and gives the source users their roles back,
+ * returning whether that worked.
+ */
+func (m *migration) undo() bool {
+    ilog := instanceLog(m.ctx, m.dbSpec)
+    defer m.dst.Close()
+
+    d := m.dst.DB(m.dbSpec.Name)
+    d.RemoveUser(m.dbSpec.Username)
+    for _, ru := range m.retired {
+        d.RemoveUser(ru.Username)
+    }
+    for i := range m.creds {
+        d.RemoveUser(m.creds[i].Username)
+    }
+    d.DropDatabase()
+
+    err := setUserRoles(m.ctx, m.src, m.dbSpec, nil)
+    if err != nil {
+        ilog.Errorf("restoring users of %s: %s", m.dbSpec.Name, err)
+        return false
+    }
+    return true
+}
+
+/*
+ * dropSource removes the users and the database from the old cluster.
+ */
+func (m *migration) dropSource() {
+    ilog := instanceLog(m.ctx, m.dbSpec)
+    defer m.dst.Close()
+
+    d := m.src.DB(m.dbSpec.Name)
+
+    usernames := []string{m.dbSpec.Username}
+    for _, ru := range m.dbSpec.RetiredUsers {
+        usernames = append(usernames, ru.Username)
+    }
+    for i := range m.creds {
+        usernames = append(usernames, m.creds[i].Username)
+    }
+    for _, username := range usernames {
+        err := d.RemoveUser(username)
+        if err != nil && err != mgo.ErrNotFound {
+            ilog.Errorf("removing old user %s of %s: %s", username, m.dbSpec.Name, err)
+        }
+    }
+
+    err := d.DropDatabase()
+    if err != nil {
+        ilog.Errorf("dropping old copy of %s: %s", m.dbSpec.Name, err)
+    }
+}
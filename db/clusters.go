@@ -0,0 +1,211 @@
+package db
+
+/*
+ * Backend clusters instance databases are placed on.  The cluster read
+ * from MONGODB_SECRET is called default and also holds the broker
+ * database; MONGODB_CLUSTERS adds more as name=secret pairs separated by
+ * commas.  Plans list the clusters their databases may be placed on.
+ */
+
+import (
+    "context"
+    "crypto/tls"
+    "errors"
+    "net"
+    "os"
+    "strings"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/akkeris/vault-client"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const defaultCluster string = "default"
+
+type Cluster struct {
+    Name    string
+    Conn    MdbConn
+    Session *mgo.Session
+}
+
+var (
+    clusters     = map[string]*Cluster{}
+    clusterNames []string
+)
+
+var ErrUnknownCluster = errors.New("Unknown cluster")
+
+func readConn(secretPath string) MdbConn {
+    var conn MdbConn
+
+    secret := vault.GetSecret(secretPath)
+    conn.DbUrl = vaulthelper(secret, "url")
+    conn.DbHosts = strings.Split(vaulthelper(secret, "hostname"), ",")
+    conn.DbPort = vaulthelper(secret, "port")
+    conn.DbAdminUser = vaulthelper(secret, "user")
+    conn.DbAdminPass = vaulthelper(secret, "pass")
+    conn.AuthDb = vaulthelper(secret, "authdb")
+    return conn
+}
+
+func dial(conn MdbConn) (*mgo.Session, error) {
+    s, err := mgo.DialWithInfo(&mgo.DialInfo{
+        Addrs:    conn.DbHosts,
+        Source:   conn.AuthDb,
+        Database: brokerDbName,
+        Username: conn.DbAdminUser,
+        Password: conn.DbAdminPass,
+        Timeout:  time.Second * 30,
+        Direct:   true,
+        FailFast: true,
+        DialServer: func(addr *mgo.ServerAddr) (net.Conn, error) {
+            return tls.Dial("tcp", addr.String(), nil)
+        },
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    s.SetMode(mgo.Monotonic, true)
+    return s, nil
+}
+
+func registerCluster(name string, conn MdbConn, s *mgo.Session) {
+    if _, ok := clusters[name]; !ok {
+        clusterNames = append(clusterNames, name)
+    }
+    clusters[name] = &Cluster{Name: name, Conn: conn, Session: s}
+    log.Infof("%s: %v", name, conn.DbHosts)
+}
+
+/*
+ * clustersInit registers the default cluster and dials the others.  A
+ * cluster that cannot be reached is left out, so plans placed only on it
+ * fail to provision instead of the broker failing to start.
+ */
+func clustersInit() {
+    registerCluster(defaultCluster, Dbc, Session)
+
+    for _, entry := range strings.Split(os.Getenv("MONGODB_CLUSTERS"), ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+
+        kv := strings.SplitN(entry, "=", 2)
+        if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+            log.Errorf("invalid cluster %q, want name=secret", entry)
+            continue
+        }
+        if kv[0] == defaultCluster {
+            log.Errorf("%s is reserved for MONGODB_SECRET", defaultCluster)
+            continue
+        }
+
+        conn := readConn(kv[1])
+        s, err := dial(conn)
+        if err != nil {
+            log.Errorf("opening cluster %s: %s", kv[0], err)
+            continue
+        }
+        registerCluster(kv[0], conn, s)
+    }
+}
+
+func getCluster(name string) (*Cluster, error) {
+    if name == "" {
+        name = defaultCluster
+    }
+    c, ok := clusters[name]
+    if !ok {
+        return nil, ErrUnknownCluster
+    }
+    return c, nil
+}
+
+/*
+ * instanceSession returns a session on the cluster holding dbSpec, to be
+ * closed by the caller.  Records from before clusters were tracked are on
+ * the default cluster.
+ */
+func instanceSession(dbSpec *model.DatabaseSpec) (*mgo.Session, error) {
+    c, err := getCluster(dbSpec.Cluster)
+    if err != nil {
+        return nil, err
+    }
+    return c.Session.Copy(), nil
+}
+
+/*
+ * Clusters a plan may place databases on, the default cluster when the
+ * plan does not say.
+ */
+func planClusters(pSpec *model.PlanSpec) []string {
+    if len(pSpec.Clusters) == 0 {
+        return []string{defaultCluster}
+    }
+    return pSpec.Clusters
+}
+
+func validateClusters(names []string) error {
+    for _, name := range names {
+        if _, ok := clusters[name]; !ok {
+            return errors.New("Unknown cluster " + name)
+        }
+    }
+    return nil
+}
+
+/*
+ * placeInstance picks the cluster of the plan holding the fewest
+ * databases.
+ */
+func placeInstance(ctx context.Context, s *mgo.Session, pSpec *model.PlanSpec) (*Cluster, error) {
+    log := logger.FromContext(ctx)
+
+    var best *Cluster
+    bestCount := -1
+
+    for _, name := range planClusters(pSpec) {
+        c, ok := clusters[name]
+        if !ok {
+            log.Warnf("plan %s cluster %s is not available", pSpec.Name, name)
+            continue
+        }
+
+        filter := bson.M{"cluster": name}
+        if name == defaultCluster {
+            filter = bson.M{"cluster": bson.M{"$in": []interface{}{name, "", nil}}}
+        }
+        n, err := s.DB(brokerDbName).C(provisionCollection).Find(filter).Count()
+        if err != nil {
+            return nil, err
+        }
+
+        if bestCount < 0 || n < bestCount {
+            best = c
+            bestCount = n
+        }
+    }
+
+    if best == nil {
+        return nil, errors.New("No cluster available for plan " + pSpec.Name)
+    }
+    return best, nil
+}
+
+func clusterIn(name string, names []string) bool {
+    if name == "" {
+        name = defaultCluster
+    }
+    for _, n := range names {
+        if n == name {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,241 @@
+package db
+
+/*
+ * Additional named credentials on an instance database.  Each one is a
+ * separate user with its own role profile, tracked in the credentials
+ * collection next to the provision record.
+ */
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const credentialsCollection string = "credentials"
+
+var roleProfiles = map[string][]mgo.Role{
+    model.RoleReadOnly:  {mgo.RoleRead},
+    model.RoleReadWrite: {mgo.RoleReadWrite},
+    model.RoleAdmin:     {mgo.RoleReadWrite, mgo.RoleDBAdmin},
+}
+
+func credentialsInit() error {
+    return BrokerDB.C(credentialsCollection).EnsureIndex(mgo.Index{
+        Key:    []string{"database", "name"},
+        Unique: true,
+    })
+}
+
+/*
+ * credentialUser is the user for cSpec on dbSpec, read only while writes
+ * to the instance are revoked.
+ */
+func credentialUser(dbSpec *model.DatabaseSpec, cSpec *model.CredentialSpec) *mgo.User {
+    return &mgo.User{
+        Username: cSpec.Username,
+        Password: cSpec.Password,
+        Roles:    credentialRoles(dbSpec, cSpec, nil),
+        CustomData: model.InfoData{
+            DatabaseName: cSpec.Database,
+            BillingCode:  dbSpec.BillingCode,
+        },
+    }
+}
+
+/*
+ * AddCredential creates a new user on dbName.  The role defaults to
+ * read-write.
+ */
+func AddCredential(ctx context.Context, dbName string, in model.CredentialRequest) (*model.CredentialSpec, error) {
+    log := logger.FromContext(ctx)
+
+    var cSpec model.CredentialSpec
+
+    if in.Name == "" {
+        return &cSpec, errors.New("Credential name not set")
+    }
+    if in.Role == "" {
+        in.Role = model.RoleReadWrite
+    }
+    if _, ok := roleProfiles[in.Role]; !ok {
+        return &cSpec, errors.New("Invalid role " + in.Role)
+    }
+
+    dbSpec, err := GetDbInfo(ctx, dbName)
+    if err != nil {
+        log.Errorf("unable to find: %v", dbName)
+        return &cSpec, err
+    }
+    if dbSpec.Status != model.StatusActive {
+        return &cSpec, errors.New("Instance is " + dbSpec.Status)
+    }
+
+    iSession, err := instanceSession(dbSpec)
+    if err != nil {
+        return &cSpec, &OpError{Op: "add credential", Name: dbName, Err: err, RolledBack: true}
+    }
+    defer iSession.Close()
+
+    cSession := BrokerDB.Session.Copy()
+    defer cSession.Close()
+
+    c := cSession.DB(brokerDbName).C(credentialsCollection)
+
+    plan, _ := lookupPlan(dbSpec.Plan)
+
+    cSpec.Name = in.Name
+    cSpec.Database = dbName
+    cSpec.Role = in.Role
+    cSpec.Username, cSpec.Password, err = newCredentials(ctx, iSession, plan)
+    if err != nil {
+        return &cSpec, &OpError{Op: "add credential", Name: dbName, Err: err, RolledBack: true}
+    }
+    cSpec.Created = time.Now()
+
+    sSpec, err := storedCredentialSpec(&cSpec)
+    if err != nil {
+        return &cSpec, &OpError{Op: "add credential", Name: dbName, Err: err, RolledBack: true}
+    }
+
+    err = c.Insert(sSpec)
+    if mgo.IsDup(err) {
+        return &cSpec, errors.New("Credential " + in.Name + " already exists")
+    } else if err != nil {
+        log.Errorf("inserting %s for %s: %s", in.Name, dbName, err)
+        return &cSpec, &OpError{Op: "add credential", Name: dbName, Err: err, RolledBack: true}
+    }
+
+    log.Infof("add user %s (%s) to %s", cSpec.Username, cSpec.Role, dbName)
+    err = iSession.DB(dbName).UpsertUser(credentialUser(dbSpec, &cSpec))
+    if err != nil {
+        log.Errorf("adding user %s: %s", cSpec.Username, err)
+        opErr := &OpError{Op: "add credential", Name: dbName, Err: err, RolledBack: true}
+        if rErr := c.Remove(bson.M{"database": dbName, "name": in.Name}); rErr != nil {
+            log.Errorf("removing record %s: %s", in.Name, rErr)
+            opErr.RolledBack = false
+        }
+        return &cSpec, opErr
+    }
+
+    return &cSpec, nil
+}
+
+func GetCredential(ctx context.Context, dbName string, credName string) (*model.CredentialSpec, error) {
+    log := logger.FromContext(ctx)
+
+    var cSpec model.CredentialSpec
+
+    cSession := BrokerDB.Session.Copy()
+    defer cSession.Close()
+
+    c := cSession.DB(brokerDbName).C(credentialsCollection)
+
+    err := c.Find(bson.M{"database": dbName, "name": credName}).One(&cSpec)
+    if err != nil {
+        log.Errorf("finding %s for %s: %s", credName, dbName, err)
+        return &cSpec, err
+    }
+
+    cSpec.Password, err = decryptPassword(cSpec.Password)
+    return &cSpec, err
+}
+
+func GetCredentials(ctx context.Context, dbName string) (*[]model.CredentialSpec, error) {
+    log := logger.FromContext(ctx)
+
+    lCSpec := []model.CredentialSpec{}
+
+    cSession := BrokerDB.Session.Copy()
+    defer cSession.Close()
+
+    c := cSession.DB(brokerDbName).C(credentialsCollection)
+
+    err := c.Find(bson.M{"database": dbName}).Sort("name").All(&lCSpec)
+    if err != nil {
+        log.Errorf("listing for %s: %s", dbName, err)
+        return &lCSpec, err
+    }
+
+    for i := range lCSpec {
+        lCSpec[i].Password, err = decryptPassword(lCSpec[i].Password)
+        if err != nil {
+            return &lCSpec, err
+        }
+    }
+    return &lCSpec, nil
+}
+
+/*
+ * RemoveCredential revokes the user and forgets the credential.
+ */
+func RemoveCredential(ctx context.Context, dbName string, credName string) error {
+    cSpec, err := GetCredential(ctx, dbName, credName)
+    if err != nil {
+        return err
+    }
+
+    dbSpec, err := GetDbInfo(ctx, dbName)
+    if err != nil {
+        return err
+    }
+
+    iSession, err := instanceSession(dbSpec)
+    if err != nil {
+        return &OpError{Op: "remove credential", Name: dbName, Err: err, RolledBack: true}
+    }
+    defer iSession.Close()
+
+    return removeCredential(ctx, iSession, cSpec)
+}
+
+/*
+ * removeCredential drops the user through s, a session on the cluster
+ * holding the database, and then the record.
+ */
+func removeCredential(ctx context.Context, s *mgo.Session, cSpec *model.CredentialSpec) error {
+    log := logger.FromContext(ctx)
+
+    log.Infof("remove user %s from %s", cSpec.Username, cSpec.Database)
+    err := s.DB(cSpec.Database).RemoveUser(cSpec.Username)
+    if err != nil && err != mgo.ErrNotFound {
+        log.Errorf("removing user %s: %s", cSpec.Username, err)
+        return &OpError{Op: "remove credential", Name: cSpec.Database, Err: err, RolledBack: true}
+    }
+
+    cSession := BrokerDB.Session.Copy()
+    defer cSession.Close()
+
+    err = cSession.DB(brokerDbName).C(credentialsCollection).Remove(bson.M{"database": cSpec.Database, "name": cSpec.Name})
+    if err != nil {
+        log.Errorf("removing record %s: %s", cSpec.Name, err)
+        return &OpError{Op: "remove credential", Name: cSpec.Database, Err: err, RolledBack: false}
+    }
+    return nil
+}
+
+/*
+ * Revoke every additional credential of a database that is being removed.
+ */
+func removeAllCredentials(ctx context.Context, s *mgo.Session, dbName string) error {
+    var cSpec model.CredentialSpec
+
+    cSession := BrokerDB.Session.Copy()
+    defer cSession.Close()
+
+    iter := cSession.DB(brokerDbName).C(credentialsCollection).Find(bson.M{"database": dbName}).Iter()
+    for iter.Next(&cSpec) {
+        c := cSpec
+        if err := removeCredential(ctx, s, &c); err != nil {
+            iter.Close()
+            return err
+        }
+    }
+    return iter.Close()
+}
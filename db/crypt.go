@@ -0,0 +1,164 @@
+package db
+
+/*
+ * Encryption of the passwords kept in the broker database.  The key is a
+ * base64 encoded 32 byte AES key, read from the "key" field of the Vault
+ * secret at PASSWORD_KEY_SECRET or, for development, from the file at
+ * PASSWORD_KEY_FILE.  Encrypted values carry a prefix so records written
+ * before a key was configured can still be read.
+ */
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/base64"
+    "errors"
+    "io"
+    "io/ioutil"
+    "os"
+    "strings"
+
+    "mongodb-api/model"
+
+    "github.com/akkeris/vault-client"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const encryptedPrefix string = "enc:v1:"
+
+var passwordAEAD cipher.AEAD
+
+var ErrNoPasswordKey = errors.New("No password encryption key configured")
+
+func cryptInit() error {
+    var encoded string
+
+    if secret := os.Getenv("PASSWORD_KEY_SECRET"); secret != "" {
+        encoded = vaulthelper(vault.GetSecret(secret), "key")
+    } else if file := os.Getenv("PASSWORD_KEY_FILE"); file != "" {
+        b, err := ioutil.ReadFile(file)
+        if err != nil {
+            return err
+        }
+        encoded = string(b)
+    } else {
+        log.Warnf("no password key set, passwords are stored unencrypted")
+        return nil
+    }
+
+    key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+    if err != nil {
+        return errors.New("password key is not base64: " + err.Error())
+    }
+    if len(key) != 32 {
+        return errors.New("password key must be 32 bytes")
+    }
+
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return err
+    }
+    passwordAEAD, err = cipher.NewGCM(block)
+    return err
+}
+
+func encryptPassword(password string) (string, error) {
+    if passwordAEAD == nil || password == "" || strings.HasPrefix(password, encryptedPrefix) {
+        return password, nil
+    }
+
+    nonce := make([]byte, passwordAEAD.NonceSize())
+    if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+        return "", err
+    }
+
+    sealed := passwordAEAD.Seal(nonce, nonce, []byte(password), nil)
+    return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptPassword(stored string) (string, error) {
+    if !strings.HasPrefix(stored, encryptedPrefix) {
+        return stored, nil
+    }
+    if passwordAEAD == nil {
+        return "", ErrNoPasswordKey
+    }
+
+    sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedPrefix))
+    if err != nil {
+        return "", err
+    }
+    n := passwordAEAD.NonceSize()
+    if len(sealed) < n {
+        return "", errors.New("encrypted password is truncated")
+    }
+
+    plain, err := passwordAEAD.Open(nil, sealed[:n], sealed[n:], nil)
+    if err != nil {
+        return "", err
+    }
+    return string(plain), nil
+}
+
+/*
+ * Copies of specs as they are stored, with the password encrypted.
+ */
+func storedDbSpec(dbSpec *model.DatabaseSpec) (*model.DatabaseSpec, error) {
+    sSpec := *dbSpec
+    password, err := encryptPassword(dbSpec.Password)
+    sSpec.Password = password
+    return &sSpec, err
+}
+
+func storedCredentialSpec(cSpec *model.CredentialSpec) (*model.CredentialSpec, error) {
+    sSpec := *cSpec
+    password, err := encryptPassword(cSpec.Password)
+    sSpec.Password = password
+    return &sSpec, err
+}
+
+/*
+ * EncryptPasswords encrypts every password still stored in plaintext.
+ * It is safe to run more than once.
+ */
+func EncryptPasswords() (int, error) {
+    if passwordAEAD == nil {
+        return 0, ErrNoPasswordKey
+    }
+
+    eSession := BrokerDB.Session.Copy()
+    defer eSession.Close()
+
+    n := 0
+    for _, coll := range []string{provisionCollection, credentialsCollection} {
+        var doc struct {
+            Id       bson.ObjectId `bson:"_id"`
+            Password string        `bson:"password"`
+        }
+
+        c := eSession.DB(brokerDbName).C(coll)
+        notEncrypted := bson.M{"password": bson.M{"$exists": true, "$ne": "", "$not": bson.RegEx{Pattern: "^" + encryptedPrefix}}}
+
+        iter := c.Find(notEncrypted).Iter()
+        for iter.Next(&doc) {
+            password, err := encryptPassword(doc.Password)
+            if err != nil {
+                iter.Close()
+                return n, err
+            }
+            err = c.Update(bson.M{"_id": doc.Id, "password": doc.Password}, bson.M{"$set": bson.M{"password": password}})
+            if err != nil {
+                iter.Close()
+                return n, err
+            }
+            n++
+        }
+        if err := iter.Close(); err != nil {
+            return n, err
+        }
+    }
+
+    log.Infof("encrypted %d passwords", n)
+    return n, nil
+}
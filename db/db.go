@@ -4,18 +4,16 @@ package db
  * TODO: Add package documentation
  */
 import (
-    "crypto/tls"
+    "context"
     "errors"
-    "net"
     "os"
-    "strings"
     "time"
 
     "mongodb-api/logger"
     "mongodb-api/model"
 
-    "github.com/nu7hatch/gouuid"
     "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
 
     "github.com/akkeris/vault-client"
 )
@@ -30,13 +28,22 @@ type MdbConn struct {
 }
 
 var (
-    Dbc        MdbConn
-    Session    *mgo.Session
-    BrokerDB   *mgo.Database
-    plans      []model.PlanSpec
-    plansMap   map[string]string
-    log        = logger.Log
-    namePrefix string
+    Dbc          MdbConn
+    Session      *mgo.Session
+    BrokerDB     *mgo.Database
+    log          = logger.Log
+    namePrefix   string
+    rotateGrace  time.Duration
+    reapInterval time.Duration
+    planCacheTTL time.Duration
+    usageCheck   time.Duration
+    quotaEnforce bool
+
+    deleteRetention time.Duration
+    usageRetention  time.Duration
+    purgeInterval   time.Duration
+    driftInterval   time.Duration
+    driftRepair     bool
 )
 
 const (
@@ -45,6 +52,16 @@ const (
     plansCollection     string = "plans"
 )
 
+/*
+ * ErrNotFound is returned when no instance has the name or id asked for.
+ */
+var ErrNotFound = mgo.ErrNotFound
+
+var instanceRoles = []mgo.Role{
+    mgo.RoleReadWrite,
+    mgo.RoleDBAdmin,
+}
+
 /*
  * TODO: add function descriptions
  */
@@ -61,72 +78,62 @@ func vaulthelper(secret vault.VaultSecret, which string) (v string) {
 func setEnv() {
     mongodbSecret := os.Getenv("MONGODB_SECRET")
     if mongodbSecret == "" {
-        log.Fatal("(db.setEnv) MONGODB_SECRET secret not set")
+        log.Fatalf("MONGODB_SECRET secret not set")
     }
-    log.Print("(db.setEnv) MONGODB_SECRET: " + mongodbSecret)
-    log.Print("(db.setEnv) VAULT_ADDR: " + os.Getenv("VAULT_ADDR"))
-    log.Print("(db.setEnv) VAULT_TOKEN: " + os.Getenv("VAULT_TOKEN"))
+    log.Infof("MONGODB_SECRET: %v", mongodbSecret)
+    log.Infof("VAULT_ADDR: %v", os.Getenv("VAULT_ADDR"))
+    log.Infof("VAULT_TOKEN set: %v", os.Getenv("VAULT_TOKEN") != "")
 
-    secret := vault.GetSecret(mongodbSecret)
+    Dbc = readConn(mongodbSecret)
     dbc := &Dbc
-    dbc.DbUrl = vaulthelper(secret, "url")
-    dbc.DbHosts = strings.Split(vaulthelper(secret, "hostname"), ",")
-    dbc.DbPort = vaulthelper(secret, "port")
-    dbc.DbAdminUser = vaulthelper(secret, "user")
-    dbc.DbAdminPass = vaulthelper(secret, "pass")
-    dbc.AuthDb = vaulthelper(secret, "authdb")
-
-    // log.Println("(db.setEnv) dbUrl: ", dbc.DbUrl)
-    log.Println("(db.setEnv) dbHost: ", dbc.DbHosts)
-    log.Println("(db.setEnv) dbPort: ", dbc.DbPort)
-    log.Println("(db.setEnv) dbAdminUser: ", dbc.DbAdminUser)
-    //log.Println("dbAdminPass: ", dbc.DbAdminPass )
-    log.Println("(db.setEnv) authDb: ", dbc.AuthDb)
+
+    // log.Infof("dbUrl: %v", dbc.DbUrl)
+    log.Infof("dbHost: %v", dbc.DbHosts)
+    log.Infof("dbPort: %v", dbc.DbPort)
+    log.Infof("dbAdminUser: %v", dbc.DbAdminUser)
+    //log.Infof("dbAdminPass: %v", dbc.DbAdminPass)
+    log.Infof("authDb: %v", dbc.AuthDb)
 
     namePrefix = os.Getenv("NAME_PREFIX")
-    log.Println("(db.setEnv) namePrefix: ", namePrefix)
+    log.Infof("namePrefix: %v", namePrefix)
     if namePrefix == "" {
         namePrefix = "def"
     }
-    log.Println("(db.setEnv) namePrefix: ", namePrefix)
+    log.Infof("namePrefix: %v", namePrefix)
+
+    rotateGrace = durationEnv("ROTATE_GRACE_PERIOD", 24*time.Hour)
+    log.Infof("rotateGrace: %v", rotateGrace)
+    reapInterval = durationEnv("CREDENTIAL_REAP_INTERVAL", 5*time.Minute)
+    log.Infof("reapInterval: %v", reapInterval)
+    planCacheTTL = durationEnv("PLAN_CACHE_TTL", time.Minute)
+    log.Infof("planCacheTTL: %v", planCacheTTL)
+    usageCheck = durationEnv("USAGE_CHECK_INTERVAL", 15*time.Minute)
+    log.Infof("usageCheck: %v", usageCheck)
+    usageRetention = durationEnv("USAGE_RETENTION", 400*24*time.Hour)
+    log.Infof("usageRetention: %v", usageRetention)
+    quotaEnforce = os.Getenv("QUOTA_ENFORCE") == "true"
+    log.Infof("quotaEnforce: %v", quotaEnforce)
+    deleteRetention = durationEnv("DELETE_RETENTION", 7*24*time.Hour)
+    log.Infof("deleteRetention: %v", deleteRetention)
+    purgeInterval = durationEnv("PURGE_INTERVAL", 15*time.Minute)
+    log.Infof("purgeInterval: %v", purgeInterval)
+    driftInterval = durationEnv("DRIFT_CHECK_INTERVAL", time.Hour)
+    log.Infof("driftInterval: %v", driftInterval)
+    driftRepair = os.Getenv("DRIFT_REPAIR") == "true"
+    log.Infof("driftRepair: %v", driftRepair)
 }
 
-func plansInit() error {
-    var err error
-
-    pSession := BrokerDB.Session.Copy()
-    defer pSession.Close()
-
-    pColl := pSession.DB(brokerDbName).C(plansCollection)
-
-    err = pColl.Find(nil).All(&plans)
-
-    if err == nil {
-        if len(plans) < 1 {
-            log.Println("(db.plansInit) initialize collection")
-            plan := model.PlanSpec{
-                Name:        "shared",
-                Size:        "Unlimited",
-                Description: "Shared Server",
-            }
-            plans = append(plans, plan)
-            err = pColl.Insert(&plan)
-            plan = model.PlanSpec{
-                Name:        "ha",
-                Size:        "100gb",
-                Description: "High Availability",
-            }
-            plans = append(plans, plan)
-            err = pColl.Insert(&plan)
-        }
+func durationEnv(name string, def time.Duration) time.Duration {
+    v := os.Getenv(name)
+    if v == "" {
+        return def
     }
-
-    plansMap = map[string]string{}
-
-    for _, p := range plans {
-        plansMap[p.Name] = p.Description
+    d, err := time.ParseDuration(v)
+    if err != nil {
+        log.Warnf("invalid %s %q, using %s", name, v, def)
+        return def
     }
-    return err
+    return d
 }
 
 func Init() {
@@ -134,35 +141,19 @@ func Init() {
 
     setEnv()
 
-    mongoDBDialInfo := &mgo.DialInfo{
-        Addrs:    Dbc.DbHosts,
-        Source:   Dbc.AuthDb,
-        Database: brokerDbName,
-        Username: Dbc.DbAdminUser,
-        Password: Dbc.DbAdminPass,
-        Timeout:  time.Second * 30,
-        Direct:   true,
-        FailFast: true,
-        DialServer: func(addr *mgo.ServerAddr) (net.Conn, error) {
-            return tls.Dial("tcp", addr.String(), nil)
-        },
-    }
-
-    Session, err = mgo.DialWithInfo(mongoDBDialInfo)
+    Session, err = dial(Dbc)
 
     if err != nil {
-        log.Fatal("(db.Init) ERROR opening database:", err)
+        log.Fatalf("opening database: %v", err)
     }
 
-    Session.SetMode(mgo.Monotonic, true)
-
     bi, err := Session.BuildInfo()
 
     if err != nil {
-        log.Fatalln("(db.Init) Error: ", err)
+        log.Fatalf("Error: %v", err)
     }
 
-    log.Println("(db.Init) MongoDB Version: ", bi.Version)
+    log.Infof("MongoDB Version: %v", bi.Version)
 
     /*
      * Initialize broker db if not already.
@@ -172,9 +163,81 @@ func Init() {
 
     numProvisioned, _ := BrokerDB.C(provisionCollection).Count()
 
-    log.Println("(db.Init) BrokerDB:", brokerDbName)
-    log.Println("(db.Init) Provision Collection:", provisionCollection)
-    log.Println("(db.Init) num provisioned:", numProvisioned)
+    log.Infof("BrokerDB: %v", brokerDbName)
+    log.Infof("Provision Collection: %v", provisionCollection)
+    log.Infof("num provisioned: %v", numProvisioned)
+
+    /*
+     * Service broker instance ids must map to exactly one database.
+     */
+
+    err = BrokerDB.C(provisionCollection).EnsureIndex(mgo.Index{
+        Key:    []string{"instanceid"},
+        Unique: true,
+        Sparse: true,
+    })
+
+    if err != nil {
+        log.Errorf("Error creating instanceid index: %v", err)
+    }
+
+    clustersInit()
+
+    err = credentialsInit()
+
+    if err != nil {
+        log.Errorf("Error creating credentials index: %v", err)
+    }
+
+    err = cryptInit()
+
+    if err != nil {
+        log.Fatalf("Error reading password key: %v", err)
+    }
+
+    err = apiKeysInit()
+
+    if err != nil {
+        log.Errorf("Error creating apikeys index: %v", err)
+    }
+
+    err = backupsInit()
+
+    if err != nil {
+        log.Errorf("Error initializing backups: %v", err)
+    }
+
+    err = usageInit()
+
+    if err != nil {
+        log.Errorf("Error creating usage index: %v", err)
+    }
+
+    err = labelsInit()
+
+    if err != nil {
+        log.Errorf("Error creating label indexes: %v", err)
+    }
+
+    err = listInit()
+
+    if err != nil {
+        log.Errorf("Error creating list indexes: %v", err)
+    }
+
+    err = deleteInit()
+
+    if err != nil {
+        log.Errorf("Error creating purge index: %v", err)
+    }
+
+    err = idempotencyInit()
+
+    if err != nil {
+        log.Errorf("Error creating idempotency key index: %v", err)
+    }
+
+    metricsInit()
 
     /*
      * Initialize plans
@@ -183,13 +246,12 @@ func Init() {
     err = plansInit()
 
     if err != nil {
-        log.Println("(db.Init) Error initializing plans: ")
-        log.Println(err)
+        log.Errorf("Error initializing plans: %v", err)
     }
 
 }
 
-func DbStatus() (*mgo.BuildInfo, error) {
+func DbStatus(ctx context.Context) (*mgo.BuildInfo, error) {
     err := Session.Ping()
     if err != nil {
         return nil, err
@@ -200,78 +262,235 @@ func DbStatus() (*mgo.BuildInfo, error) {
 }
 
 /*
- * TODO: Create test collection
+ * Provision validates the request, records the new database with a
+ * status of provisioning and then creates the database user.  The
+ * returned spec carries the final status.
  */
-func Provision(in model.ProvisionSpec) (*model.DatabaseSpec, error) {
-    var err error
-    var pSpec model.DatabaseSpec
+func Provision(ctx context.Context, in model.ProvisionSpec) (*model.DatabaseSpec, error) {
+    pSpec, err := startProvision(ctx, in)
+    if err == nil && pSpec.Replayed {
+        return pSpec, nil
+    }
+
+    if err == nil {
+        err = finishProvision(ctx, pSpec, false)
+    }
+    countResult(provisionsTotal, err)
+    return pSpec, err
+}
 
-    pRoles := []mgo.Role{
-        mgo.RoleReadWrite,
-        mgo.RoleDBAdmin,
+/*
+ * ProvisionAsync records the new database and returns straight away,
+ * creating the user in the background.  Progress is reported by
+ * GetDbStatus.
+ */
+func ProvisionAsync(ctx context.Context, in model.ProvisionSpec) (*model.DatabaseSpec, error) {
+    pSpec, err := startProvision(ctx, in)
+    if err != nil {
+        countResult(provisionsTotal, err)
+        return pSpec, err
     }
+    if pSpec.Replayed {
+        return pSpec, nil
+    }
+
+    bgSpec := *pSpec
+    go func() {
+        countResult(provisionsTotal, finishProvision(logger.Detach(ctx), &bgSpec, true))
+    }()
+
+    return pSpec, nil
+}
+
+func startProvision(ctx context.Context, in model.ProvisionSpec) (*model.DatabaseSpec, error) {
+    log := logger.FromContext(ctx)
+
+    var err error
+    var pSpec model.DatabaseSpec
 
     if in.Plan == "" {
         err = errors.New("Plan not set")
-    } else if _, ok := plansMap[in.Plan]; !ok {
+    } else if plan, ok := lookupPlan(in.Plan); !ok {
         err = errors.New("Invalid Plan")
     } else if in.BillingCode == "" {
         err = errors.New("BillingCode not set")
+    } else if err = validateLabels(in.Labels); err != nil {
+        return &pSpec, err
+    } else if err = validateIdempotencyKey(in.IdempotencyKey); err != nil {
+        return &pSpec, err
     } else {
         pSession := BrokerDB.Session.Copy()
         defer pSession.Close()
 
         c := pSession.DB(brokerDbName).C(provisionCollection)
 
-        pSpec = model.DatabaseSpec{}
+        var existing *model.DatabaseSpec
+        existing, err = findProvisioned(ctx, pSession, in)
+        if err != nil {
+            return &pSpec, err
+        }
+        if existing != nil {
+            return existing, nil
+        }
 
-        newNameUuid, _ := uuid.NewV4()
-        pSpec.Name = namePrefix + strings.Split(newNameUuid.String(), "-")[0]
+        var cluster *Cluster
+        cluster, err = placeInstance(ctx, pSession, plan)
+        if err != nil {
+            log.Errorf("placing plan %s: %s", in.Plan, err)
+            return &pSpec, err
+        }
 
-        newUsernameUuid, _ := uuid.NewV4()
-        pSpec.Username = "u" + strings.Split(newUsernameUuid.String(), "-")[0]
+        pSpec = model.DatabaseSpec{}
 
-        newPasswordUuid, _ := uuid.NewV4()
-        pSpec.Password = "p" + strings.Split(newPasswordUuid.String(), "-")[0]
+        pSpec.Name, err = newDbName()
+        if err == nil {
+            pSpec.Username, pSpec.Password, err = newCredentials(ctx, cluster.Session, plan)
+        }
+        if err != nil {
+            log.Errorf("generating credentials: %s", err)
+            return &pSpec, &OpError{Op: "provision", Name: in.Plan, Err: err, RolledBack: true}
+        }
 
         pSpec.Created = time.Now()
         pSpec.Plan = in.Plan
         pSpec.BillingCode = in.BillingCode
         pSpec.Misc = in.Misc
+        pSpec.InstanceId = in.InstanceId
+        pSpec.Labels = in.Labels
+        pSpec.LabelIndex = labelIndex(in.Labels)
+        pSpec.IdempotencyKey = in.IdempotencyKey
+        if in.IdempotencyKey != "" {
+            pSpec.CallerId = in.CallerId
+        }
+        pSpec.RequestHash = requestHash(in)
 
-        pSpec.Host = Dbc.DbHosts[0]
-        pSpec.Port = Dbc.DbPort
+        pSpec.Cluster = cluster.Name
+        pSpec.Host = cluster.Conn.DbHosts[0]
+        pSpec.Port = cluster.Conn.DbPort
 
-        log.Print("(db.Provision) Insert:", pSpec)
+        pSpec.Status = model.StatusProvisioning
+        pSpec.Message = "creating database user"
+        pSpec.Updated = pSpec.Created
+        pSpec.LastRequestId = logger.RequestId(ctx)
 
-        err := c.Insert(&pSpec)
+        ilog := instanceLog(ctx, &pSpec)
+        ilog.Infof("Insert: %s plan %s on %s", pSpec.Name, pSpec.Plan, pSpec.Cluster)
 
-        if err != nil {
-            log.Print("ERROR insert into provision collection: ", pSpec.Name)
-        } else {
-            pUser := mgo.User{
-                Username: pSpec.Username,
-                Password: pSpec.Password,
-                Roles:    pRoles,
-                CustomData: model.InfoData{
-                    DatabaseName: pSpec.Name,
-                    BillingCode:  pSpec.BillingCode,
-                },
+        var sSpec *model.DatabaseSpec
+        sSpec, err = storedDbSpec(&pSpec)
+        if err == nil {
+            err = c.Insert(sSpec)
+        }
+
+        /*
+         * A DeletePlan that started before the insert has marked the plan,
+         * one that starts after it counts this record.
+         */
+        if err == nil {
+            var usable bool
+            usable, err = planUsable(pSession, in.Plan)
+            if err != nil || !usable {
+                if rErr := c.Remove(bson.M{"name": pSpec.Name}); rErr != nil {
+                    ilog.Errorf("removing record %s: %s", pSpec.Name, rErr)
+                }
             }
+            if err == nil && !usable {
+                return &pSpec, errors.New("Invalid Plan")
+            }
+        }
 
-            log.Printf("(db.Provision) Upsert user: %+v", pUser)
-            err = pSession.DB(pSpec.Name).UpsertUser(&pUser)
-            if err != nil {
-                log.Println("(db.Provision) ERROR adding user: ", pUser.Username)
-            } else {
-                log.Print("(db.Provision) Added user: ", pUser.Username)
+        /*
+         * A retry racing the first request loses on the unique indexes.
+         */
+        if mgo.IsDup(err) && (in.IdempotencyKey != "" || in.InstanceId != "") {
+            existing, fErr := findProvisioned(ctx, pSession, in)
+            if fErr != nil {
+                return &pSpec, fErr
+            }
+            if existing != nil {
+                return existing, nil
             }
         }
+
+        if err != nil {
+            ilog.Errorf("insert into provision collection: %v", pSpec.Name)
+            err = &OpError{Op: "provision", Name: pSpec.Name, Err: err, RolledBack: true}
+        }
     }
     return &pSpec, err
 }
 
-func GetDbInfo(dbName string) (*model.DatabaseSpec, error) {
+/*
+ * finishProvision creates the database user.  On failure the work done so
+ * far is rolled back; keepFailed leaves the record behind marked failed so
+ * an asynchronous caller can still read the reason from the status.
+ */
+func finishProvision(ctx context.Context, pSpec *model.DatabaseSpec, keepFailed bool) error {
+    ilog := instanceLog(ctx, pSpec)
+
+    pSession, err := instanceSession(pSpec)
+    if err != nil {
+        ilog.Errorf("connecting to %s: %s", pSpec.Cluster, err)
+        opErr := &OpError{Op: "provision", Name: pSpec.Name, Err: err, RolledBack: true}
+        return failProvision(ctx, pSpec, opErr, keepFailed)
+    }
+    defer pSession.Close()
+
+    pUser := instanceUser(pSpec)
+
+    ilog.Infof("Upsert user: %s", pUser.Username)
+    err = upsertUser(pSession.DB(pSpec.Name), pUser)
+    if err != nil {
+        ilog.Errorf("adding user: %v", pUser.Username)
+        return rollbackProvision(ctx, pSession, pSpec, err, keepFailed)
+    }
+    ilog.Infof("Added user: %v", pUser.Username)
+
+    pSpec.Status = model.StatusActive
+    pSpec.Message = ""
+    pSpec.Updated = time.Now()
+
+    err = setStatus(ctx, pSpec.Name, pSpec.Status, pSpec.Message, pSpec.LastError)
+    if err != nil {
+        return rollbackProvision(ctx, pSession, pSpec, err, keepFailed)
+    }
+    return nil
+}
+
+/*
+ * instanceLog returns a logger that tags every line with the instance and
+ * its billing code.
+ */
+func instanceLog(ctx context.Context, dbSpec *model.DatabaseSpec) *logger.Logger {
+    return logger.FromContext(ctx).With(logger.Fields{
+        "instance":    dbSpec.Name,
+        "billingcode": dbSpec.BillingCode,
+    })
+}
+
+func instanceUser(dbSpec *model.DatabaseSpec) *mgo.User {
+    roles := instanceRoles
+    if dbSpec.WriteRevoked {
+        roles = overQuotaRoles
+    }
+    if dbSpec.Status == model.StatusDeleted {
+        roles = deletedRoles
+    }
+
+    return &mgo.User{
+        Username: dbSpec.Username,
+        Password: dbSpec.Password,
+        Roles:    roles,
+        CustomData: model.InfoData{
+            DatabaseName: dbSpec.Name,
+            BillingCode:  dbSpec.BillingCode,
+        },
+    }
+}
+
+func GetDbInfo(ctx context.Context, dbName string) (*model.DatabaseSpec, error) {
+    log := logger.FromContext(ctx)
+
     var err error
     fSpec := model.DatabaseSpec{}
     f := struct {
@@ -285,90 +504,156 @@ func GetDbInfo(dbName string) (*model.DatabaseSpec, error) {
 
     c := gSession.DB(brokerDbName).C(provisionCollection)
 
-    log.Print("(db.GetDbInfo) find:", dbName)
+    log.Debugf("find: %v", dbName)
 
     err = c.Find(f).One(&fSpec)
 
     if err != nil {
-        log.Print("(db.GetDbInfo) ERROR finding: ", dbName)
-        log.Print("(db.GetDbInfo): ", err)
+        log.Errorf("finding %v: %v", dbName, err)
     } else {
-        log.Printf("(db.GetDbInfo) found: %+v", fSpec)
+        log.Debugf("found: %v", dbName)
+        defaultStatus(&fSpec)
+        fSpec.Password, err = decryptPassword(fSpec.Password)
     }
 
     return &fSpec, err
 }
 
-func RemoveDb(dbName string) error {
-    var dbSpec *model.DatabaseSpec
+func GetDbInfoByInstanceId(ctx context.Context, instanceId string) (*model.DatabaseSpec, error) {
+    log := logger.FromContext(ctx)
+
     var err error
-    r := struct {
-        Name string
+    fSpec := model.DatabaseSpec{}
+    f := struct {
+        InstanceId string
     }{
-        dbName,
+        instanceId,
     }
 
-    rSession := BrokerDB.Session.Copy()
-    defer rSession.Close()
+    gSession := BrokerDB.Session.Copy()
+    defer gSession.Close()
+
+    c := gSession.DB(brokerDbName).C(provisionCollection)
 
-    dbSpec, err = GetDbInfo(dbName)
+    log.Debugf("find: %v", instanceId)
+
+    err = c.Find(f).One(&fSpec)
 
     if err != nil {
-        log.Print("(db.RemoveDb) ERROR unable to find: ", dbName)
+        log.Errorf("finding %v: %v", instanceId, err)
     } else {
-        log.Printf("(db.RemoveDb) remove user: %s\n", dbSpec.Username)
-        err = rSession.DB(dbName).RemoveUser(dbSpec.Username)
-        if err != nil {
-            log.Printf("(db.RemoveDb) error removing user: %s\n", dbSpec.Username)
-        }
+        defaultStatus(&fSpec)
+        fSpec.Password, err = decryptPassword(fSpec.Password)
+    }
 
-        log.Print("(db.RemoveDb) drop db: ", dbName)
-        err = rSession.DB(dbName).DropDatabase()
+    return &fSpec, err
+}
 
-        if err != nil {
-            log.Printf("(db.RemoveDb) ERROR dropping: %s\n", dbName)
-            log.Println("(db.RemoveDb) ERROR: ", err)
-        } else {
-            log.Println("(db.RemoveDb) Remove doc for:", dbName)
-            err = rSession.DB("").C(provisionCollection).Remove(r)
-            if err != nil {
-                log.Println("(db.RemoveDb) ERROR removing from:", provisionCollection)
-            }
-        }
+/*
+ * RemoveDb deletes dbName.  With a retention window the users lose their
+ * roles and the data is kept until the purger drops it, otherwise it is
+ * purged straight away.
+ */
+func RemoveDb(ctx context.Context, dbName string) error {
+    log := logger.FromContext(ctx)
+
+    dbSpec, err := GetDbInfo(ctx, dbName)
+
+    if err != nil {
+        log.Errorf("unable to find: %v", dbName)
+        return err
+    }
+    if dbSpec.Status == model.StatusDeleted {
+        return ErrDeleted
     }
 
+    if deleteRetention > 0 {
+        err = softDelete(ctx, dbSpec)
+    } else {
+        err = purgeDb(ctx, dbSpec)
+    }
+    countResult(deletesTotal, err)
     return err
 }
 
-func GetDbList() (*[]model.DatabaseSpec, error) {
-    var err error
-    var lDbSpec []model.DatabaseSpec
+/*
+ * purgeDb removes the users, the database and the provision record.  The
+ * users lose their roles first and are only removed, credentials included,
+ * once the database is dropped, so a failed drop can be undone.
+ */
+func purgeDb(ctx context.Context, dbSpec *model.DatabaseSpec) error {
+    dbName := dbSpec.Name
+    r := struct {
+        Name string
+    }{
+        dbName,
+    }
+
+    ilog := instanceLog(ctx, dbSpec)
 
-    fSession := BrokerDB.Session.Copy()
-    defer fSession.Close()
+    rSession, err := instanceSession(dbSpec)
+    if err != nil {
+        return &OpError{Op: "deprovision", Name: dbName, Err: err, RolledBack: true}
+    }
+    defer rSession.Close()
 
-    c := fSession.DB(brokerDbName).C(provisionCollection)
-    err = c.Find(nil).All(&lDbSpec)
+    prevStatus := dbSpec.Status
+    setStatus(ctx, dbName, model.StatusDeprovisioning, "revoking database users", "")
 
+    ilog.Infof("revoke users of: %s", dbName)
+    err = setUserRoles(ctx, rSession, dbSpec, deletedRoles)
     if err != nil {
-        log.Print("(db.GetDbList) ERROR finding all db's ", err)
-    } else {
-        log.Println(lDbSpec)
-        log.Printf("(db.GetDbList) Number dbs: %d", len(lDbSpec))
+        ilog.Errorf("error revoking users: %s", err)
+        return rollbackDeprovision(ctx, rSession, dbSpec, prevStatus, err)
     }
 
-    return &lDbSpec, err
-}
+    ilog.Infof("drop db: %v", dbName)
+    setStatus(ctx, dbName, model.StatusDeprovisioning, "dropping database", "")
+    err = dropDatabase(rSession.DB(dbName))
 
-func GetPlans() (*[]model.PlanSpec, error) {
-    var err error
+    if err != nil {
+        ilog.Errorf("dropping: %s", dbName)
+        ilog.Errorf("%v", err)
+        return rollbackDeprovision(ctx, rSession, dbSpec, prevStatus, err)
+    }
 
-    pSession := BrokerDB.Session.Copy()
-    defer pSession.Close()
+    setStatus(ctx, dbName, model.StatusDeprovisioning, "removing database users", "")
 
-    pColl := pSession.DB(brokerDbName).C(plansCollection)
+    ilog.Infof("remove user: %s", dbSpec.Username)
+    err = rSession.DB(dbName).RemoveUser(dbSpec.Username)
+    if err == mgo.ErrNotFound {
+        err = nil
+    }
+
+    for _, ru := range dbSpec.RetiredUsers {
+        ilog.Infof("remove retired user: %s", ru.Username)
+        rErr := rSession.DB(dbName).RemoveUser(ru.Username)
+        if rErr != nil && rErr != mgo.ErrNotFound {
+            ilog.Errorf("error removing retired user %s: %s", ru.Username, rErr)
+        }
+    }
+
+    if err == nil {
+        err = removeAllCredentials(ctx, rSession, dbName)
+    }
+    if err != nil {
+        ilog.Errorf("error removing users: %s", err)
+        opErr := &OpError{Op: "deprovision", Name: dbName, Err: err, RolledBack: false}
+        setStatus(ctx, dbName, model.StatusFailed, "", opErr.Error())
+        return opErr
+    }
 
-    err = pColl.Find(nil).All(&plans)
+    ilog.Infof("Remove doc for: %v", dbName)
+    bSession := BrokerDB.Session.Copy()
+    defer bSession.Close()
+
+    err = bSession.DB(brokerDbName).C(provisionCollection).Remove(r)
+    if err != nil {
+        ilog.Errorf("removing from: %v", provisionCollection)
+        opErr := &OpError{Op: "deprovision", Name: dbName, Err: err, RolledBack: false}
+        setStatus(ctx, dbName, model.StatusFailed, "", opErr.Error())
+        return opErr
+    }
 
-    return &plans, err
+    return nil
 }
@@ -10,12 +10,23 @@ package db
 
 import (
     // "log"
+    "bytes"
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
     "testing"
+    "time"
 
+    "mongodb-api/logger"
     "mongodb-api/model"
 
     . "github.com/smartystreets/goconvey/convey"
     "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
 )
 
 func TestDb(t *testing.T) {
@@ -23,6 +34,34 @@ func TestDb(t *testing.T) {
 
     Init()
     s := Session
+    ctx := context.Background()
+
+    listNames := func(q model.ListQuery) ([]string, string, error) {
+        names := []string{}
+        next, err := NextCursor(ctx, q)
+        if err != nil {
+            return names, next, err
+        }
+        err = GetDbList(ctx, q, next, func(d *model.DatabaseSpec) error {
+            names = append(names, d.Name)
+            return nil
+        })
+        return names, next, err
+    }
+
+    /*
+     * loginAs returns a session holding only the credentials of username.
+     */
+    loginAs := func(dbName string, username string, password string) (*mgo.Session, error) {
+        ls := s.Copy()
+        ls.LogoutAll()
+        err := ls.DB(dbName).Login(username, password)
+        if err != nil {
+            ls.Close()
+            return nil, err
+        }
+        return ls, nil
+    }
 
     Convey("Connecting to MongoDB", t, func() {
         Convey("it should create a session", func() {
@@ -41,8 +80,8 @@ func TestDb(t *testing.T) {
         })
 
         Convey("Should return valid server info", func() {
-            bi, err := DbStatus()
-            log.Printf("BuildInfo: %+v", bi)
+            bi, err := DbStatus(ctx)
+            log.Infof("BuildInfo: %+v", bi)
             So(err, ShouldBeNil)
             So(bi.Version, ShouldNotBeBlank)
         })
@@ -54,7 +93,7 @@ func TestDb(t *testing.T) {
         provSpec.Plan = "shared"
 
         Convey("Should return error on empty billingcode", func() {
-            _, err := Provision(provSpec)
+            _, err := Provision(ctx, provSpec)
 
             So(err, ShouldNotBeNil)
         })
@@ -63,35 +102,35 @@ func TestDb(t *testing.T) {
         provSpec.Misc = "testing"
 
         Convey("Should create database spec", func() {
-            pSpec, err := Provision(provSpec)
+            pSpec, err := Provision(ctx, provSpec)
 
             So(err, ShouldBeNil)
             So(pSpec, ShouldNotBeNil)
             So(pSpec.Plan, ShouldEqual, "shared")
             So(pSpec.Host, ShouldEqual, Dbc.DbHosts[0])
-            log.Print("(create db) dbName:", pSpec.Name)
+            So(pSpec.Cluster, ShouldEqual, defaultCluster)
+            log.Infof("(create db) dbName: %v", pSpec.Name)
 
             Convey("Get database info", func() {
                 dbName := pSpec.Name
-                gSpec, err := GetDbInfo(dbName)
+                gSpec, err := GetDbInfo(ctx, dbName)
 
-                log.Println("(get info) get name:", gSpec.Name)
+                log.Infof("(get info) get name: %v", gSpec.Name)
                 So(err, ShouldBeNil)
                 So(gSpec.Name, ShouldEqual, dbName)
 
                 Convey("When requesting all dbs", func() {
-                    allSpec, err := GetDbList()
+                    names, _, err := listNames(model.ListQuery{})
 
                     Convey("Should get all provisioned dbs", func() {
                         So(err, ShouldBeNil)
-                        So(allSpec, ShouldNotBeNil)
-                        So(len(*allSpec), ShouldBeGreaterThan, 0)
+                        So(len(names), ShouldBeGreaterThan, 0)
 
                         Convey("Should Remove database", func() {
                             dbName := pSpec.Name
 
-                            log.Println("(remove db) remove name:", dbName)
-                            err := RemoveDb(dbName)
+                            log.Infof("(remove db) remove name: %v", dbName)
+                            err := RemoveDb(ctx, dbName)
 
                             So(err, ShouldBeNil)
 
@@ -108,37 +147,984 @@ func TestDb(t *testing.T) {
 
         Convey("Blank Plan should not create database spec", func() {
             provSpec.Plan = ""
-            _, err := Provision(provSpec)
+            _, err := Provision(ctx, provSpec)
             So(err, ShouldNotBeNil)
         })
         Convey("Should return error on invalid plan", func() {
             provSpec.Plan = "junk"
-            _, err := Provision(provSpec)
+            _, err := Provision(ctx, provSpec)
 
             So(err, ShouldNotBeNil)
         })
         Convey("Blank Billingcode should not create database spec", func() {
             provSpec.BillingCode = ""
-            _, err := Provision(provSpec)
+            _, err := Provision(ctx, provSpec)
+            So(err, ShouldNotBeNil)
+        })
+    })
+
+    Convey("When instances are labelled", t, func() {
+        pSpec, err := Provision(ctx, model.ProvisionSpec{
+            Plan:        "shared",
+            BillingCode: "testOps",
+            Labels:      map[string]string{"team": "payments", "environment": "test"},
+        })
+        So(err, ShouldBeNil)
+
+        Convey("Should find them by plan and label", func() {
+            names, _, err := listNames(model.ListQuery{Plan: "shared", Labels: map[string]string{"team": "payments"}})
+            So(err, ShouldBeNil)
+            So(pSpec.Name, ShouldBeIn, names)
+
+            names, _, err = listNames(model.ListQuery{Labels: map[string]string{"team": "payments", "environment": "prod"}})
+            So(err, ShouldBeNil)
+            So(pSpec.Name, ShouldNotBeIn, names)
+        })
+        Convey("Should add and remove labels", func() {
+            dbSpec, err := SetLabels(ctx, pSpec.Name, map[string]string{"team": "ledger", "app": "api"})
+            So(err, ShouldBeNil)
+            So(dbSpec.Labels["team"], ShouldEqual, "ledger")
+            So(dbSpec.Labels["environment"], ShouldEqual, "test")
+
+            dbSpec, err = RemoveLabel(ctx, pSpec.Name, "app")
+            So(err, ShouldBeNil)
+            So(dbSpec.Labels, ShouldNotContainKey, "app")
+
+            _, err = RemoveLabel(ctx, pSpec.Name, "app")
+            So(err, ShouldEqual, ErrLabelNotFound)
+        })
+        Convey("Should keep every change made at the same time", func() {
+            keys := []string{"a", "b", "c", "d"}
+            errs := make(chan error, len(keys))
+            for _, k := range keys {
+                go func(k string) {
+                    _, err := SetLabels(ctx, pSpec.Name, map[string]string{k: "x"})
+                    errs <- err
+                }(k)
+            }
+            for range keys {
+                So(<-errs, ShouldBeNil)
+            }
+
+            dbSpec, err := GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            for _, k := range keys {
+                So(dbSpec.Labels, ShouldContainKey, k)
+            }
+            So(dbSpec.Labels["team"], ShouldEqual, "payments")
+        })
+        Convey("Should label an instance that has none", func() {
+            uSpec, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+            So(err, ShouldBeNil)
+            defer RemoveDb(ctx, uSpec.Name)
+
+            dbSpec, err := SetLabels(ctx, uSpec.Name, map[string]string{"app": "api"})
+            So(err, ShouldBeNil)
+            So(dbSpec.Labels["app"], ShouldEqual, "api")
+
+            _, err = RemoveLabel(ctx, uSpec.Name, "app")
+            So(err, ShouldBeNil)
+            _, err = SetLabels(ctx, uSpec.Name, map[string]string{"app": "web"})
+            So(err, ShouldBeNil)
+        })
+        Convey("Should refuse invalid labels", func() {
+            _, err := SetLabels(ctx, pSpec.Name, map[string]string{"Bad Key": "x"})
+            So(err, ShouldNotBeNil)
+        })
+
+        Reset(func() {
+            RemoveDb(ctx, pSpec.Name)
+        })
+    })
+
+    Convey("When listing a page at a time", t, func() {
+        var pSpecs []*model.DatabaseSpec
+        for i := 0; i < 3; i++ {
+            pSpec, err := Provision(ctx, model.ProvisionSpec{
+                Plan:        "shared",
+                BillingCode: "testOps",
+                Labels:      map[string]string{"test": "paging"},
+            })
+            So(err, ShouldBeNil)
+            pSpecs = append(pSpecs, pSpec)
+        }
+        q := model.ListQuery{Labels: map[string]string{"test": "paging"}, Sort: "name", Limit: 2}
+
+        Convey("Should page through every instance once", func() {
+            first, next, err := listNames(q)
+            So(err, ShouldBeNil)
+            So(len(first), ShouldEqual, 2)
+            So(next, ShouldNotEqual, "")
+
+            q.Cursor = next
+            second, next, err := listNames(q)
+            So(err, ShouldBeNil)
+            So(len(second), ShouldEqual, 1)
+            So(next, ShouldEqual, "")
+            So(second[0], ShouldBeGreaterThan, first[1])
+        })
+        Convey("Should list every instance without a limit", func() {
+            q.Limit = 0
+            names, next, err := listNames(q)
+            So(err, ShouldBeNil)
+            So(len(names), ShouldEqual, 3)
+            So(next, ShouldEqual, "")
+        })
+        Convey("Should not skip an instance added while a page is read", func() {
+            first, next, err := listNames(q)
+            So(err, ShouldBeNil)
+
+            pSpec, err := Provision(ctx, model.ProvisionSpec{
+                Plan:        "shared",
+                BillingCode: "testOps",
+                Labels:      map[string]string{"test": "paging"},
+            })
+            So(err, ShouldBeNil)
+            pSpecs = append(pSpecs, pSpec)
+
+            seen := map[string]bool{}
+            err = GetDbList(ctx, q, next, func(d *model.DatabaseSpec) error {
+                seen[d.Name] = true
+                return nil
+            })
+            So(err, ShouldBeNil)
+            q.Cursor = next
+            rest, _, err := listNames(q)
+            So(err, ShouldBeNil)
+            for _, name := range rest {
+                seen[name] = true
+            }
+            for _, name := range first {
+                So(seen, ShouldContainKey, name)
+            }
+            So(seen, ShouldContainKey, pSpec.Name)
+        })
+        Convey("Should sort descending", func() {
+            q.Sort = "-name"
+            q.Limit = 3
+            names, _, err := listNames(q)
+            So(err, ShouldBeNil)
+            So(names[0], ShouldBeGreaterThan, names[1])
+            So(names[1], ShouldBeGreaterThan, names[2])
+        })
+        Convey("Should only read the fields asked for", func() {
+            q.Fields = []string{"plan"}
+            err := GetDbList(ctx, q, "", func(d *model.DatabaseSpec) error {
+                So(d.Plan, ShouldEqual, "shared")
+                So(d.Password, ShouldEqual, "")
+                So(d.Username, ShouldEqual, "")
+                return nil
+            })
+            So(err, ShouldBeNil)
+        })
+        Convey("Should refuse bad queries", func() {
+            _, _, err := listNames(model.ListQuery{Sort: "password"})
+            So(err, ShouldNotBeNil)
+            _, _, err = listNames(model.ListQuery{Limit: MaxListLimit + 1})
+            So(err, ShouldNotBeNil)
+            _, _, err = listNames(model.ListQuery{Cursor: "junk"})
+            So(err, ShouldEqual, ErrInvalidCursor)
+            _, _, err = listNames(model.ListQuery{Fields: []string{"secret"}})
+            So(err, ShouldNotBeNil)
+        })
+
+        Reset(func() {
+            for _, pSpec := range pSpecs {
+                RemoveDb(ctx, pSpec.Name)
+            }
+        })
+    })
+
+    Convey("When an instance is deleted", t, func() {
+        deleteRetention = time.Hour
+        pSpec, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+        So(err, ShouldBeNil)
+        So(RemoveDb(ctx, pSpec.Name), ShouldBeNil)
+
+        Convey("Should keep it until the retention ends", func() {
+            dbSpec, err := GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(dbSpec.Status, ShouldEqual, model.StatusDeleted)
+            So(dbSpec.PurgeAfter, ShouldHappenAfter, time.Now())
+
+            So(RemoveDb(ctx, pSpec.Name), ShouldEqual, ErrDeleted)
+            _, err = RotateCredentials(ctx, pSpec.Name, 0)
+            So(err, ShouldNotBeNil)
+
+            purgeDeleted(ctx)
+            _, err = GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+        })
+        Convey("Should refuse reads by its user", func() {
+            ls, err := loginAs(pSpec.Name, pSpec.Username, pSpec.Password)
+            So(err, ShouldBeNil)
+            defer ls.Close()
+
+            _, err = ls.DB(pSpec.Name).C("data").Count()
+            So(err, ShouldNotBeNil)
+        })
+        Convey("Should undelete it", func() {
+            dbSpec, err := Undelete(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(dbSpec.Status, ShouldEqual, model.StatusActive)
+
+            dbSpec, err = GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(dbSpec.Status, ShouldEqual, model.StatusActive)
+            So(dbSpec.PurgeAfter.IsZero(), ShouldBeTrue)
+
+            _, err = Undelete(ctx, pSpec.Name)
+            So(err, ShouldNotBeNil)
+
+            So(RemoveDb(ctx, pSpec.Name), ShouldBeNil)
+        })
+        Convey("Should purge it once the retention ends", func() {
+            err := s.DB(brokerDbName).C(provisionCollection).Update(bson.M{"name": pSpec.Name}, bson.M{
+                "$set": bson.M{"purgeafter": time.Now().Add(-time.Minute)},
+            })
+            So(err, ShouldBeNil)
+
+            purgeDeleted(ctx)
+            _, err = GetDbInfo(ctx, pSpec.Name)
             So(err, ShouldNotBeNil)
         })
+
+        Reset(func() {
+            if dbSpec, err := GetDbInfo(ctx, pSpec.Name); err == nil {
+                purgeDb(ctx, dbSpec)
+            }
+        })
+    })
+
+    Convey("When an instance with a missing credential user is deleted", t, func() {
+        deleteRetention = time.Hour
+        pSpec, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+        So(err, ShouldBeNil)
+        cSpec, err := AddCredential(ctx, pSpec.Name, model.CredentialRequest{Name: "gone"})
+        So(err, ShouldBeNil)
+        So(s.DB(pSpec.Name).RemoveUser(cSpec.Username), ShouldBeNil)
+
+        Convey("Should delete it and skip the missing user", func() {
+            So(RemoveDb(ctx, pSpec.Name), ShouldBeNil)
+
+            dbSpec, err := GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(dbSpec.Status, ShouldEqual, model.StatusDeleted)
+        })
+
+        Reset(func() {
+            if dbSpec, err := GetDbInfo(ctx, pSpec.Name); err == nil {
+                purgeDb(ctx, dbSpec)
+            }
+        })
+    })
+
+    Convey("When the drop fails while purging an instance", t, func() {
+        pSpec, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+        So(err, ShouldBeNil)
+        cSpec, err := AddCredential(ctx, pSpec.Name, model.CredentialRequest{Name: "app"})
+        So(err, ShouldBeNil)
+        So(s.DB(pSpec.Name).C("data").Insert(bson.M{"x": 1}), ShouldBeNil)
+
+        dropDatabase = func(*mgo.Database) error {
+            return errors.New("drop refused")
+        }
+
+        Convey("Should keep the instance and its credentials usable", func() {
+            err := purgeDb(ctx, pSpec)
+            So(err, ShouldNotBeNil)
+            So(err.(*OpError).RolledBack, ShouldBeTrue)
+
+            dbSpec, err := GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(dbSpec.Status, ShouldEqual, model.StatusActive)
+
+            _, err = GetCredential(ctx, pSpec.Name, "app")
+            So(err, ShouldBeNil)
+
+            for _, u := range [][2]string{{pSpec.Username, pSpec.Password}, {cSpec.Username, cSpec.Password}} {
+                ls, err := loginAs(pSpec.Name, u[0], u[1])
+                So(err, ShouldBeNil)
+                So(ls.DB(pSpec.Name).C("data").Insert(bson.M{"x": 2}), ShouldBeNil)
+                ls.Close()
+            }
+        })
+
+        Reset(func() {
+            dropDatabase = (*mgo.Database).DropDatabase
+            if dbSpec, err := GetDbInfo(ctx, pSpec.Name); err == nil {
+                purgeDb(ctx, dbSpec)
+            }
+        })
+    })
+
+    Convey("When a provision is retried", t, func() {
+        key := fmt.Sprintf("test-%d", time.Now().UnixNano())
+        in := model.ProvisionSpec{Plan: "shared", BillingCode: "testOps", IdempotencyKey: key}
+
+        pSpec, err := Provision(ctx, in)
+        So(err, ShouldBeNil)
+        So(pSpec.Replayed, ShouldBeFalse)
+
+        Convey("Should return the first instance for the same request", func() {
+            again, err := Provision(ctx, in)
+            So(err, ShouldBeNil)
+            So(again.Replayed, ShouldBeTrue)
+            So(again.Name, ShouldEqual, pSpec.Name)
+            So(again.Password, ShouldEqual, pSpec.Password)
+
+            again, err = ProvisionAsync(ctx, in)
+            So(err, ShouldBeNil)
+            So(again.Name, ShouldEqual, pSpec.Name)
+        })
+        Convey("Should refuse a different request with the same key", func() {
+            in.BillingCode = "otherOps"
+            _, err := Provision(ctx, in)
+            So(err, ShouldEqual, ErrIdempotencyConflict)
+        })
+        Convey("Should keep the keys of other callers apart", func() {
+            in.CallerId = "another-caller"
+            other, err := Provision(ctx, in)
+            So(err, ShouldBeNil)
+            defer RemoveDb(ctx, other.Name)
+            So(other.Replayed, ShouldBeFalse)
+            So(other.Name, ShouldNotEqual, pSpec.Name)
+
+            again, err := Provision(ctx, in)
+            So(err, ShouldBeNil)
+            So(again.Name, ShouldEqual, other.Name)
+        })
+        Convey("Should refuse a different request with the same instance id", func() {
+            id := key + "-instance"
+            first, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps", InstanceId: id})
+            So(err, ShouldBeNil)
+            defer RemoveDb(ctx, first.Name)
+
+            again, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps", InstanceId: id})
+            So(err, ShouldBeNil)
+            So(again.Name, ShouldEqual, first.Name)
+
+            _, err = Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "otherOps", InstanceId: id})
+            So(err, ShouldEqual, ErrIdempotencyConflict)
+        })
+
+        Reset(func() {
+            RemoveDb(ctx, pSpec.Name)
+        })
+    })
+
+    Convey("When the cluster drifts from the records", t, func() {
+        driftItem := func(items []model.DriftItem, name string, username string) *model.DriftItem {
+            for i := range items {
+                if items[i].Database == name && items[i].Username == username {
+                    return &items[i]
+                }
+            }
+            return nil
+        }
+
+        pSpec, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+        So(err, ShouldBeNil)
+        So(s.DB(pSpec.Name).C("drift").Insert(bson.M{"x": 1}), ShouldBeNil)
+
+        Convey("Should find and repair a missing user", func() {
+            So(s.DB(pSpec.Name).RemoveUser(pSpec.Username), ShouldBeNil)
+
+            report, err := CheckDrift(ctx, false)
+            So(err, ShouldBeNil)
+            item := driftItem(report.MissingUsers, pSpec.Name, pSpec.Username)
+            So(item, ShouldNotBeNil)
+            So(item.Repaired, ShouldBeFalse)
+
+            report, err = CheckDrift(ctx, true)
+            So(err, ShouldBeNil)
+            So(driftItem(report.MissingUsers, pSpec.Name, pSpec.Username).Repaired, ShouldBeTrue)
+
+            report, err = CheckDrift(ctx, false)
+            So(err, ShouldBeNil)
+            So(driftItem(report.MissingUsers, pSpec.Name, pSpec.Username), ShouldBeNil)
+        })
+        Convey("Should find and repair changed roles", func() {
+            So(s.DB(pSpec.Name).UpsertUser(&mgo.User{Username: pSpec.Username, Roles: []mgo.Role{mgo.RoleRead}}), ShouldBeNil)
+
+            report, err := CheckDrift(ctx, true)
+            So(err, ShouldBeNil)
+            item := driftItem(report.RoleMismatches, pSpec.Name, pSpec.Username)
+            So(item, ShouldNotBeNil)
+            So(item.Detail, ShouldContainSubstring, "expected dbAdmin,readWrite")
+            So(item.Repaired, ShouldBeTrue)
+
+            report, err = CheckDrift(ctx, false)
+            So(err, ShouldBeNil)
+            So(driftItem(report.RoleMismatches, pSpec.Name, pSpec.Username), ShouldBeNil)
+        })
+        Convey("Should find orphan records and databases", func() {
+            So(s.DB(pSpec.Name).RemoveUser(pSpec.Username), ShouldBeNil)
+            So(s.DB(pSpec.Name).DropDatabase(), ShouldBeNil)
+
+            orphan := namePrefix + "drift000"
+            So(s.DB(orphan).C("drift").Insert(bson.M{"x": 1}), ShouldBeNil)
+            defer s.DB(orphan).DropDatabase()
+
+            report, err := CheckDrift(ctx, false)
+            So(err, ShouldBeNil)
+            So(driftItem(report.OrphanRecords, pSpec.Name, ""), ShouldNotBeNil)
+            So(driftItem(report.OrphanDatabases, orphan, ""), ShouldNotBeNil)
+
+            report, err = CheckDrift(ctx, true)
+            So(err, ShouldBeNil)
+            So(driftItem(report.OrphanRecords, pSpec.Name, "").Repaired, ShouldBeTrue)
+            So(driftItem(report.OrphanDatabases, orphan, "").Repaired, ShouldBeFalse)
+
+            dbSpec, err := GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(dbSpec.Status, ShouldEqual, model.StatusFailed)
+        })
+        Convey("Should leave a plan change alone", func() {
+            c := s.DB(brokerDbName).C(provisionCollection)
+            So(c.Update(bson.M{"name": pSpec.Name}, bson.M{
+                "$set": bson.M{"status": model.StatusUpdating, "changingto": "ha"},
+            }), ShouldBeNil)
+            So(s.DB(pSpec.Name).UpsertUser(&mgo.User{Username: pSpec.Username, Roles: overQuotaRoles}), ShouldBeNil)
+
+            target := namePrefix + "drift001"
+            So(s.DB(target).C("drift").Insert(bson.M{"x": 1}), ShouldBeNil)
+            defer s.DB(target).DropDatabase()
+            So(c.Insert(bson.M{"name": target, "cluster": "elsewhere", "status": model.StatusUpdating, "changingto": "ha"}), ShouldBeNil)
+            defer c.Remove(bson.M{"name": target})
+
+            report, err := CheckDrift(ctx, true)
+            So(err, ShouldBeNil)
+            So(driftItem(report.RoleMismatches, pSpec.Name, pSpec.Username), ShouldBeNil)
+            So(driftItem(report.OrphanDatabases, target, ""), ShouldBeNil)
+
+            ls, err := loginAs(pSpec.Name, pSpec.Username, pSpec.Password)
+            So(err, ShouldBeNil)
+            defer ls.Close()
+            So(ls.DB(pSpec.Name).C("drift").Insert(bson.M{"x": 2}), ShouldNotBeNil)
+        })
+
+        Reset(func() {
+            if dbSpec, err := GetDbInfo(ctx, pSpec.Name); err == nil {
+                purgeDb(ctx, dbSpec)
+            }
+        })
     })
 
     Convey("When making request using bad db name", t, func() {
         dbName := "badName"
 
         Convey("Should not find db info "+dbName, func() {
-            _, err := GetDbInfo(dbName)
+            _, err := GetDbInfo(ctx, dbName)
             So(err, ShouldNotBeNil)
         })
         Convey("Should not remove db "+dbName, func() {
-            err := RemoveDb(dbName)
+            err := RemoveDb(ctx, dbName)
+            So(err, ShouldNotBeNil)
+        })
+    })
+
+    Convey("When an operation fails after changing the server", t, func() {
+        opErr := &OpError{Op: "provision", Name: "testdb", Err: errors.New("boom"), RolledBack: true}
+
+        Convey("Should report the reason and the rollback state", func() {
+            So(opErr.Error(), ShouldContainSubstring, "boom")
+            So(opErr.Error(), ShouldContainSubstring, "rolled back")
+            opErr.RolledBack = false
+            So(opErr.Error(), ShouldContainSubstring, "rollback incomplete")
+        })
+        Convey("Should undo a provision whose user cannot be created", func() {
+            upsertUser = func(*mgo.Database, *mgo.User) error {
+                return errors.New("user refused")
+            }
+
+            pSpec, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+            So(err, ShouldNotBeNil)
+            So(err.(*OpError).RolledBack, ShouldBeTrue)
+            So(err.Error(), ShouldContainSubstring, "user refused")
+
+            _, err = GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldEqual, ErrNotFound)
+
+            names, err := s.DatabaseNames()
+            So(err, ShouldBeNil)
+            So(names, ShouldNotContain, pSpec.Name)
+        })
+        Convey("Should only mark failed a provision whose cluster cannot be reached", func() {
+            pSpec, err := startProvision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+            So(err, ShouldBeNil)
+            defer s.DB(brokerDbName).C(provisionCollection).Remove(bson.M{"name": pSpec.Name})
+            defer s.DB(pSpec.Name).DropDatabase()
+
+            So(s.DB(pSpec.Name).C("data").Insert(bson.M{"x": 1}), ShouldBeNil)
+
+            pSpec.Cluster = "nosuchcluster"
+            err = finishProvision(ctx, pSpec, true)
+            So(err, ShouldNotBeNil)
+            So(err.(*OpError).RolledBack, ShouldBeTrue)
+
+            dbSpec, err := GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(dbSpec.Status, ShouldEqual, model.StatusFailed)
+
+            n, err := s.DB(pSpec.Name).C("data").Count()
+            So(err, ShouldBeNil)
+            So(n, ShouldEqual, 1)
+        })
+        Convey("Should undo a deprovision whose database cannot be dropped", func() {
+            deleteRetention = 0
+            pSpec, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+            So(err, ShouldBeNil)
+            defer purgeDb(ctx, pSpec)
+
+            dropDatabase = func(*mgo.Database) error {
+                return errors.New("drop refused")
+            }
+
+            err = RemoveDb(ctx, pSpec.Name)
+            So(err, ShouldNotBeNil)
+            So(err.(*OpError).RolledBack, ShouldBeTrue)
+            dropDatabase = (*mgo.Database).DropDatabase
+
+            dbSpec, err := GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(dbSpec.Status, ShouldEqual, model.StatusActive)
+            So(dbSpec.LastError, ShouldContainSubstring, "drop refused")
+
+            ls, err := loginAs(pSpec.Name, pSpec.Username, pSpec.Password)
+            So(err, ShouldBeNil)
+            defer ls.Close()
+            So(ls.DB(pSpec.Name).C("data").Insert(bson.M{"x": 1}), ShouldBeNil)
+        })
+
+        Reset(func() {
+            upsertUser = (*mgo.Database).UpsertUser
+            dropDatabase = (*mgo.Database).DropDatabase
+        })
+    })
+
+    Convey("When a plan is added to the plans collection directly", t, func() {
+        name := fmt.Sprintf("direct%d", time.Now().UnixNano())
+        err := s.DB(brokerDbName).C(plansCollection).Insert(&model.PlanSpec{
+            Name:        name,
+            Size:        "1gb",
+            Description: "Added without the API",
+        })
+        So(err, ShouldBeNil)
+
+        Convey("Should be found without a restart", func() {
+            plans.missed = time.Time{}
+            pSpec, ok := lookupPlan(name)
+            So(ok, ShouldBeTrue)
+            So(pSpec.Size, ShouldEqual, "1gb")
+        })
+        Convey("Should not reload the plans for every miss", func() {
+            loadPlans()
+            plans.missed = time.Now()
+            _, ok := lookupPlan(name)
+            So(ok, ShouldBeFalse)
+
+            plans.missed = time.Time{}
+            _, ok = lookupPlan(name)
+            So(ok, ShouldBeTrue)
+        })
+
+        Reset(func() {
+            s.DB(brokerDbName).C(plansCollection).Remove(bson.M{"name": name})
+        })
+    })
+
+    Convey("When a plan is deleted", t, func() {
+        name := fmt.Sprintf("doomed%d", time.Now().UnixNano())
+        _, err := CreatePlan(ctx, model.PlanSpec{Name: name, Size: "1gb"})
+        So(err, ShouldBeNil)
+
+        c := s.DB(brokerDbName).C(provisionCollection)
+
+        Convey("Should refuse while a database is on it", func() {
+            pSpec, err := Provision(ctx, model.ProvisionSpec{Plan: name, BillingCode: "testOps"})
+            So(err, ShouldBeNil)
+
+            So(DeletePlan(ctx, name), ShouldEqual, ErrPlanInUse)
+            _, ok := lookupPlan(name)
+            So(ok, ShouldBeTrue)
+
+            deleteRetention = 0
+            So(RemoveDb(ctx, pSpec.Name), ShouldBeNil)
+            So(DeletePlan(ctx, name), ShouldBeNil)
+            _, ok = lookupPlan(name)
+            So(ok, ShouldBeFalse)
+        })
+        Convey("Should refuse while a database is changing to it", func() {
+            dbName := fmt.Sprintf("changing%d", time.Now().UnixNano())
+            So(c.Insert(bson.M{"name": dbName, "plan": "shared", "changingto": name}), ShouldBeNil)
+            defer c.Remove(bson.M{"name": dbName})
+
+            So(DeletePlan(ctx, name), ShouldEqual, ErrPlanInUse)
+        })
+        Convey("Should not provision on a plan being deleted", func() {
+            err := s.DB(brokerDbName).C(plansCollection).Update(bson.M{"name": name}, bson.M{
+                "$set": bson.M{"deleting": true},
+            })
+            So(err, ShouldBeNil)
+
+            _, err = Provision(ctx, model.ProvisionSpec{Plan: name, BillingCode: "testOps"})
+            So(err, ShouldNotBeNil)
+
+            n, err := c.Find(bson.M{"plan": name}).Count()
+            So(err, ShouldBeNil)
+            So(n, ShouldEqual, 0)
+        })
+
+        Reset(func() {
+            s.DB(brokerDbName).C(plansCollection).Remove(bson.M{"name": name})
+            loadPlans()
+        })
+    })
+
+    Convey("When plans name backend clusters", t, func() {
+        Convey("Should reject clusters that are not configured", func() {
+            _, err := CreatePlan(ctx, model.PlanSpec{
+                Name:     fmt.Sprintf("nowhere%d", time.Now().UnixNano()),
+                Size:     "1gb",
+                Clusters: []string{"nowhere"},
+            })
+            So(err, ShouldNotBeNil)
+            So(err.Error(), ShouldContainSubstring, "Unknown cluster")
+        })
+        Convey("Should place plans without clusters on the default cluster", func() {
+            c, err := placeInstance(ctx, s, &model.PlanSpec{Name: "shared"})
+            So(err, ShouldBeNil)
+            So(c.Name, ShouldEqual, defaultCluster)
+        })
+        Convey("Should not place plans whose clusters are unavailable", func() {
+            _, err := placeInstance(ctx, s, &model.PlanSpec{Name: "gone", Clusters: []string{"gone"}})
+            So(err, ShouldNotBeNil)
+        })
+        Convey("Should treat records without a cluster as on the default cluster", func() {
+            c, err := getCluster("")
+            So(err, ShouldBeNil)
+            So(c.Name, ShouldEqual, defaultCluster)
+
+            _, err = getCluster("gone")
+            So(err, ShouldEqual, ErrUnknownCluster)
+        })
+    })
+
+    Convey("When passwords are encrypted", t, func() {
+        prevAEAD := passwordAEAD
+        block, _ := aes.NewCipher(bytes.Repeat([]byte{7}, 32))
+        passwordAEAD, _ = cipher.NewGCM(block)
+
+        Convey("Should round trip and read plaintext records", func() {
+            enc, err := encryptPassword("secret")
+            So(err, ShouldBeNil)
+            So(enc, ShouldStartWith, encryptedPrefix)
+            So(enc, ShouldNotContainSubstring, "secret")
+
+            dec, err := decryptPassword(enc)
+            So(err, ShouldBeNil)
+            So(dec, ShouldEqual, "secret")
+
+            dec, err = decryptPassword("plain")
+            So(err, ShouldBeNil)
+            So(dec, ShouldEqual, "plain")
+        })
+
+        Convey("Should store provisioned passwords encrypted", func() {
+            var stored model.DatabaseSpec
+
+            pSpec, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps", Misc: "testing"})
+            So(err, ShouldBeNil)
+            defer RemoveDb(ctx, pSpec.Name)
+
+            err = s.DB(brokerDbName).C(provisionCollection).Find(bson.M{"name": pSpec.Name}).One(&stored)
+            So(err, ShouldBeNil)
+            So(stored.Password, ShouldStartWith, encryptedPrefix)
+
+            gSpec, err := GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(gSpec.Password, ShouldEqual, pSpec.Password)
+        })
+
+        Reset(func() {
+            passwordAEAD = prevAEAD
+        })
+    })
+
+    Convey("When generating credentials", t, func() {
+        Convey("Should follow the plan's password policy", func() {
+            username, password, err := newCredentials(ctx, s, &model.PlanSpec{PasswordLength: 40, PasswordCharset: "hex"})
+            So(err, ShouldBeNil)
+            So(username, ShouldStartWith, "u")
+            So(len(username), ShouldEqual, usernameLength+1)
+            So(len(password), ShouldEqual, 40)
+            So(strings.Trim(password, passwordCharsets["hex"]), ShouldBeEmpty)
+        })
+        Convey("Should use the default policy without a plan", func() {
+            _, password, err := newCredentials(ctx, s, nil)
+            So(err, ShouldBeNil)
+            So(len(password), ShouldEqual, defaultPasswordLength)
+        })
+        Convey("Should reject invalid policies", func() {
+            So(validatePasswordPolicy(&model.PlanSpec{PasswordLength: 4}), ShouldNotBeNil)
+            So(validatePasswordPolicy(&model.PlanSpec{PasswordCharset: "emoji"}), ShouldNotBeNil)
+            So(validatePasswordPolicy(&model.PlanSpec{PasswordLength: 32, PasswordCharset: "urlsafe"}), ShouldBeNil)
+        })
+    })
+
+    Convey("When provisioning with logging captured", t, func() {
+        var buf bytes.Buffer
+
+        logger.SetOutput(&buf)
+        pSpec, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps", Misc: "testing"})
+        So(err, ShouldBeNil)
+        GetDbInfo(ctx, pSpec.Name)
+        listNames(model.ListQuery{})
+        RemoveDb(ctx, pSpec.Name)
+        logger.SetOutput(os.Stdout)
+
+        Convey("Should not log the password", func() {
+            So(buf.String(), ShouldContainSubstring, pSpec.Name)
+            So(buf.String(), ShouldNotContainSubstring, pSpec.Password)
+        })
+    })
+
+    Convey("When reading plan sizes", t, func() {
+        Convey("Should parse sizes with units", func() {
+            n, limited, err := parseSize("100gb")
+            So(err, ShouldBeNil)
+            So(limited, ShouldBeTrue)
+            So(n, ShouldEqual, int64(100)<<30)
+
+            n, limited, err = parseSize("512 MB")
+            So(err, ShouldBeNil)
+            So(n, ShouldEqual, int64(512)<<20)
+        })
+        Convey("Should treat Unlimited as no limit", func() {
+            _, limited, err := parseSize("Unlimited")
+            So(err, ShouldBeNil)
+            So(limited, ShouldBeFalse)
+        })
+        Convey("Should reject unknown sizes", func() {
+            _, _, err := parseSize("lots")
+            So(err, ShouldNotBeNil)
+        })
+    })
+
+    Convey("When a database grows past its plan size", t, func() {
+        planName := fmt.Sprintf("tiny%d", time.Now().UnixNano())
+        err := s.DB(brokerDbName).C(plansCollection).Insert(&model.PlanSpec{
+            Name:        planName,
+            Size:        "1kb",
+            Description: "Too small to use",
+        })
+        So(err, ShouldBeNil)
+        loadPlans()
+
+        pSpec, err := Provision(ctx, model.ProvisionSpec{
+            Plan:        planName,
+            BillingCode: "testOps",
+            Misc:        "testing",
+        })
+        So(err, ShouldBeNil)
+
+        for i := 0; i < 100; i++ {
+            err = s.DB(pSpec.Name).C("filler").Insert(bson.M{"n": i, "pad": fmt.Sprintf("%0100d", i)})
+            So(err, ShouldBeNil)
+        }
+
+        Convey("Should mark it over quota and revoke writes when enforced", func() {
+            quotaEnforce = true
+            _, err = checkDbUsage(ctx, s, pSpec)
+            So(err, ShouldBeNil)
+
+            gSpec, err := GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(gSpec.OverQuota, ShouldBeTrue)
+            So(gSpec.WriteRevoked, ShouldBeTrue)
+            So(gSpec.Usage, ShouldBeGreaterThan, 1024)
+
+            quotaEnforce = false
+            _, err = checkDbUsage(ctx, s, gSpec)
+            So(err, ShouldBeNil)
+
+            gSpec, err = GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(gSpec.OverQuota, ShouldBeTrue)
+            So(gSpec.WriteRevoked, ShouldBeFalse)
+        })
+
+        Convey("Should revoke writes by credentials and skip reaped users", func() {
+            cSpec, err := AddCredential(ctx, pSpec.Name, model.CredentialRequest{Name: "app"})
+            So(err, ShouldBeNil)
+
+            rSpec, err := RotateCredentials(ctx, pSpec.Name, time.Hour)
+            So(err, ShouldBeNil)
+            So(s.DB(pSpec.Name).RemoveUser(pSpec.Username), ShouldBeNil)
+
+            quotaEnforce = true
+            _, err = checkDbUsage(ctx, s, rSpec)
+            So(err, ShouldBeNil)
+            So(rSpec.WriteRevoked, ShouldBeTrue)
+
+            ls, err := loginAs(pSpec.Name, cSpec.Username, cSpec.Password)
+            So(err, ShouldBeNil)
+            defer ls.Close()
+
+            _, err = ls.DB(pSpec.Name).C("filler").Count()
+            So(err, ShouldBeNil)
+            So(ls.DB(pSpec.Name).C("filler").Insert(bson.M{"n": -1}), ShouldNotBeNil)
+        })
+
+        Convey("Should keep writes revoked for credentials added while over quota", func() {
+            quotaEnforce = true
+            _, err = checkDbUsage(ctx, s, pSpec)
+            So(err, ShouldBeNil)
+
+            cSpec, err := AddCredential(ctx, pSpec.Name, model.CredentialRequest{Name: "late"})
+            So(err, ShouldBeNil)
+
+            ls, err := loginAs(pSpec.Name, cSpec.Username, cSpec.Password)
+            So(err, ShouldBeNil)
+            defer ls.Close()
+
+            _, err = ls.DB(pSpec.Name).C("filler").Count()
+            So(err, ShouldBeNil)
+            So(ls.DB(pSpec.Name).C("filler").Insert(bson.M{"n": -1}), ShouldNotBeNil)
+        })
+
+        Convey("Should record usage for the billing report", func() {
+            recorded, err := checkDbUsage(ctx, s, pSpec)
+            So(err, ShouldBeNil)
+            So(recorded, ShouldBeTrue)
+
+            reports, err := GetBillingReport(ctx, time.Now().Add(-time.Hour), time.Now().Add(time.Minute))
+            So(err, ShouldBeNil)
+
+            var found *model.BillingInstance
+            for _, report := range *reports {
+                for i := range report.Instances {
+                    if report.Instances[i].Name == pSpec.Name {
+                        So(report.BillingCode, ShouldEqual, "testOps")
+                        found = &report.Instances[i]
+                    }
+                }
+            }
+            So(found, ShouldNotBeNil)
+            So(found.Plan, ShouldEqual, planName)
+            So(found.InstanceDays, ShouldEqual, 1)
+            So(found.Usage, ShouldBeGreaterThan, 1024)
+        })
+
+        Convey("Should expire usage snapshots after USAGE_RETENTION", func() {
+            indexes, err := s.DB(brokerDbName).C(usageCollection).Indexes()
+            So(err, ShouldBeNil)
+
+            var expiry time.Duration
+            for _, index := range indexes {
+                if len(index.Key) == 1 && index.Key[0] == "time" {
+                    expiry = index.ExpireAfter
+                }
+            }
+            So(expiry, ShouldEqual, usageRetention)
+        })
+
+        Reset(func() {
+            quotaEnforce = false
+            if pSpec != nil {
+                RemoveDb(ctx, pSpec.Name)
+                s.DB(brokerDbName).C(usageCollection).RemoveAll(bson.M{"name": pSpec.Name})
+            }
+            s.DB(brokerDbName).C(plansCollection).Remove(bson.M{"name": planName})
+        })
+    })
+
+    Convey("When plan changes race", t, func() {
+        pSpec, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+        So(err, ShouldBeNil)
+
+        Convey("Should let only one of them start", func() {
+            errs := make(chan error, 4)
+            for i := 0; i < cap(errs); i++ {
+                go func() {
+                    _, err := ChangePlan(ctx, pSpec.Name, "ha")
+                    errs <- err
+                }()
+            }
+            for i := 0; i < cap(errs); i++ {
+                if err := <-errs; err != nil {
+                    _, isOpErr := err.(*OpError)
+                    So(isOpErr, ShouldBeFalse)
+                }
+            }
+
+            dbSpec, err := GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(dbSpec.Plan, ShouldEqual, "ha")
+            So(dbSpec.Status, ShouldEqual, model.StatusActive)
+        })
+        Convey("Should refuse while the instance is busy", func() {
+            So(setStatus(ctx, pSpec.Name, model.StatusDeprovisioning, "", ""), ShouldBeNil)
+            _, err := ChangePlan(ctx, pSpec.Name, "ha")
             So(err, ShouldNotBeNil)
+
+            dbSpec, err := GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(dbSpec.Status, ShouldEqual, model.StatusDeprovisioning)
+            So(setStatus(ctx, pSpec.Name, model.StatusActive, "", ""), ShouldBeNil)
+        })
+
+        Reset(func() {
+            RemoveDb(ctx, pSpec.Name)
+        })
+    })
+
+    Convey("When changing to a plan smaller than the data", t, func() {
+        planName := fmt.Sprintf("small%d", time.Now().UnixNano())
+        err := s.DB(brokerDbName).C(plansCollection).Insert(&model.PlanSpec{
+            Name:        planName,
+            Size:        "1kb",
+            Description: "Too small to move to",
+        })
+        So(err, ShouldBeNil)
+        loadPlans()
+
+        pSpec, err := Provision(ctx, model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+        So(err, ShouldBeNil)
+
+        for i := 0; i < 100; i++ {
+            err = s.DB(pSpec.Name).C("filler").Insert(bson.M{"n": i, "pad": fmt.Sprintf("%0100d", i)})
+            So(err, ShouldBeNil)
+        }
+
+        Convey("Should refuse the change and leave the instance as it was", func() {
+            _, err := ChangePlan(ctx, pSpec.Name, planName)
+            So(err, ShouldNotBeNil)
+            So(err.Error(), ShouldContainSubstring, "exceeds")
+            _, ok := err.(*OpError)
+            So(ok, ShouldBeFalse)
+
+            dbSpec, err := GetDbInfo(ctx, pSpec.Name)
+            So(err, ShouldBeNil)
+            So(dbSpec.Plan, ShouldEqual, "shared")
+            So(dbSpec.Status, ShouldEqual, model.StatusActive)
+
+            n, err := s.DB(pSpec.Name).C("filler").Count()
+            So(err, ShouldBeNil)
+            So(n, ShouldEqual, 100)
+        })
+
+        Reset(func() {
+            if pSpec != nil {
+                RemoveDb(ctx, pSpec.Name)
+            }
+            s.DB(brokerDbName).C(plansCollection).Remove(bson.M{"name": planName})
         })
     })
 
     Convey("When requesting plans", t, func() {
-        pSpec, err := GetPlans()
+        pSpec, err := GetPlans(ctx)
 
         Convey("Should list current available plans", func() {
             So(err, ShouldBeNil)
@@ -0,0 +1,282 @@
+package db
+
+/*
+ * Soft delete.  A deleted instance keeps its database and users for
+ * DELETE_RETENTION, but the users have no roles, so nothing can read or
+ * write the data.  Until then it can be undeleted, after that the purger
+ * drops it for good.
+ */
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+var ErrDeleted = errors.New("Instance is deleted")
+
+/*
+ * Empty but not nil, mgo only sends the roles of a user that has some or
+ * whose roles are set.
+ */
+var deletedRoles = []mgo.Role{}
+
+func deleteInit() error {
+    return BrokerDB.C(provisionCollection).EnsureIndex(mgo.Index{
+        Key: []string{"status", "purgeafter"},
+    })
+}
+
+/*
+ * setDeletedRoles takes every role from the users of dbSpec, including
+ * rotated users and additional credentials, or gives them back.
+ */
+func setDeletedRoles(ctx context.Context, s *mgo.Session, dbSpec *model.DatabaseSpec, deleted bool) error {
+    var roles []mgo.Role
+    if deleted {
+        roles = deletedRoles
+    }
+
+    err := setUserRoles(ctx, s, dbSpec, roles)
+    if err != nil {
+        return err
+    }
+
+    instanceLog(ctx, dbSpec).Infof("%s users deleted: %t", dbSpec.Name, deleted)
+    return nil
+}
+
+/*
+ * setUserRoles gives every user of dbSpec the roles, or the roles its
+ * record implies when roles is nil.  Users that are no longer on the
+ * server, such as rotated users already reaped, are skipped.
+ */
+func setUserRoles(ctx context.Context, s *mgo.Session, dbSpec *model.DatabaseSpec, roles []mgo.Role) error {
+    ilog := instanceLog(ctx, dbSpec)
+
+    var cSpec model.CredentialSpec
+
+    main := roles
+    if main == nil {
+        main = instanceRoles
+        if dbSpec.WriteRevoked {
+            main = overQuotaRoles
+        }
+    }
+
+    users := map[string][]mgo.Role{dbSpec.Username: main}
+    for _, ru := range dbSpec.RetiredUsers {
+        users[ru.Username] = main
+    }
+
+    cSession := BrokerDB.Session.Copy()
+    defer cSession.Close()
+
+    iter := cSession.DB(brokerDbName).C(credentialsCollection).Find(bson.M{"database": dbSpec.Name}).Iter()
+    for iter.Next(&cSpec) {
+        users[cSpec.Username] = credentialRoles(dbSpec, &cSpec, roles)
+    }
+    if err := iter.Close(); err != nil {
+        return err
+    }
+
+    onServer, err := dbUsernames(s.DB(dbSpec.Name))
+    if err != nil {
+        return err
+    }
+
+    for username, r := range users {
+        if !onServer[username] {
+            ilog.Warnf("user %s not on %s, skipped", username, dbSpec.Name)
+            continue
+        }
+        err := s.DB(dbSpec.Name).UpsertUser(&mgo.User{
+            Username: username,
+            Roles:    r,
+        })
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/*
+ * credentialRoles returns roles, or when it is nil the roles of the
+ * credential's profile, read only while writes are revoked.
+ */
+func credentialRoles(dbSpec *model.DatabaseSpec, cSpec *model.CredentialSpec, roles []mgo.Role) []mgo.Role {
+    if roles != nil {
+        return roles
+    }
+    if dbSpec.WriteRevoked {
+        return overQuotaRoles
+    }
+    return roleProfiles[cSpec.Role]
+}
+
+/*
+ * dbUsernames returns the users defined on d.
+ */
+func dbUsernames(d *mgo.Database) (map[string]bool, error) {
+    var res struct {
+        Users []serverUser `bson:"users"`
+    }
+
+    err := d.Run(bson.D{{Name: "usersInfo", Value: 1}}, &res)
+    if err != nil {
+        return nil, err
+    }
+
+    names := map[string]bool{}
+    for _, u := range res.Users {
+        names[u.User] = true
+    }
+    return names, nil
+}
+
+func softDelete(ctx context.Context, dbSpec *model.DatabaseSpec) error {
+    ilog := instanceLog(ctx, dbSpec)
+
+    dSession, err := instanceSession(dbSpec)
+    if err != nil {
+        return &OpError{Op: "delete", Name: dbSpec.Name, Err: err, RolledBack: true}
+    }
+    defer dSession.Close()
+
+    err = setDeletedRoles(ctx, dSession, dbSpec, true)
+    if err != nil {
+        ilog.Errorf("revoking users of %s: %s", dbSpec.Name, err)
+        opErr := &OpError{Op: "delete", Name: dbSpec.Name, Err: err, RolledBack: true}
+        if rErr := setDeletedRoles(ctx, dSession, dbSpec, false); rErr != nil {
+            ilog.Errorf("restoring users of %s: %s", dbSpec.Name, rErr)
+            opErr.RolledBack = false
+        }
+        return opErr
+    }
+
+    purgeAfter := time.Now().Add(deleteRetention)
+
+    bSession := BrokerDB.Session.Copy()
+    defer bSession.Close()
+
+    err = bSession.DB(brokerDbName).C(provisionCollection).Update(bson.M{"name": dbSpec.Name}, bson.M{
+        "$set": bson.M{"purgeafter": purgeAfter},
+    })
+    if err == nil {
+        err = setStatus(ctx, dbSpec.Name, model.StatusDeleted, "deleted, purged after "+purgeAfter.Format(time.RFC3339), "")
+    }
+    if err != nil {
+        opErr := &OpError{Op: "delete", Name: dbSpec.Name, Err: err, RolledBack: true}
+        if rErr := setDeletedRoles(ctx, dSession, dbSpec, false); rErr != nil {
+            ilog.Errorf("restoring users of %s: %s", dbSpec.Name, rErr)
+            opErr.RolledBack = false
+        }
+        return opErr
+    }
+
+    ilog.Infof("deleted %s, purged after %s", dbSpec.Name, purgeAfter.Format(time.RFC3339))
+    return nil
+}
+
+/*
+ * Undelete gives the users of a deleted instance their roles back before
+ * the purger gets to it.
+ */
+func Undelete(ctx context.Context, dbName string) (*model.DatabaseSpec, error) {
+    log := logger.FromContext(ctx)
+
+    dbSpec, err := GetDbInfo(ctx, dbName)
+    if err != nil {
+        log.Errorf("unable to find: %v", dbName)
+        return dbSpec, err
+    }
+    ilog := instanceLog(ctx, dbSpec)
+
+    if dbSpec.Status != model.StatusDeleted {
+        return dbSpec, errors.New("Instance is " + dbSpec.Status)
+    }
+
+    uSession, err := instanceSession(dbSpec)
+    if err != nil {
+        return dbSpec, &OpError{Op: "undelete", Name: dbName, Err: err, RolledBack: true}
+    }
+    defer uSession.Close()
+
+    err = setDeletedRoles(ctx, uSession, dbSpec, false)
+    if err != nil {
+        ilog.Errorf("restoring users of %s: %s", dbName, err)
+        opErr := &OpError{Op: "undelete", Name: dbName, Err: err, RolledBack: true}
+        if rErr := setDeletedRoles(ctx, uSession, dbSpec, true); rErr != nil {
+            opErr.RolledBack = false
+        }
+        return dbSpec, opErr
+    }
+
+    bSession := BrokerDB.Session.Copy()
+    defer bSession.Close()
+
+    err = bSession.DB(brokerDbName).C(provisionCollection).Update(bson.M{"name": dbName}, bson.M{
+        "$unset": bson.M{"purgeafter": ""},
+    })
+    if err == nil {
+        err = setStatus(ctx, dbName, model.StatusActive, "", "")
+    }
+    if err != nil {
+        return dbSpec, &OpError{Op: "undelete", Name: dbName, Err: err, RolledBack: false}
+    }
+
+    dbSpec.Status = model.StatusActive
+    dbSpec.Message = ""
+    dbSpec.PurgeAfter = time.Time{}
+
+    ilog.Infof("undeleted %s", dbName)
+    return dbSpec, nil
+}
+
+func StartPurger() {
+    runEvery("purger", purgeInterval, purgeDeleted)
+}
+
+/*
+ * purgeDeleted drops every deleted instance whose retention has run out.
+ */
+func purgeDeleted(ctx context.Context) {
+    log := logger.FromContext(ctx)
+
+    var names []struct {
+        Name string
+    }
+
+    pSession := BrokerDB.Session.Copy()
+    defer pSession.Close()
+
+    err := pSession.DB(brokerDbName).C(provisionCollection).Find(bson.M{
+        "status":     model.StatusDeleted,
+        "purgeafter": bson.M{"$lte": time.Now()},
+    }).Select(bson.M{"name": 1}).All(&names)
+    if err != nil {
+        log.Errorf("finding deleted instances: %v", err)
+        return
+    }
+
+    for _, n := range names {
+        dbSpec, err := GetDbInfo(ctx, n.Name)
+        if err != nil || dbSpec.Status != model.StatusDeleted {
+            continue
+        }
+
+        err = purgeDb(ctx, dbSpec)
+        if err != nil {
+            instanceLog(ctx, dbSpec).Errorf("purging %s: %s", dbSpec.Name, err)
+            continue
+        }
+        instanceLog(ctx, dbSpec).Infof("purged %s", dbSpec.Name)
+    }
+}
@@ -0,0 +1,391 @@
+package db
+
+/*
+ * Drift between the provision records and the clusters.  Each cluster is
+ * compared with the records placed on it:
+ *
+ *   orphan databases  instance named databases, or their users, with no record
+ *   orphan records    records whose database has neither data nor users
+ *   missing users     instance or credential users that are not on the cluster
+ *   role mismatches   users whose roles are not the ones the record implies
+ *
+ * Repair recreates missing users from the stored passwords, puts the
+ * expected roles back and marks orphan records failed.  Orphan databases
+ * are only reported, dropping data the broker knows nothing about is left
+ * to an operator.
+ */
+
+import (
+    "context"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+type serverRole struct {
+    Role string `bson:"role"`
+    DB   string `bson:"db"`
+}
+
+type serverUser struct {
+    User  string       `bson:"user"`
+    DB    string       `bson:"db"`
+    Roles []serverRole `bson:"roles"`
+}
+
+/*
+ * A user a record says should be on the cluster.
+ */
+type expectedUser struct {
+    username string
+    roles    []mgo.Role
+    user     func() (*mgo.User, error)
+    optional bool
+}
+
+func StartDriftCheck() {
+    runEvery("drift check", driftInterval, func(ctx context.Context) {
+        log := logger.FromContext(ctx)
+
+        report, err := CheckDrift(ctx, driftRepair)
+        if err != nil {
+            log.Errorf("checking drift: %s", err)
+            return
+        }
+        logDrift(ctx, report)
+    })
+}
+
+func logDrift(ctx context.Context, report *model.DriftSpec) {
+    log := logger.FromContext(ctx)
+
+    n := len(report.OrphanDatabases) + len(report.OrphanRecords) + len(report.MissingUsers) + len(report.RoleMismatches)
+    if n == 0 && len(report.UncheckedClusters) == 0 {
+        log.Debugf("no drift")
+        return
+    }
+
+    log.Warnf("drift: %d orphan databases, %d orphan records, %d missing users, %d role mismatches, unchecked clusters %v",
+        len(report.OrphanDatabases), len(report.OrphanRecords), len(report.MissingUsers), len(report.RoleMismatches),
+        report.UncheckedClusters)
+}
+
+/*
+ * clusterUsers returns the roles of every user on the cluster of s, by
+ * database and username.
+ */
+func clusterUsers(s *mgo.Session) (map[string]map[string][]serverRole, error) {
+    var res struct {
+        Users []serverUser `bson:"users"`
+    }
+
+    err := s.DB("admin").Run(bson.D{{Name: "usersInfo", Value: bson.M{"forAllDBs": true}}}, &res)
+    if err != nil {
+        return nil, err
+    }
+
+    users := map[string]map[string][]serverRole{}
+    for _, u := range res.Users {
+        if users[u.DB] == nil {
+            users[u.DB] = map[string][]serverRole{}
+        }
+        users[u.DB][u.User] = u.Roles
+    }
+    return users, nil
+}
+
+/*
+ * roleNames returns the sorted roles on dbName, roles on other databases
+ * as role@db.
+ */
+func roleNames(dbName string, roles []serverRole) []string {
+    names := []string{}
+    for _, r := range roles {
+        if r.DB == dbName {
+            names = append(names, r.Role)
+        } else {
+            names = append(names, r.Role+"@"+r.DB)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+func expectedRoleNames(roles []mgo.Role) []string {
+    names := []string{}
+    for _, r := range roles {
+        names = append(names, string(r))
+    }
+    sort.Strings(names)
+    return names
+}
+
+/*
+ * expectedUsers lists the users of dbSpec: its own, any rotated user still
+ * in its grace period and its credentials.
+ */
+func expectedUsers(dbSpec *model.DatabaseSpec, creds []model.CredentialSpec) []expectedUser {
+    main := instanceUser(dbSpec)
+
+    users := []expectedUser{{
+        username: dbSpec.Username,
+        roles:    main.Roles,
+        user: func() (*mgo.User, error) {
+            return main, nil
+        },
+    }}
+
+    for _, ru := range dbSpec.RetiredUsers {
+        users = append(users, expectedUser{username: ru.Username, roles: main.Roles, optional: true})
+    }
+
+    for i := range creds {
+        cSpec := creds[i]
+        roles := credentialRoles(dbSpec, &cSpec, nil)
+        if dbSpec.Status == model.StatusDeleted {
+            roles = deletedRoles
+        }
+        users = append(users, expectedUser{
+            username: cSpec.Username,
+            roles:    roles,
+            user: func() (*mgo.User, error) {
+                var err error
+
+                cSpec.Password, err = decryptPassword(cSpec.Password)
+                if err != nil {
+                    return nil, err
+                }
+                u := credentialUser(dbSpec, &cSpec)
+                u.Roles = roles
+                return u, nil
+            },
+        })
+    }
+    return users
+}
+
+func repairItem(item *model.DriftItem, err error) {
+    if err != nil {
+        item.Error = err.Error()
+        return
+    }
+    item.Repaired = true
+}
+
+/*
+ * CheckDrift compares every reachable cluster with the records placed on
+ * it, and repairs what it can if repair is set.
+ */
+func CheckDrift(ctx context.Context, repair bool) (*model.DriftSpec, error) {
+    log := logger.FromContext(ctx)
+
+    var dbSpec model.DatabaseSpec
+    var cSpec model.CredentialSpec
+
+    report := &model.DriftSpec{
+        Checked:         time.Now(),
+        Repair:          repair,
+        OrphanDatabases: []model.DriftItem{},
+        OrphanRecords:   []model.DriftItem{},
+        MissingUsers:    []model.DriftItem{},
+        RoleMismatches:  []model.DriftItem{},
+    }
+
+    dSession := BrokerDB.Session.Copy()
+    defer dSession.Close()
+
+    records := map[string]map[string]model.DatabaseSpec{}
+    moving := map[string]bool{}
+    iter := dSession.DB(brokerDbName).C(provisionCollection).Find(nil).Iter()
+    for iter.Next(&dbSpec) {
+        defaultStatus(&dbSpec)
+        cluster := dbSpec.Cluster
+        if cluster == "" {
+            cluster = defaultCluster
+        }
+        if records[cluster] == nil {
+            records[cluster] = map[string]model.DatabaseSpec{}
+        }
+        records[cluster][dbSpec.Name] = dbSpec
+        if dbSpec.Status == model.StatusUpdating || dbSpec.ChangingTo != "" {
+            moving[dbSpec.Name] = true
+        }
+        dbSpec = model.DatabaseSpec{}
+    }
+    if err := iter.Close(); err != nil {
+        log.Errorf("reading records: %v", err)
+        return report, err
+    }
+
+    creds := map[string][]model.CredentialSpec{}
+    iter = dSession.DB(brokerDbName).C(credentialsCollection).Find(nil).Iter()
+    for iter.Next(&cSpec) {
+        creds[cSpec.Database] = append(creds[cSpec.Database], cSpec)
+        cSpec = model.CredentialSpec{}
+    }
+    if err := iter.Close(); err != nil {
+        log.Errorf("reading credentials: %v", err)
+        return report, err
+    }
+
+    instanceDbRe := regexp.MustCompile("^" + regexp.QuoteMeta(namePrefix) + "[a-z0-9]{8}$")
+
+    for name := range records {
+        if _, ok := clusters[name]; !ok {
+            report.UncheckedClusters = append(report.UncheckedClusters, name)
+        }
+    }
+
+    for _, name := range clusterNames {
+        c := clusters[name]
+
+        s := c.Session.Copy()
+        err := checkClusterDrift(ctx, s, name, records[name], creds, moving, instanceDbRe, repair, report)
+        s.Close()
+        if err != nil {
+            log.Errorf("checking cluster %s: %s", name, err)
+            report.UncheckedClusters = append(report.UncheckedClusters, name)
+        }
+    }
+
+    sort.Strings(report.UncheckedClusters)
+    return report, nil
+}
+
+/*
+ * checkClusterDrift compares cluster with its records.  The databases in
+ * moving are being copied between clusters by a plan change, the copy has
+ * no record on its cluster yet and is not an orphan.
+ */
+func checkClusterDrift(ctx context.Context, s *mgo.Session, cluster string, records map[string]model.DatabaseSpec,
+    creds map[string][]model.CredentialSpec, moving map[string]bool, instanceDbRe *regexp.Regexp, repair bool, report *model.DriftSpec) error {
+
+    dbNames, err := s.DatabaseNames()
+    if err != nil {
+        return err
+    }
+    users, err := clusterUsers(s)
+    if err != nil {
+        return err
+    }
+
+    onServer := map[string]bool{}
+    for _, name := range dbNames {
+        onServer[name] = true
+    }
+
+    candidates := map[string]bool{}
+    for name := range onServer {
+        candidates[name] = true
+    }
+    for name := range users {
+        candidates[name] = true
+    }
+
+    orphans := []string{}
+    for name := range candidates {
+        if _, ok := records[name]; !ok && !moving[name] && instanceDbRe.MatchString(name) {
+            orphans = append(orphans, name)
+        }
+    }
+    sort.Strings(orphans)
+    for _, name := range orphans {
+        report.OrphanDatabases = append(report.OrphanDatabases, model.DriftItem{
+            Cluster:  cluster,
+            Database: name,
+            Detail:   strings.Join(usernames(users[name]), ","),
+        })
+    }
+
+    names := []string{}
+    for name := range records {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    for _, name := range names {
+        dbSpec := records[name]
+
+        /*
+         * Records part way through provisioning, deprovisioning or a plan
+         * change, or that have already failed, are not expected to match.
+         * A plan change freezes the users on purpose while it copies.
+         */
+        switch dbSpec.Status {
+        case model.StatusActive, model.StatusDeleted:
+        default:
+            continue
+        }
+        if dbSpec.ChangingTo != "" {
+            continue
+        }
+
+        ilog := instanceLog(ctx, &dbSpec)
+
+        if !onServer[name] && len(users[name]) == 0 {
+            item := model.DriftItem{Cluster: cluster, Database: name, Detail: "no data or users on the cluster"}
+            if repair {
+                repairItem(&item, setStatus(ctx, name, model.StatusFailed, "", "database and users not found on cluster "+cluster))
+            }
+            ilog.Warnf("orphan record %s", name)
+            report.OrphanRecords = append(report.OrphanRecords, item)
+            continue
+        }
+
+        dbSpec.Password, err = decryptPassword(dbSpec.Password)
+        if err != nil {
+            return err
+        }
+
+        for _, eu := range expectedUsers(&dbSpec, creds[name]) {
+            item := model.DriftItem{Cluster: cluster, Database: name, Username: eu.username}
+
+            roles, ok := users[name][eu.username]
+            if !ok {
+                if eu.optional {
+                    continue
+                }
+                if repair {
+                    u, err := eu.user()
+                    if err == nil {
+                        err = s.DB(name).UpsertUser(u)
+                    }
+                    repairItem(&item, err)
+                }
+                ilog.Warnf("missing user %s on %s", eu.username, name)
+                report.MissingUsers = append(report.MissingUsers, item)
+                continue
+            }
+
+            have := roleNames(name, roles)
+            want := expectedRoleNames(eu.roles)
+            if strings.Join(have, ",") == strings.Join(want, ",") {
+                continue
+            }
+
+            item.Detail = "has " + strings.Join(have, ",") + ", expected " + strings.Join(want, ",")
+            if repair {
+                repairItem(&item, s.DB(name).UpsertUser(&mgo.User{Username: eu.username, Roles: eu.roles}))
+            }
+            ilog.Warnf("user %s on %s %s", eu.username, name, item.Detail)
+            report.RoleMismatches = append(report.RoleMismatches, item)
+        }
+    }
+    return nil
+}
+
+func usernames(users map[string][]serverRole) []string {
+    names := []string{}
+    for u := range users {
+        names = append(names, u)
+    }
+    sort.Strings(names)
+    return names
+}
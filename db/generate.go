@@ -0,0 +1,143 @@
+package db
+
+/*
+ * Generation of database names, usernames and passwords.  Plans may set
+ * the password length and one of the character sets below; usernames are
+ * checked against the users already on the cluster.
+ */
+
+import (
+    "context"
+    "crypto/rand"
+    "errors"
+    "fmt"
+    "math/big"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const (
+    lowerAlnum = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+    usernameLength        = 12
+    defaultPasswordLength = 24
+    minPasswordLength     = 12
+    maxPasswordLength     = 128
+
+    defaultCharset = "alphanumeric"
+
+    /*
+     * Attempts at a username that is not on the cluster before giving up.
+     */
+    maxUsernameTries = 5
+)
+
+/*
+ * Passwords end up in connection URLs, so none of the sets need escaping.
+ */
+var passwordCharsets = map[string]string{
+    "alphanumeric": "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789",
+    "hex":          "0123456789abcdef",
+    "urlsafe":      "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-._~",
+}
+
+var ErrUsernameCollision = errors.New("Could not generate a username not already on the cluster")
+
+/*
+ * randomString returns n characters drawn uniformly from charset.
+ */
+func randomString(n int, charset string) (string, error) {
+    max := big.NewInt(int64(len(charset)))
+    b := make([]byte, n)
+    for i := range b {
+        r, err := rand.Int(rand.Reader, max)
+        if err != nil {
+            return "", err
+        }
+        b[i] = charset[r.Int64()]
+    }
+    return string(b), nil
+}
+
+func validatePasswordPolicy(pSpec *model.PlanSpec) error {
+    if pSpec.PasswordLength != 0 &&
+        (pSpec.PasswordLength < minPasswordLength || pSpec.PasswordLength > maxPasswordLength) {
+        return fmt.Errorf("Password length must be between %d and %d", minPasswordLength, maxPasswordLength)
+    }
+    if pSpec.PasswordCharset != "" {
+        if _, ok := passwordCharsets[pSpec.PasswordCharset]; !ok {
+            return errors.New("Invalid password charset " + pSpec.PasswordCharset)
+        }
+    }
+    return nil
+}
+
+/*
+ * Password length and characters for plan, the defaults when plan is nil
+ * or does not say.
+ */
+func passwordPolicy(plan *model.PlanSpec) (int, string) {
+    length := defaultPasswordLength
+    charset := passwordCharsets[defaultCharset]
+
+    if plan != nil {
+        if plan.PasswordLength != 0 {
+            length = plan.PasswordLength
+        }
+        if cs, ok := passwordCharsets[plan.PasswordCharset]; ok {
+            charset = cs
+        }
+    }
+    return length, charset
+}
+
+func newDbName() (string, error) {
+    suffix, err := randomString(8, lowerAlnum)
+    if err != nil {
+        return "", err
+    }
+    return namePrefix + suffix, nil
+}
+
+/*
+ * newCredentials generates a username that no database on the cluster of
+ * s uses yet, and a password following the policy of plan.
+ */
+func newCredentials(ctx context.Context, s *mgo.Session, plan *model.PlanSpec) (string, string, error) {
+    log := logger.FromContext(ctx)
+
+    var username string
+
+    for i := 0; ; i++ {
+        if i == maxUsernameTries {
+            return "", "", ErrUsernameCollision
+        }
+
+        suffix, err := randomString(usernameLength, lowerAlnum)
+        if err != nil {
+            return "", "", err
+        }
+        username = "u" + suffix
+
+        n, err := s.DB("admin").C("system.users").Find(bson.M{"user": username}).Count()
+        if err != nil {
+            return "", "", err
+        }
+        if n == 0 {
+            break
+        }
+        log.Infof("username %s already on the cluster", username)
+    }
+
+    length, charset := passwordPolicy(plan)
+    password, err := randomString(length, charset)
+    if err != nil {
+        return "", "", err
+    }
+
+    return username, password, nil
+}
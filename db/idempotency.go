@@ -0,0 +1,141 @@
+package db
+
+/*
+ * Idempotent provisioning.  A caller that may retry a provision sends an
+ * idempotency key, or an instance id, with it.  A retry with the same key
+ * and request gets the instance the first request created; the same key
+ * with a different request is refused.  Idempotency keys belong to the
+ * API key that sent them, so callers cannot see each other's instances by
+ * picking the same one.
+ */
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "strings"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const maxIdempotencyKey = 255
+
+var ErrIdempotencyConflict = errors.New("Idempotency key already used for a different request")
+
+func idempotencyInit() error {
+    c := BrokerDB.C(provisionCollection)
+
+    /*
+     * Keys used to be unique across callers.
+     */
+    err := c.DropIndex("idempotencykey")
+    if err != nil && !strings.Contains(err.Error(), "not found") {
+        return err
+    }
+
+    return c.EnsureIndex(mgo.Index{
+        Key:    []string{"callerid", "idempotencykey"},
+        Unique: true,
+        Sparse: true,
+    })
+}
+
+/*
+ * callerFilter matches the records of callerId.  Records made without one
+ * do not have the field.
+ */
+func callerFilter(callerId string) interface{} {
+    if callerId == "" {
+        return bson.M{"$exists": false}
+    }
+    return callerId
+}
+
+func validateIdempotencyKey(key string) error {
+    if len(key) > maxIdempotencyKey {
+        return errors.New("Idempotency key is too long")
+    }
+    for _, c := range key {
+        if c < ' ' || c == 0x7f {
+            return errors.New("Idempotency key has control characters")
+        }
+    }
+    return nil
+}
+
+/*
+ * requestHash identifies what was asked for, leaving out the keys that
+ * identify the request.
+ */
+func requestHash(in model.ProvisionSpec) string {
+    in.IdempotencyKey = ""
+    in.InstanceId = ""
+    in.CallerId = ""
+
+    b, _ := json.Marshal(in)
+    sum := sha256.Sum256(b)
+    return hex.EncodeToString(sum[:])
+}
+
+/*
+ * Records from before requests were hashed are compared on what they
+ * were provisioned with.
+ */
+func sameRequest(dbSpec *model.DatabaseSpec, in model.ProvisionSpec) bool {
+    if dbSpec.RequestHash != "" {
+        return dbSpec.RequestHash == requestHash(in)
+    }
+    return dbSpec.Plan == in.Plan && dbSpec.BillingCode == in.BillingCode
+}
+
+/*
+ * findProvisioned returns the instance an earlier request with the
+ * idempotency key or instance id of in created, nil if there is none.  It
+ * may still be provisioning.
+ */
+func findProvisioned(ctx context.Context, s *mgo.Session, in model.ProvisionSpec) (*model.DatabaseSpec, error) {
+    log := logger.FromContext(ctx)
+
+    filters := []bson.M{}
+    if in.IdempotencyKey != "" {
+        filters = append(filters, bson.M{"idempotencykey": in.IdempotencyKey, "callerid": callerFilter(in.CallerId)})
+    }
+    if in.InstanceId != "" {
+        filters = append(filters, bson.M{"instanceid": in.InstanceId})
+    }
+
+    for _, f := range filters {
+        var dbSpec model.DatabaseSpec
+
+        err := s.DB(brokerDbName).C(provisionCollection).Find(f).One(&dbSpec)
+        if err == mgo.ErrNotFound {
+            continue
+        }
+        if err != nil {
+            log.Errorf("finding %v: %v", f, err)
+            return nil, &OpError{Op: "provision", Name: "a " + in.Plan + " instance", Err: err, RolledBack: true}
+        }
+
+        if !sameRequest(&dbSpec, in) {
+            instanceLog(ctx, &dbSpec).Warnf("%v reused for a different request", f)
+            return nil, ErrIdempotencyConflict
+        }
+
+        defaultStatus(&dbSpec)
+        dbSpec.Password, err = decryptPassword(dbSpec.Password)
+        if err != nil {
+            return nil, &OpError{Op: "provision", Name: dbSpec.Name, Err: err, RolledBack: true}
+        }
+        dbSpec.Replayed = true
+
+        instanceLog(ctx, &dbSpec).Infof("replaying provision of %s", dbSpec.Name)
+        return &dbSpec, nil
+    }
+    return nil, nil
+}
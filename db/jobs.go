@@ -0,0 +1,46 @@
+package db
+
+/*
+ * Background jobs run by the broker alongside the API.
+ */
+
+import (
+    "context"
+    "time"
+
+    "mongodb-api/logger"
+)
+
+/*
+ * runEvery calls fn every interval until the process exits.  A job that
+ * panics is logged and tried again on the next tick.  fn logs through the
+ * logger of its context, which names the job.
+ */
+func runEvery(name string, interval time.Duration, fn func(context.Context)) {
+    if interval <= 0 {
+        log.Infof("%s disabled", name)
+        return
+    }
+
+    log.Infof("starting %s every %s", name, interval)
+
+    ctx := logger.NewContext(context.Background(), log.With(logger.Fields{"job": name}))
+
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+
+        for range ticker.C {
+            runJob(ctx, name, fn)
+        }
+    }()
+}
+
+func runJob(ctx context.Context, name string, fn func(context.Context)) {
+    defer func() {
+        if r := recover(); r != nil {
+            log.Errorf("%s panic: %v", name, r)
+        }
+    }()
+    fn(ctx)
+}
@@ -0,0 +1,213 @@
+package db
+
+/*
+ * Key/value labels on instances, such as app, space, team and
+ * environment.  Besides the labels themselves each record keeps a
+ * labelindex of "key=value" strings, which is indexed so that listing by
+ * label does not scan the provision collection.
+ */
+
+import (
+    "context"
+    "errors"
+    "regexp"
+    "sort"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const (
+    maxLabels        = 64
+    maxLabelValueLen = 255
+    labelRetries     = 5
+)
+
+var (
+    ErrLabelNotFound = errors.New("Label not found")
+    ErrLabelsChanged = errors.New("Labels were changed by another request, try again")
+
+    errLabelsMoved = errors.New("labels changed since read")
+
+    labelKeyRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+)
+
+func labelsInit() error {
+    return BrokerDB.C(provisionCollection).EnsureIndex(mgo.Index{
+        Key: []string{"labelindex"},
+    })
+}
+
+func validateLabel(key string, value string) error {
+    if !labelKeyRe.MatchString(key) {
+        return errors.New("Invalid label " + key + ", keys are lower case letters, digits, '.', '_' and '-'")
+    }
+    if len(value) > maxLabelValueLen {
+        return errors.New("Label " + key + " is too long")
+    }
+    for _, c := range value {
+        if c < ' ' || c == 0x7f {
+            return errors.New("Label " + key + " has control characters")
+        }
+    }
+    return nil
+}
+
+func validateLabels(labels map[string]string) error {
+    if len(labels) > maxLabels {
+        return errors.New("Too many labels")
+    }
+    for k, v := range labels {
+        if err := validateLabel(k, v); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/*
+ * labelIndex returns the "key=value" strings for labels, sorted.
+ */
+func labelIndex(labels map[string]string) []string {
+    if len(labels) == 0 {
+        return nil
+    }
+
+    index := make([]string, 0, len(labels))
+    for k, v := range labels {
+        index = append(index, k+"="+v)
+    }
+    sort.Strings(index)
+    return index
+}
+
+/*
+ * labelIndexFilter matches the labelindex a record was read with.  Records
+ * without labels have none, or an empty one.
+ */
+func labelIndexFilter(index []string) interface{} {
+    if len(index) == 0 {
+        return bson.M{"$in": []interface{}{nil, []string{}}}
+    }
+    return index
+}
+
+/*
+ * updateLabels saves the labels of dbSpec if the record still has the
+ * labelindex prev it was read with.
+ */
+func updateLabels(ctx context.Context, dbSpec *model.DatabaseSpec, prev []string) error {
+    log := logger.FromContext(ctx)
+
+    lSession := BrokerDB.Session.Copy()
+    defer lSession.Close()
+
+    dbSpec.LabelIndex = labelIndex(dbSpec.Labels)
+    dbSpec.Updated = time.Now()
+
+    err := lSession.DB(brokerDbName).C(provisionCollection).Update(bson.M{
+        "name":       dbSpec.Name,
+        "labelindex": labelIndexFilter(prev),
+    }, bson.M{
+        "$set": bson.M{
+            "labels":     dbSpec.Labels,
+            "labelindex": dbSpec.LabelIndex,
+            "updated":    dbSpec.Updated,
+        },
+    })
+    if err == mgo.ErrNotFound {
+        return errLabelsMoved
+    }
+    if err != nil {
+        log.Errorf("updating labels of %s: %s", dbSpec.Name, err)
+        return &OpError{Op: "label", Name: dbSpec.Name, Err: err, RolledBack: true}
+    }
+    return nil
+}
+
+/*
+ * changeLabels reads the labels of dbName, lets change alter them and
+ * saves them, reading them again if another request saved labels in the
+ * meantime.
+ */
+func changeLabels(ctx context.Context, dbName string, change func(*model.DatabaseSpec) error) (*model.DatabaseSpec, error) {
+    for i := 0; i < labelRetries; i++ {
+        dbSpec, err := GetDbInfo(ctx, dbName)
+        if err != nil {
+            return dbSpec, err
+        }
+
+        prev := dbSpec.LabelIndex
+        if err = change(dbSpec); err != nil {
+            return dbSpec, err
+        }
+
+        err = updateLabels(ctx, dbSpec, prev)
+        if err != errLabelsMoved {
+            return dbSpec, err
+        }
+        instanceLog(ctx, dbSpec).Infof("labels of %s changed meanwhile, retrying", dbName)
+    }
+    return nil, ErrLabelsChanged
+}
+
+/*
+ * SetLabels adds labels to dbName, replacing the value of any it already
+ * has.
+ */
+func SetLabels(ctx context.Context, dbName string, labels map[string]string) (*model.DatabaseSpec, error) {
+    if len(labels) == 0 {
+        return nil, errors.New("Labels not set")
+    }
+    err := validateLabels(labels)
+    if err != nil {
+        return nil, err
+    }
+
+    dbSpec, err := changeLabels(ctx, dbName, func(dbSpec *model.DatabaseSpec) error {
+        merged := map[string]string{}
+        for k, v := range dbSpec.Labels {
+            merged[k] = v
+        }
+        for k, v := range labels {
+            merged[k] = v
+        }
+        if len(merged) > maxLabels {
+            return errors.New("Too many labels")
+        }
+        dbSpec.Labels = merged
+        return nil
+    })
+    if err != nil {
+        return dbSpec, err
+    }
+
+    instanceLog(ctx, dbSpec).Infof("labels of %s set to %v", dbName, dbSpec.LabelIndex)
+    return dbSpec, nil
+}
+
+/*
+ * RemoveLabel removes the label key from dbName.
+ */
+func RemoveLabel(ctx context.Context, dbName string, key string) (*model.DatabaseSpec, error) {
+    dbSpec, err := changeLabels(ctx, dbName, func(dbSpec *model.DatabaseSpec) error {
+        if _, ok := dbSpec.Labels[key]; !ok {
+            return ErrLabelNotFound
+        }
+        delete(dbSpec.Labels, key)
+        if len(dbSpec.Labels) == 0 {
+            dbSpec.Labels = nil
+        }
+        return nil
+    })
+    if err != nil {
+        return dbSpec, err
+    }
+
+    instanceLog(ctx, dbSpec).Infof("label %s removed from %s", key, dbName)
+    return dbSpec, nil
+}
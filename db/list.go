@@ -0,0 +1,346 @@
+package db
+
+/*
+ * Listing the provision collection, all of it or a page at a time.  Pages
+ * are sorted by created, name or plan, with name breaking ties, and the
+ * cursor for the next page holds the sort value and name of the last
+ * record of the page so records added or removed meanwhile do not shift
+ * the pages.
+ */
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "strings"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const (
+    DefaultListLimit = 100
+    MaxListLimit     = 1000
+)
+
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+var listSorts = []string{"created", "name", "plan"}
+
+/*
+ * The bson fields needed for each JSON field of a listed instance.
+ */
+var listFields = map[string][]string{
+    "name":            {"name"},
+    "username":        {"username"},
+    "password":        {"password"},
+    "created":         {"created"},
+    "cluster":         {"cluster"},
+    "hostname":        {"host"},
+    "port":            {"port"},
+    "plan":            {"plan"},
+    "billingcode":     {"billingcode"},
+    "misc":            {"misc"},
+    "instance_id":     {"instanceid"},
+    "status":          {"status"},
+    "message":         {"message"},
+    "last_error":      {"lasterror"},
+    "updated":         {"updated"},
+    "retired_users":   {"retiredusers"},
+    "usage":           {"usage"},
+    "usage_checked":   {"usagechecked"},
+    "over_quota":      {"overquota"},
+    "write_revoked":   {"writerevoked"},
+    "last_request_id": {"lastrequestid"},
+    "labels":          {"labels"},
+    "purge_after":     {"purgeafter"},
+    "idempotency_key": {"idempotencykey"},
+    "MONGODB_URL":     {"username", "password", "host", "port", "name"},
+}
+
+type listCursor struct {
+    Sort string    `json:"s"`
+    Name string    `json:"n"`
+    Plan string    `json:"p,omitempty"`
+    Time time.Time `json:"t,omitempty"`
+}
+
+func listInit() error {
+    keys := [][]string{
+        {"name"},
+        {"created", "name"},
+        {"plan", "name"},
+    }
+    for _, key := range keys {
+        err := BrokerDB.C(provisionCollection).EnsureIndex(mgo.Index{Key: key})
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/*
+ * ValidateListQuery checks q and fills in the defaults.  Without a limit
+ * or cursor every record is listed, a cursor alone pages by
+ * DefaultListLimit.
+ */
+func ValidateListQuery(q *model.ListQuery) error {
+    if q.Limit == 0 && q.Cursor != "" {
+        q.Limit = DefaultListLimit
+    }
+    if q.Limit < 0 || q.Limit > MaxListLimit {
+        return errors.New("Invalid limit, must be between 1 and 1000")
+    }
+
+    if q.Sort == "" {
+        q.Sort = "created"
+    }
+    field := strings.TrimPrefix(q.Sort, "-")
+    valid := false
+    for _, s := range listSorts {
+        valid = valid || s == field
+    }
+    if !valid {
+        return errors.New("Invalid sort " + q.Sort + ", use created, name or plan")
+    }
+
+    for _, f := range q.Fields {
+        if _, ok := listFields[f]; !ok {
+            return errors.New("Invalid field " + f)
+        }
+    }
+
+    if q.Cursor != "" {
+        if _, err := decodeCursor(q.Cursor, q.Sort); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func encodeCursor(sort string, dbSpec *model.DatabaseSpec) string {
+    c := listCursor{Sort: sort, Name: dbSpec.Name}
+    switch strings.TrimPrefix(sort, "-") {
+    case "created":
+        c.Time = dbSpec.Created
+    case "plan":
+        c.Plan = dbSpec.Plan
+    }
+
+    b, _ := json.Marshal(c)
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string, sort string) (*listCursor, error) {
+    var c listCursor
+
+    b, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil {
+        return nil, ErrInvalidCursor
+    }
+    if err = json.Unmarshal(b, &c); err != nil || c.Name == "" {
+        return nil, ErrInvalidCursor
+    }
+    if c.Sort != sort {
+        return nil, errors.New("Cursor is for sort " + c.Sort)
+    }
+    return &c, nil
+}
+
+/*
+ * cursorFilter selects the records after c in the order of sort, or with
+ * after false the records up to and including c.
+ */
+func cursorFilter(sort string, c *listCursor, after bool) bson.M {
+    op, nameOp := "$gt", "$gt"
+    if !after {
+        op, nameOp = "$lt", "$lte"
+    }
+    if strings.HasPrefix(sort, "-") {
+        flip := map[string]string{"$gt": "$lt", "$lt": "$gt", "$lte": "$gte"}
+        op, nameOp = flip[op], flip[nameOp]
+    }
+
+    switch strings.TrimPrefix(sort, "-") {
+    case "created":
+        return bson.M{"$or": []bson.M{
+            {"created": bson.M{op: c.Time}},
+            {"created": c.Time, "name": bson.M{nameOp: c.Name}},
+        }}
+    case "plan":
+        return bson.M{"$or": []bson.M{
+            {"plan": bson.M{op: c.Plan}},
+            {"plan": c.Plan, "name": bson.M{nameOp: c.Name}},
+        }}
+    }
+    return bson.M{"name": bson.M{nameOp: c.Name}}
+}
+
+/*
+ * listFilter selects the records after the cursor of q, and up to and
+ * including next if it is set, in the order of sort.
+ */
+func listFilter(q model.ListQuery, next string) (bson.M, error) {
+    f := bson.M{}
+    if q.Plan != "" {
+        f["plan"] = q.Plan
+    }
+    if len(q.Labels) > 0 {
+        f["labelindex"] = bson.M{"$all": labelIndex(q.Labels)}
+    }
+
+    and := []bson.M{f}
+    if q.Cursor != "" {
+        c, err := decodeCursor(q.Cursor, q.Sort)
+        if err != nil {
+            return nil, err
+        }
+        and = append(and, cursorFilter(q.Sort, c, true))
+    }
+    if next != "" {
+        c, err := decodeCursor(next, q.Sort)
+        if err != nil {
+            return nil, err
+        }
+        and = append(and, cursorFilter(q.Sort, c, false))
+    }
+
+    if len(and) == 1 {
+        return f, nil
+    }
+    return bson.M{"$and": and}, nil
+}
+
+func listSort(sort string) []string {
+    if sort == "name" || sort == "-name" {
+        return []string{sort}
+    }
+    if strings.HasPrefix(sort, "-") {
+        return []string{sort, "-name"}
+    }
+    return []string{sort, "name"}
+}
+
+/*
+ * listSelect returns the projection for q.Fields, always including what
+ * the cursor needs, or nil for every field.
+ */
+func listSelect(q model.ListQuery) bson.M {
+    if len(q.Fields) == 0 {
+        return nil
+    }
+
+    sel := bson.M{"name": 1, strings.TrimPrefix(q.Sort, "-"): 1}
+    for _, f := range q.Fields {
+        for _, b := range listFields[f] {
+            sel[b] = 1
+        }
+    }
+    return sel
+}
+
+/*
+ * NextCursor returns the cursor of the page after the one q selects, or ""
+ * if that is the last one or q is not paged.  Only the sort fields of the
+ * last record of the page and the one after it are read, so the cursor is
+ * known before the page is.
+ */
+func NextCursor(ctx context.Context, q model.ListQuery) (string, error) {
+    log := logger.FromContext(ctx)
+
+    err := ValidateListQuery(&q)
+    if err != nil || q.Limit == 0 {
+        return "", err
+    }
+
+    f, err := listFilter(q, "")
+    if err != nil {
+        return "", err
+    }
+
+    nSession := BrokerDB.Session.Copy()
+    defer nSession.Close()
+
+    var ends []model.DatabaseSpec
+    err = nSession.DB(brokerDbName).C(provisionCollection).Find(f).Sort(listSort(q.Sort)...).
+        Select(bson.M{"name": 1, "created": 1, "plan": 1}).Skip(q.Limit - 1).Limit(2).All(&ends)
+    if err != nil {
+        log.Errorf("finding next page: %v", err)
+        return "", err
+    }
+    if len(ends) < 2 {
+        return "", nil
+    }
+    return encodeCursor(q.Sort, &ends[0]), nil
+}
+
+/*
+ * GetDbList calls fn with each instance q selects, reading them one at a
+ * time.  With next from NextCursor the page ends at the record it was
+ * taken from, so records added meanwhile are listed rather than pushed
+ * past the cursor.  Passwords are only decrypted when q selects them.
+ */
+func GetDbList(ctx context.Context, q model.ListQuery, next string, fn func(*model.DatabaseSpec) error) error {
+    log := logger.FromContext(ctx)
+
+    err := ValidateListQuery(&q)
+    if err != nil {
+        return err
+    }
+
+    f, err := listFilter(q, next)
+    if err != nil {
+        return err
+    }
+    sel := listSelect(q)
+    _, decrypt := sel["password"]
+    decrypt = decrypt || sel == nil
+
+    fSession := BrokerDB.Session.Copy()
+    defer fSession.Close()
+
+    query := fSession.DB(brokerDbName).C(provisionCollection).Find(f).Sort(listSort(q.Sort)...)
+    if next == "" && q.Limit > 0 {
+        query = query.Limit(q.Limit)
+    }
+    if sel != nil {
+        query = query.Select(sel)
+    }
+
+    var dbSpec model.DatabaseSpec
+    n := 0
+
+    iter := query.Iter()
+    for iter.Next(&dbSpec) {
+        defaultStatus(&dbSpec)
+        if decrypt {
+            dbSpec.Password, err = decryptPassword(dbSpec.Password)
+            if err != nil {
+                iter.Close()
+                return err
+            }
+        }
+
+        err = fn(&dbSpec)
+        if err != nil {
+            iter.Close()
+            return err
+        }
+
+        dbSpec = model.DatabaseSpec{}
+        n++
+    }
+    if err = iter.Close(); err != nil {
+        log.Errorf("listing dbs: %v", err)
+        return err
+    }
+
+    log.Debugf("listed %d dbs", n)
+    return nil
+}
@@ -0,0 +1,246 @@
+package db
+
+/*
+ * Server log lines for a single instance database, taken from the
+ * getLog command and the database profiler and filtered down to the
+ * instance's namespace.
+ */
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const (
+    LogDirServer  = "mongod"
+    LogDirProfile = "profile"
+
+    profileCollection = "system.profile"
+)
+
+var serverLogs = []string{"global", "startupWarnings"}
+
+var ErrUnknownLog = errors.New("Unknown log")
+
+/*
+ * GetLogs merges the global server log and the profiler for dbName,
+ * oldest first, keeping the most recent q.Limit entries.
+ */
+func GetLogs(ctx context.Context, dbName string, q model.LogQuery) (*[]model.LogEntry, error) {
+    entries := []model.LogEntry{}
+
+    lSession, err := logSession(ctx, dbName)
+    if err != nil {
+        return &entries, err
+    }
+    defer lSession.Close()
+
+    entries, err = getServerLog(ctx, lSession, dbName, "global", q)
+    if err != nil {
+        return &entries, err
+    }
+
+    profile, err := getProfile(ctx, lSession, dbName, q)
+    if err != nil {
+        return &entries, err
+    }
+
+    entries = append(entries, profile...)
+    entries = limitLogs(entries, q.Limit)
+    return &entries, nil
+}
+
+/*
+ * GetLog returns a single source, dir is mongod or profile.
+ */
+func GetLog(ctx context.Context, dbName string, dir string, file string, q model.LogQuery) (*[]model.LogEntry, error) {
+    var entries []model.LogEntry
+
+    if !(dir == LogDirServer && isServerLog(file)) && !(dir == LogDirProfile && file == profileCollection) {
+        return &entries, ErrUnknownLog
+    }
+
+    lSession, err := logSession(ctx, dbName)
+    if err != nil {
+        return &entries, err
+    }
+    defer lSession.Close()
+
+    if dir == LogDirServer {
+        entries, err = getServerLog(ctx, lSession, dbName, file, q)
+    } else {
+        entries, err = getProfile(ctx, lSession, dbName, q)
+    }
+
+    entries = limitLogs(entries, q.Limit)
+    return &entries, err
+}
+
+/*
+ * Logs are read from the cluster holding dbName.
+ */
+func logSession(ctx context.Context, dbName string) (*mgo.Session, error) {
+    dbSpec, err := GetDbInfo(ctx, dbName)
+    if err != nil {
+        return nil, err
+    }
+    return instanceSession(dbSpec)
+}
+
+func isServerLog(file string) bool {
+    for _, l := range serverLogs {
+        if l == file {
+            return true
+        }
+    }
+    return false
+}
+
+func limitLogs(entries []model.LogEntry, limit int) []model.LogEntry {
+    sort.SliceStable(entries, func(i, j int) bool {
+        return entries[i].Time.Before(entries[j].Time)
+    })
+    if limit > 0 && len(entries) > limit {
+        entries = entries[len(entries)-limit:]
+    }
+    return entries
+}
+
+func inRange(t time.Time, q model.LogQuery) bool {
+    if !q.From.IsZero() && t.Before(q.From) {
+        return false
+    }
+    if !q.To.IsZero() && t.After(q.To) {
+        return false
+    }
+    return true
+}
+
+func getServerLog(ctx context.Context, s *mgo.Session, dbName string, name string, q model.LogQuery) ([]model.LogEntry, error) {
+    log := logger.FromContext(ctx)
+
+    var result struct {
+        Log []string `bson:"log"`
+    }
+    entries := []model.LogEntry{}
+
+    err := s.DB("admin").Run(bson.D{{Name: "getLog", Value: name}}, &result)
+    if err != nil {
+        log.Errorf("getLog %s: %s", name, err)
+        return entries, err
+    }
+
+    for _, line := range result.Log {
+        if !logLineMatches(line, dbName) {
+            continue
+        }
+        t := parseLogTime(line)
+        if !inRange(t, q) {
+            continue
+        }
+        entries = append(entries, model.LogEntry{
+            Time:    t,
+            Source:  LogDirServer + "/" + name,
+            Message: line,
+        })
+    }
+    return entries, nil
+}
+
+/*
+ * Lines name the database either as a dbname.collection namespace or, in
+ * the structured log format of newer servers, as "$db":"dbname".
+ */
+func logLineMatches(line string, dbName string) bool {
+    return strings.Contains(line, " "+dbName+".") ||
+        strings.Contains(line, "\""+dbName+".") ||
+        strings.Contains(line, "\"$db\":\""+dbName+"\"")
+}
+
+func parseLogTime(line string) time.Time {
+    if strings.HasPrefix(line, "{") {
+        var l struct {
+            T struct {
+                Date string `json:"$date"`
+            } `json:"t"`
+        }
+        if json.Unmarshal([]byte(line), &l) == nil {
+            if t, err := time.Parse(time.RFC3339Nano, l.T.Date); err == nil {
+                return t
+            }
+        }
+        return time.Time{}
+    }
+
+    fields := strings.SplitN(line, " ", 2)
+    if t, err := time.Parse("2006-01-02T15:04:05.000-0700", fields[0]); err == nil {
+        return t
+    }
+    return time.Time{}
+}
+
+func getProfile(ctx context.Context, s *mgo.Session, dbName string, q model.LogQuery) ([]model.LogEntry, error) {
+    log := logger.FromContext(ctx)
+
+    var doc struct {
+        Op          string    `bson:"op"`
+        Ns          string    `bson:"ns"`
+        Millis      int       `bson:"millis"`
+        Ts          time.Time `bson:"ts"`
+        PlanSummary string    `bson:"planSummary"`
+        Command     bson.M    `bson:"command"`
+    }
+    entries := []model.LogEntry{}
+
+    ts := bson.M{}
+    if !q.From.IsZero() {
+        ts["$gte"] = q.From
+    }
+    if !q.To.IsZero() {
+        ts["$lte"] = q.To
+    }
+    filter := bson.M{}
+    if len(ts) > 0 {
+        filter["ts"] = ts
+    }
+
+    query := s.DB(dbName).C(profileCollection).Find(filter).Sort("-ts")
+    if q.Limit > 0 {
+        query = query.Limit(q.Limit)
+    }
+
+    iter := query.Iter()
+    for iter.Next(&doc) {
+        msg := fmt.Sprintf("%s %s %dms", doc.Op, doc.Ns, doc.Millis)
+        if doc.PlanSummary != "" {
+            msg += " " + doc.PlanSummary
+        }
+        if cmd, err := json.Marshal(doc.Command); err == nil && doc.Command != nil {
+            msg += " " + string(cmd)
+        }
+        entries = append(entries, model.LogEntry{
+            Time:    doc.Ts,
+            Source:  LogDirProfile + "/" + profileCollection,
+            Message: msg,
+        })
+        doc.Command = nil
+        doc.PlanSummary = ""
+    }
+
+    err := iter.Close()
+    if err != nil {
+        log.Errorf("reading profile of %s: %s", dbName, err)
+    }
+    return entries, err
+}
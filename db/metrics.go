@@ -0,0 +1,163 @@
+package db
+
+/*
+ * Metrics of the db package.  Provisions and deletes are counted by
+ * result: success, failure for errors on the server, or rejected for
+ * requests refused before anything was changed.  Instance counts, backend
+ * pings and the mgo socket stats are read when the metrics are written.
+ */
+
+import (
+    "sync"
+    "time"
+
+    "mongodb-api/metrics"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const pingTimeout = 5 * time.Second
+
+var (
+    provisionsTotal = metrics.NewCounterVec("mongodb_api_provisions_total",
+        "Provisions by result.", "result")
+    deletesTotal = metrics.NewCounterVec("mongodb_api_deletes_total",
+        "Deletes of instances by result.", "result")
+
+    metricsOnce sync.Once
+)
+
+func countResult(c *metrics.CounterVec, err error) {
+    if err == nil {
+        c.Inc("success")
+    } else if _, ok := err.(*OpError); ok {
+        c.Inc("failure")
+    } else {
+        c.Inc("rejected")
+    }
+}
+
+func metricsInit() {
+    metricsOnce.Do(func() {
+        mgo.SetStats(true)
+
+        metrics.NewGaugeFunc("mongodb_api_instances",
+            "Instances by plan and billing code, not counting deleted ones.",
+            instanceCounts, "plan", "billingcode")
+        metrics.NewGaugeGroup([]metrics.GaugeDesc{
+            {Name: "mongodb_api_backend_up", Help: "Whether the cluster answered a ping."},
+            {Name: "mongodb_api_backend_ping_seconds", Help: "Time taken by a ping of the cluster."},
+        }, func(emits []metrics.Emit) {
+            for name, d := range pingClusters() {
+                if d < 0 {
+                    emits[0](0, name)
+                    continue
+                }
+                emits[0](1, name)
+                emits[1](d.Seconds(), name)
+            }
+        }, "cluster")
+
+        mgoGauge("mongodb_api_mgo_clusters", "Clusters mgo is connected to.",
+            func(s mgo.Stats) int { return s.Clusters })
+        mgoGauge("mongodb_api_mgo_master_conns", "Connections to masters.",
+            func(s mgo.Stats) int { return s.MasterConns })
+        mgoGauge("mongodb_api_mgo_slave_conns", "Connections to slaves.",
+            func(s mgo.Stats) int { return s.SlaveConns })
+        mgoGauge("mongodb_api_mgo_sockets_alive", "Sockets open.",
+            func(s mgo.Stats) int { return s.SocketsAlive })
+        mgoGauge("mongodb_api_mgo_sockets_in_use", "Sockets held by sessions.",
+            func(s mgo.Stats) int { return s.SocketsInUse })
+        mgoGauge("mongodb_api_mgo_socket_refs", "References to sockets.",
+            func(s mgo.Stats) int { return s.SocketRefs })
+
+        mgoCounter("mongodb_api_mgo_sent_ops_total", "Operations sent.",
+            func(s mgo.Stats) int { return s.SentOps })
+        mgoCounter("mongodb_api_mgo_received_ops_total", "Replies received.",
+            func(s mgo.Stats) int { return s.ReceivedOps })
+        mgoCounter("mongodb_api_mgo_received_docs_total", "Documents received.",
+            func(s mgo.Stats) int { return s.ReceivedDocs })
+    })
+}
+
+func mgoGauge(name string, help string, fn func(mgo.Stats) int) {
+    metrics.NewGaugeFunc(name, help, func(emit metrics.Emit) {
+        emit(float64(fn(mgo.GetStats())))
+    })
+}
+
+func mgoCounter(name string, help string, fn func(mgo.Stats) int) {
+    metrics.NewCounterFunc(name, help, func(emit metrics.Emit) {
+        emit(float64(fn(mgo.GetStats())))
+    })
+}
+
+func instanceCounts(emit metrics.Emit) {
+    var counts []struct {
+        Id struct {
+            Plan        string `bson:"plan"`
+            BillingCode string `bson:"billingcode"`
+        } `bson:"_id"`
+        N int `bson:"n"`
+    }
+
+    mSession := BrokerDB.Session.Copy()
+    defer mSession.Close()
+    mSession.SetSocketTimeout(pingTimeout)
+
+    err := mSession.DB(brokerDbName).C(provisionCollection).Pipe([]bson.M{
+        {"$match": bson.M{"status": bson.M{"$ne": model.StatusDeleted}}},
+        {"$group": bson.M{
+            "_id": bson.M{"plan": "$plan", "billingcode": "$billingcode"},
+            "n":   bson.M{"$sum": 1},
+        }},
+    }).All(&counts)
+    if err != nil {
+        log.Errorf("counting instances: %v", err)
+        return
+    }
+
+    for _, c := range counts {
+        emit(float64(c.N), c.Id.Plan, c.Id.BillingCode)
+    }
+}
+
+/*
+ * pingClusters pings every cluster at once and returns how long each took
+ * to answer, or -1 if it did not.
+ */
+func pingClusters() map[string]time.Duration {
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+
+    pings := map[string]time.Duration{}
+
+    for _, name := range clusterNames {
+        wg.Add(1)
+        go func(name string, c *Cluster) {
+            defer wg.Done()
+
+            s := c.Session.Copy()
+            defer s.Close()
+            s.SetSyncTimeout(pingTimeout)
+            s.SetSocketTimeout(pingTimeout)
+
+            start := time.Now()
+            err := s.Ping()
+            d := time.Since(start)
+            if err != nil {
+                log.Warnf("ping of %s: %v", name, err)
+                d = -1
+            }
+
+            mu.Lock()
+            pings[name] = d
+            mu.Unlock()
+        }(name, clusters[name])
+    }
+    wg.Wait()
+
+    return pings
+}
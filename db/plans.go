@@ -0,0 +1,338 @@
+package db
+
+/*
+ * Plans.  The plans collection is the source of truth; the broker keeps a
+ * cache of it that is refreshed after every change made through the API,
+ * when a plan is not found, at most once every planMissInterval, and once
+ * it is older than PLAN_CACHE_TTL, so plans added to the collection
+ * directly are picked up without a restart.
+ */
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "os"
+    "sync"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+var (
+    ErrPlanExists   = errors.New("Plan already exists")
+    ErrPlanInUse    = errors.New("Plan has provisioned databases")
+    ErrPlanNotFound = errors.New("Plan not found")
+)
+
+var defaultPlans = []model.PlanSpec{
+    {
+        Name:        "shared",
+        Size:        "Unlimited",
+        Description: "Shared Server",
+    },
+    {
+        Name:        "ha",
+        Size:        "100gb",
+        Description: "High Availability",
+    },
+}
+
+/*
+ * How often a plan that is not in the cache sends lookupPlan back to the
+ * collection, so requests naming unknown plans cannot reload it each time.
+ */
+const planMissInterval = 5 * time.Second
+
+type planCache struct {
+    sync.RWMutex
+    plans  []model.PlanSpec
+    loaded time.Time
+    missed time.Time
+}
+
+var plans planCache
+
+/*
+ * plansInit loads plans from PLANS_FILE if set, a JSON list of plans that
+ * are created or updated by name, and seeds the default plans into an
+ * empty collection otherwise.
+ */
+func plansInit() error {
+    pSession := BrokerDB.Session.Copy()
+    defer pSession.Close()
+
+    pColl := pSession.DB(brokerDbName).C(plansCollection)
+
+    err := pColl.EnsureIndex(mgo.Index{
+        Key:    []string{"name"},
+        Unique: true,
+    })
+    if err != nil {
+        return err
+    }
+
+    if plansFile := os.Getenv("PLANS_FILE"); plansFile != "" {
+        log.Infof("loading plans from %v", plansFile)
+        err = loadPlansFile(pColl, plansFile)
+        if err != nil {
+            return err
+        }
+    } else if n, err := pColl.Count(); err != nil {
+        return err
+    } else if n < 1 {
+        log.Infof("initialize collection")
+        for i := range defaultPlans {
+            err = pColl.Insert(&defaultPlans[i])
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    _, err = loadPlans()
+    return err
+}
+
+func loadPlansFile(pColl *mgo.Collection, plansFile string) error {
+    var filePlans []model.PlanSpec
+
+    b, err := ioutil.ReadFile(plansFile)
+    if err != nil {
+        return err
+    }
+
+    err = json.Unmarshal(b, &filePlans)
+    if err != nil {
+        return err
+    }
+
+    for i := range filePlans {
+        err = validatePlan(&filePlans[i])
+        if err != nil {
+            return err
+        }
+        _, err = pColl.Upsert(bson.M{"name": filePlans[i].Name}, &filePlans[i])
+        if err != nil {
+            return err
+        }
+        log.Infof("loaded plan %v", filePlans[i].Name)
+    }
+    return nil
+}
+
+func loadPlans() ([]model.PlanSpec, error) {
+    var lPlans []model.PlanSpec
+
+    pSession := BrokerDB.Session.Copy()
+    defer pSession.Close()
+
+    err := pSession.DB(brokerDbName).C(plansCollection).Find(nil).Sort("name").All(&lPlans)
+    if err != nil {
+        log.Errorf("loading plans: %v", err)
+        return lPlans, err
+    }
+
+    plans.Lock()
+    plans.plans = lPlans
+    plans.loaded = time.Now()
+    plans.Unlock()
+
+    return lPlans, nil
+}
+
+func cachedPlan(name string) (*model.PlanSpec, bool, bool) {
+    plans.RLock()
+    defer plans.RUnlock()
+
+    fresh := time.Since(plans.loaded) < planCacheTTL
+    for _, p := range plans.plans {
+        if p.Name == name && !p.Deleting {
+            pSpec := p
+            return &pSpec, true, fresh
+        }
+    }
+    return nil, false, fresh
+}
+
+/*
+ * claimMissReload reports whether a lookup that missed may reload the
+ * cache, which one lookup per planMissInterval may.
+ */
+func (c *planCache) claimMissReload() bool {
+    c.Lock()
+    defer c.Unlock()
+
+    if time.Since(c.missed) < planMissInterval {
+        return false
+    }
+    c.missed = time.Now()
+    return true
+}
+
+/*
+ * lookupPlan finds a plan by name, going back to the collection when the
+ * cache is stale, or when the plan is unknown and no other lookup did so
+ * recently.
+ */
+func lookupPlan(name string) (*model.PlanSpec, bool) {
+    pSpec, ok, fresh := cachedPlan(name)
+    if ok && fresh {
+        return pSpec, true
+    }
+    if fresh && !plans.claimMissReload() {
+        return nil, false
+    }
+
+    if _, err := loadPlans(); err != nil {
+        return pSpec, ok
+    }
+
+    pSpec, ok, _ = cachedPlan(name)
+    return pSpec, ok
+}
+
+/*
+ * planUsable reads name back from the collection.  Callers that have just
+ * recorded a database on the plan use it to tell whether a DeletePlan
+ * that started meanwhile has taken the plan away.
+ */
+func planUsable(s *mgo.Session, name string) (bool, error) {
+    n, err := s.DB(brokerDbName).C(plansCollection).Find(bson.M{
+        "name":     name,
+        "deleting": bson.M{"$ne": true},
+    }).Count()
+    return n > 0, err
+}
+
+func GetPlans(ctx context.Context) (*[]model.PlanSpec, error) {
+    lPlans, err := loadPlans()
+    return &lPlans, err
+}
+
+func validatePlan(pSpec *model.PlanSpec) error {
+    if pSpec.Name == "" {
+        return errors.New("Plan name not set")
+    }
+    _, _, err := parseSize(pSpec.Size)
+    if err != nil {
+        return err
+    }
+    err = validatePasswordPolicy(pSpec)
+    if err != nil {
+        return err
+    }
+    return validateClusters(pSpec.Clusters)
+}
+
+func CreatePlan(ctx context.Context, pSpec model.PlanSpec) (*model.PlanSpec, error) {
+    log := logger.FromContext(ctx)
+
+    err := validatePlan(&pSpec)
+    if err != nil {
+        return &pSpec, err
+    }
+
+    pSession := BrokerDB.Session.Copy()
+    defer pSession.Close()
+
+    err = pSession.DB(brokerDbName).C(plansCollection).Insert(&pSpec)
+    if mgo.IsDup(err) {
+        return &pSpec, ErrPlanExists
+    } else if err != nil {
+        log.Errorf("inserting %s: %s", pSpec.Name, err)
+        return &pSpec, &OpError{Op: "create plan", Name: pSpec.Name, Err: err, RolledBack: true}
+    }
+
+    log.Infof("created plan %v", pSpec.Name)
+    loadPlans()
+    return &pSpec, nil
+}
+
+/*
+ * UpdatePlan replaces the plan called name.  Renaming is not supported,
+ * databases refer to their plan by name.
+ */
+func UpdatePlan(ctx context.Context, name string, pSpec model.PlanSpec) (*model.PlanSpec, error) {
+    log := logger.FromContext(ctx)
+
+    pSpec.Name = name
+    err := validatePlan(&pSpec)
+    if err != nil {
+        return &pSpec, err
+    }
+
+    pSession := BrokerDB.Session.Copy()
+    defer pSession.Close()
+
+    err = pSession.DB(brokerDbName).C(plansCollection).Update(bson.M{"name": name, "deleting": bson.M{"$ne": true}}, &pSpec)
+    if err == mgo.ErrNotFound {
+        return &pSpec, ErrPlanNotFound
+    } else if err != nil {
+        log.Errorf("updating %s: %s", name, err)
+        return &pSpec, &OpError{Op: "update plan", Name: name, Err: err, RolledBack: true}
+    }
+
+    log.Infof("updated plan %v", name)
+    loadPlans()
+    return &pSpec, nil
+}
+
+/*
+ * DeletePlan removes a plan no database is using.  The plan is marked
+ * deleting before the databases on it are counted, and provisions and
+ * plan changes check for the mark after recording the plan, so one of
+ * the two always sees the other.
+ */
+func DeletePlan(ctx context.Context, name string) error {
+    log := logger.FromContext(ctx)
+
+    pSession := BrokerDB.Session.Copy()
+    defer pSession.Close()
+
+    pColl := pSession.DB(brokerDbName).C(plansCollection)
+
+    err := pColl.Update(bson.M{"name": name, "deleting": bson.M{"$ne": true}}, bson.M{
+        "$set": bson.M{"deleting": true},
+    })
+    if err == mgo.ErrNotFound {
+        return ErrPlanNotFound
+    } else if err != nil {
+        log.Errorf("marking %s deleting: %s", name, err)
+        return &OpError{Op: "delete plan", Name: name, Err: err, RolledBack: true}
+    }
+    loadPlans()
+
+    n, err := pSession.DB(brokerDbName).C(provisionCollection).Find(bson.M{
+        "$or": []bson.M{{"plan": name}, {"changingto": name}},
+    }).Count()
+    if err != nil || n > 0 {
+        uErr := pColl.Update(bson.M{"name": name}, bson.M{"$unset": bson.M{"deleting": ""}})
+        if uErr != nil {
+            log.Errorf("unmarking %s deleting: %s", name, uErr)
+        }
+        loadPlans()
+        if err != nil {
+            return &OpError{Op: "delete plan", Name: name, Err: err, RolledBack: uErr == nil}
+        }
+        if uErr != nil {
+            return &OpError{Op: "delete plan", Name: name, Err: ErrPlanInUse, RolledBack: false}
+        }
+        return ErrPlanInUse
+    }
+
+    err = pColl.Remove(bson.M{"name": name})
+    if err != nil {
+        log.Errorf("removing %s: %s", name, err)
+        return &OpError{Op: "delete plan", Name: name, Err: err, RolledBack: true}
+    }
+
+    log.Infof("deleted plan %v", name)
+    loadPlans()
+    return nil
+}
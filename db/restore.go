@@ -0,0 +1,298 @@
+package db
+
+/*
+ * Restores replay a backup archive into an instance database, either the
+ * one it was taken from or a newly provisioned instance.  They run in the
+ * background and report progress in the restores collection.
+ */
+
+import (
+    "context"
+    "errors"
+    "io"
+    "io/ioutil"
+    "strings"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/nu7hatch/gouuid"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+const (
+    restoresCollection string = "restores"
+    restoreBatchSize   int    = 1000
+)
+
+/*
+ * RestoreBackup starts restoring backup id of dbName and returns the
+ * restore record straight away.
+ */
+func RestoreBackup(ctx context.Context, dbName string, id string, in model.RestoreRequest) (*model.RestoreSpec, error) {
+    log := logger.FromContext(ctx)
+
+    var rSpec model.RestoreSpec
+
+    if backupStore == nil {
+        return &rSpec, ErrNoBackupStore
+    }
+
+    bSpec, err := GetBackup(ctx, dbName, id)
+    if err != nil {
+        return &rSpec, err
+    }
+    if bSpec.Status != model.BackupCompleted {
+        return &rSpec, errors.New("Backup is " + bSpec.Status)
+    }
+
+    target, err := restoreTarget(ctx, dbName, in)
+    if err != nil {
+        return &rSpec, err
+    }
+
+    rid, err := uuid.NewV4()
+    if err != nil {
+        return &rSpec, &OpError{Op: "restore", Name: target, Err: err, RolledBack: true}
+    }
+
+    rSpec.Id = rid.String()
+    rSpec.Backup = bSpec.Id
+    rSpec.Source = dbName
+    rSpec.Target = target
+    rSpec.Drop = in.Drop
+    rSpec.Status = model.RestoreRunning
+    rSpec.Collections = len(bSpec.Collections)
+    rSpec.Started = time.Now()
+
+    rSession := BrokerDB.Session.Copy()
+    defer rSession.Close()
+
+    err = rSession.DB(brokerDbName).C(restoresCollection).Insert(&rSpec)
+    if err != nil {
+        log.Errorf("inserting restore for %s: %s", target, err)
+        return &rSpec, &OpError{Op: "restore", Name: target, Err: err, RolledBack: true}
+    }
+
+    log.Infof("restore %s of %s into %s", bSpec.Id, dbName, target)
+
+    bgSpec := rSpec
+    go runRestore(logger.Detach(ctx), bSpec, &bgSpec)
+
+    return &rSpec, nil
+}
+
+/*
+ * The target is the source instance, or a new instance on the requested
+ * plan that defaults to the source's plan and billing code.
+ */
+func restoreTarget(ctx context.Context, dbName string, in model.RestoreRequest) (string, error) {
+    if !in.NewInstance {
+        dbSpec, err := GetDbInfo(ctx, dbName)
+        if err != nil {
+            return "", err
+        }
+        if dbSpec.Status != model.StatusActive {
+            return "", errors.New("Instance is " + dbSpec.Status)
+        }
+        return dbName, nil
+    }
+
+    pSpec := model.ProvisionSpec{
+        Plan:        in.Plan,
+        BillingCode: in.BillingCode,
+        Misc:        "restored from " + dbName,
+    }
+
+    if pSpec.Plan == "" || pSpec.BillingCode == "" {
+        source, err := GetDbInfo(ctx, dbName)
+        if err == nil {
+            if pSpec.Plan == "" {
+                pSpec.Plan = source.Plan
+            }
+            if pSpec.BillingCode == "" {
+                pSpec.BillingCode = source.BillingCode
+            }
+        }
+    }
+
+    dbSpec, err := Provision(ctx, pSpec)
+    if err != nil {
+        return "", err
+    }
+    return dbSpec.Name, nil
+}
+
+func runRestore(ctx context.Context, bSpec *model.BackupSpec, rSpec *model.RestoreSpec) {
+    log := logger.FromContext(ctx)
+
+    rSession := BrokerDB.Session.Copy()
+    defer rSession.Close()
+
+    c := rSession.DB(brokerDbName).C(restoresCollection)
+
+    var iSession *mgo.Session
+    target, err := GetDbInfo(ctx, rSpec.Target)
+    if err == nil {
+        iSession, err = instanceSession(target)
+    }
+    if err == nil {
+        err = replayBackup(ctx, iSession.DB(rSpec.Target), bSpec, rSpec, func() {
+            c.Update(bson.M{"id": rSpec.Id}, rSpec)
+        })
+        iSession.Close()
+    }
+
+    finished := time.Now()
+    rSpec.Finished = &finished
+    rSpec.Message = ""
+    if err != nil {
+        log.Errorf("restoring %s into %s: %s", bSpec.Id, rSpec.Target, err)
+        rSpec.Status = model.RestoreFailed
+        rSpec.Error = err.Error()
+    } else {
+        log.Infof("restored %s into %s: %d documents", bSpec.Id, rSpec.Target, rSpec.Documents)
+        rSpec.Status = model.RestoreCompleted
+    }
+
+    err = c.Update(bson.M{"id": rSpec.Id}, rSpec)
+    if err != nil {
+        log.Errorf("updating restore %s: %s", rSpec.Id, err)
+    }
+}
+
+func replayBackup(ctx context.Context, d *mgo.Database, bSpec *model.BackupSpec, rSpec *model.RestoreSpec, progress func()) error {
+    archive, err := OpenBackup(ctx, bSpec)
+    if err != nil {
+        return err
+    }
+    defer archive.Close()
+
+    return replayArchive(d, archive, rSpec, progress)
+}
+
+/*
+ * replayArchive loads an archive into d.  Indexes are built after each
+ * collection's documents are in.  Without drop, documents replace any
+ * existing document with the same _id.
+ */
+func replayArchive(d *mgo.Database, archive io.Reader, rSpec *model.RestoreSpec, progress func()) error {
+    var meta archiveMeta
+
+    return readArchive(archive, func(name string, r io.Reader) error {
+        if strings.HasSuffix(name, archiveMetaSuffix) {
+            meta = archiveMeta{}
+            b, err := ioutil.ReadAll(r)
+            if err != nil {
+                return err
+            }
+            err = bson.Unmarshal(b, &meta)
+            if err != nil {
+                return err
+            }
+
+            if rSpec.Drop {
+                err = d.C(meta.Collection).DropCollection()
+                if err != nil && !strings.Contains(err.Error(), "ns not found") {
+                    return err
+                }
+            }
+            return nil
+        }
+
+        coll := strings.TrimSuffix(name, archiveDataSuffix)
+        if coll != meta.Collection {
+            return errors.New("archive entry " + name + " has no metadata")
+        }
+
+        rSpec.Message = "restoring " + coll
+        progress()
+
+        n, err := restoreCollection(d.C(coll), r, !rSpec.Drop)
+        rSpec.Documents += n
+        if err != nil {
+            return err
+        }
+
+        for _, idx := range meta.Indexes {
+            if idx.Name == "_id_" {
+                continue
+            }
+            err = d.C(coll).EnsureIndex(idx)
+            if err != nil {
+                return err
+            }
+        }
+
+        rSpec.CollectionsDone++
+        progress()
+        return nil
+    })
+}
+
+func restoreCollection(c *mgo.Collection, r io.Reader, replace bool) (int, error) {
+    var n int
+
+    bulk := c.Bulk()
+    bulk.Unordered()
+    pending := 0
+
+    flush := func() error {
+        if pending == 0 {
+            return nil
+        }
+        _, err := bulk.Run()
+        bulk = c.Bulk()
+        bulk.Unordered()
+        n += pending
+        pending = 0
+        return err
+    }
+
+    err := readDocuments(r, func(doc bson.Raw) error {
+        if replace {
+            var id struct {
+                Id interface{} `bson:"_id"`
+            }
+            err := doc.Unmarshal(&id)
+            if err != nil {
+                return err
+            }
+            bulk.Upsert(bson.M{"_id": id.Id}, doc)
+        } else {
+            bulk.Insert(doc)
+        }
+
+        pending++
+        if pending >= restoreBatchSize {
+            return flush()
+        }
+        return nil
+    })
+    if err != nil {
+        return n, err
+    }
+    return n, flush()
+}
+
+func GetRestore(ctx context.Context, dbName string, id string) (*model.RestoreSpec, error) {
+    log := logger.FromContext(ctx)
+
+    var rSpec model.RestoreSpec
+
+    rSession := BrokerDB.Session.Copy()
+    defer rSession.Close()
+
+    c := rSession.DB(brokerDbName).C(restoresCollection)
+
+    err := c.Find(bson.M{
+        "id":  id,
+        "$or": []bson.M{{"source": dbName}, {"target": dbName}},
+    }).One(&rSpec)
+    if err != nil {
+        log.Errorf("finding %s for %s: %s", id, dbName, err)
+    }
+    return &rSpec, err
+}
@@ -0,0 +1,126 @@
+package db
+
+/*
+ * Compensating actions for provisioning and deprovisioning.  Each operation
+ * either completes or undoes what it already did on the server, and the
+ * reason is kept on the instance record and returned to the caller.
+ */
+
+import (
+    "context"
+    "fmt"
+    "time"
+
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+/*
+ * Server steps an operation can fail part way through, kept as variables
+ * so the tests can make them fail.
+ */
+var (
+    upsertUser   = (*mgo.Database).UpsertUser
+    dropDatabase = (*mgo.Database).DropDatabase
+)
+
+/*
+ * OpError is returned when an operation fails after it started changing
+ * the server, as opposed to a request that was rejected up front.
+ */
+type OpError struct {
+    Op         string
+    Name       string
+    Err        error
+    RolledBack bool
+}
+
+func (e *OpError) Error() string {
+    state := "rolled back"
+    if !e.RolledBack {
+        state = "rollback incomplete"
+    }
+    return fmt.Sprintf("%s of %s failed: %s (%s)", e.Op, e.Name, e.Err, state)
+}
+
+/*
+ * Undo a provision whose user could not be created.  The record is removed
+ * unless the caller wants to keep it as failed, or the rollback itself
+ * failed and the record is needed to find what was left behind.
+ */
+func rollbackProvision(ctx context.Context, s *mgo.Session, pSpec *model.DatabaseSpec, cause error, keepFailed bool) error {
+    ilog := instanceLog(ctx, pSpec)
+
+    opErr := &OpError{Op: "provision", Name: pSpec.Name, Err: cause, RolledBack: true}
+
+    ilog.Infof("rolling back %s: %s", pSpec.Name, cause)
+
+    err := s.DB(pSpec.Name).RemoveUser(pSpec.Username)
+    if err != nil && err != mgo.ErrNotFound {
+        ilog.Errorf("removing user %s: %s", pSpec.Username, err)
+        opErr.RolledBack = false
+    }
+
+    err = s.DB(pSpec.Name).DropDatabase()
+    if err != nil {
+        ilog.Errorf("dropping %s: %s", pSpec.Name, err)
+        opErr.RolledBack = false
+    }
+
+    return failProvision(ctx, pSpec, opErr, keepFailed)
+}
+
+/*
+ * Mark a provision failed once nothing is left to undo on the server.
+ * Without a session on the instance's cluster nothing was made there, and
+ * there is nothing to undo.
+ */
+func failProvision(ctx context.Context, pSpec *model.DatabaseSpec, opErr *OpError, keepFailed bool) error {
+    pSpec.Status = model.StatusFailed
+    pSpec.Message = ""
+    pSpec.LastError = opErr.Error()
+    pSpec.Updated = time.Now()
+
+    if keepFailed || !opErr.RolledBack {
+        setStatus(ctx, pSpec.Name, pSpec.Status, pSpec.Message, pSpec.LastError)
+        return opErr
+    }
+
+    bSession := BrokerDB.Session.Copy()
+    defer bSession.Close()
+
+    err := bSession.DB(brokerDbName).C(provisionCollection).Remove(bson.M{"name": pSpec.Name})
+    if err != nil {
+        instanceLog(ctx, pSpec).Errorf("removing record %s: %s", pSpec.Name, err)
+        setStatus(ctx, pSpec.Name, pSpec.Status, pSpec.Message, pSpec.LastError)
+    }
+    return opErr
+}
+
+/*
+ * Undo a deprovision whose database could not be dropped by giving the
+ * users back the roles they had.  The users of a deleted instance had
+ * none to give back.
+ */
+func rollbackDeprovision(ctx context.Context, s *mgo.Session, dbSpec *model.DatabaseSpec, prevStatus string, cause error) error {
+    ilog := instanceLog(ctx, dbSpec)
+
+    opErr := &OpError{Op: "deprovision", Name: dbSpec.Name, Err: cause, RolledBack: true}
+
+    if prevStatus != model.StatusDeleted {
+        ilog.Infof("restoring users for %s: %s", dbSpec.Name, cause)
+
+        err := setUserRoles(ctx, s, dbSpec, nil)
+        if err != nil {
+            ilog.Errorf("restoring users of %s: %s", dbSpec.Name, err)
+            opErr.RolledBack = false
+            setStatus(ctx, dbSpec.Name, model.StatusFailed, "", opErr.Error())
+            return opErr
+        }
+    }
+
+    setStatus(ctx, dbSpec.Name, prevStatus, "", opErr.Error())
+    return opErr
+}
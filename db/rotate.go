@@ -0,0 +1,174 @@
+package db
+
+/*
+ * Credential rotation.  A rotation creates a new user on the instance
+ * database and keeps the previous one valid for a grace period so apps
+ * can pick up the new url before the old user is removed.
+ */
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+var ErrConcurrentRotation = errors.New("Credentials were rotated by another request, try again")
+
+/*
+ * RotateCredentials replaces the instance user.  A grace of zero uses the
+ * configured ROTATE_GRACE_PERIOD.
+ */
+func RotateCredentials(ctx context.Context, dbName string, grace time.Duration) (*model.DatabaseSpec, error) {
+    log := logger.FromContext(ctx)
+
+    dbSpec, err := GetDbInfo(ctx, dbName)
+    if err != nil {
+        log.Errorf("unable to find: %v", dbName)
+        return dbSpec, err
+    }
+    ilog := instanceLog(ctx, dbSpec)
+
+    if dbSpec.Status != model.StatusActive {
+        return dbSpec, errors.New("Instance is " + dbSpec.Status)
+    }
+
+    if grace <= 0 {
+        grace = rotateGrace
+    }
+
+    rSession := BrokerDB.Session.Copy()
+    defer rSession.Close()
+
+    iSession, err := instanceSession(dbSpec)
+    if err != nil {
+        return dbSpec, &OpError{Op: "rotate", Name: dbName, Err: err, RolledBack: true}
+    }
+    defer iSession.Close()
+
+    /*
+     * The retired password is kept so the user can be copied if the
+     * instance moves cluster during the grace period.
+     */
+    retired := model.RetiredUser{
+        Username: dbSpec.Username,
+        Expires:  time.Now().Add(grace),
+    }
+    retired.Password, err = encryptPassword(dbSpec.Password)
+    if err != nil {
+        return dbSpec, &OpError{Op: "rotate", Name: dbName, Err: err, RolledBack: true}
+    }
+
+    plan, _ := lookupPlan(dbSpec.Plan)
+
+    newSpec := *dbSpec
+    newSpec.Username, newSpec.Password, err = newCredentials(ctx, iSession, plan)
+    if err != nil {
+        return dbSpec, &OpError{Op: "rotate", Name: dbName, Err: err, RolledBack: true}
+    }
+
+    ilog.Infof("add user %s to %s", newSpec.Username, dbName)
+    err = iSession.DB(dbName).UpsertUser(instanceUser(&newSpec))
+    if err != nil {
+        ilog.Errorf("adding user %s: %s", newSpec.Username, err)
+        return dbSpec, &OpError{Op: "rotate", Name: dbName, Err: err, RolledBack: true}
+    }
+
+    newSpec.RetiredUsers = append(newSpec.RetiredUsers, retired)
+    newSpec.Updated = time.Now()
+
+    password, err := encryptPassword(newSpec.Password)
+    if err == nil {
+        err = rSession.DB(brokerDbName).C(provisionCollection).Update(bson.M{"name": dbName, "username": dbSpec.Username}, bson.M{
+            "$set": bson.M{
+                "username": newSpec.Username,
+                "password": password,
+                "updated":  newSpec.Updated,
+            },
+            "$push": bson.M{
+                "retiredusers": retired,
+            },
+        })
+    }
+
+    /*
+     * Another rotation got there first, the user made for this one would
+     * be known to nothing and is removed.
+     */
+    if err != nil {
+        ilog.Errorf("updating %s: %s", dbName, err)
+        rErr := iSession.DB(dbName).RemoveUser(newSpec.Username)
+        if rErr != nil && rErr != mgo.ErrNotFound {
+            ilog.Errorf("removing user %s: %s", newSpec.Username, rErr)
+            return dbSpec, &OpError{Op: "rotate", Name: dbName, Err: err, RolledBack: false}
+        }
+        if err == mgo.ErrNotFound {
+            return dbSpec, ErrConcurrentRotation
+        }
+        return dbSpec, &OpError{Op: "rotate", Name: dbName, Err: err, RolledBack: true}
+    }
+
+    ilog.Infof("%s rotated, %s expires %s", dbName, retired.Username, retired.Expires)
+    return &newSpec, nil
+}
+
+func StartCredentialReaper() {
+    runEvery("credential reaper", reapInterval, reapRetiredUsers)
+}
+
+/*
+ * Remove retired users whose grace period has ended.
+ */
+func reapRetiredUsers(ctx context.Context) {
+    log := logger.FromContext(ctx)
+
+    var dbSpec model.DatabaseSpec
+
+    now := time.Now()
+
+    rSession := BrokerDB.Session.Copy()
+    defer rSession.Close()
+
+    c := rSession.DB(brokerDbName).C(provisionCollection)
+
+    iter := c.Find(bson.M{"retiredusers.expires": bson.M{"$lte": now}}).Iter()
+    for iter.Next(&dbSpec) {
+        iSession, err := instanceSession(&dbSpec)
+        if err != nil {
+            log.Errorf("%s: %s", dbSpec.Name, err)
+            dbSpec = model.DatabaseSpec{}
+            continue
+        }
+
+        for _, ru := range dbSpec.RetiredUsers {
+            if ru.Expires.After(now) {
+                continue
+            }
+
+            log.Infof("remove user %s from %s", ru.Username, dbSpec.Name)
+            err := iSession.DB(dbSpec.Name).RemoveUser(ru.Username)
+            if err != nil && err != mgo.ErrNotFound {
+                log.Errorf("removing user %s: %s", ru.Username, err)
+                continue
+            }
+
+            err = c.Update(bson.M{"name": dbSpec.Name}, bson.M{
+                "$pull": bson.M{"retiredusers": bson.M{"username": ru.Username}},
+            })
+            if err != nil {
+                log.Errorf("updating %s: %s", dbSpec.Name, err)
+            }
+        }
+        iSession.Close()
+        dbSpec = model.DatabaseSpec{}
+    }
+
+    if err := iter.Close(); err != nil {
+        log.Errorf("%v", err)
+    }
+}
@@ -0,0 +1,75 @@
+package db
+
+/*
+ * Lifecycle state of provisioned databases.  Every record in the
+ * provision collection moves through provisioning -> active ->
+ * deprovisioning, or ends up failed with the last error recorded.
+ */
+
+import (
+    "context"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2/bson"
+)
+
+/*
+ * Records created before status tracking have no status, they were
+ * only ever written once provisioning had finished.
+ */
+func defaultStatus(dbSpec *model.DatabaseSpec) {
+    if dbSpec.Status == "" {
+        dbSpec.Status = model.StatusActive
+    }
+}
+
+/*
+ * setStatus also records the request making the change, so the request
+ * behind a failure can be found in the logs.
+ */
+func setStatus(ctx context.Context, dbName string, status string, message string, lastError string) error {
+    log := logger.FromContext(ctx)
+
+    sSession := BrokerDB.Session.Copy()
+    defer sSession.Close()
+
+    c := sSession.DB(brokerDbName).C(provisionCollection)
+
+    err := c.Update(bson.M{"name": dbName}, bson.M{
+        "$set": bson.M{
+            "status":        status,
+            "message":       message,
+            "lasterror":     lastError,
+            "updated":       time.Now(),
+            "lastrequestid": logger.RequestId(ctx),
+        },
+    })
+
+    if err != nil {
+        log.Errorf("setting %s to %s: %s", dbName, status, err)
+    } else {
+        log.Infof("%s: %s", dbName, status)
+    }
+    return err
+}
+
+func GetDbStatus(ctx context.Context, dbName string) (*model.StatusSpec, error) {
+    var sSpec model.StatusSpec
+
+    dbSpec, err := GetDbInfo(ctx, dbName)
+    if err != nil {
+        return &sSpec, err
+    }
+
+    sSpec.Name = dbSpec.Name
+    sSpec.Status = dbSpec.Status
+    sSpec.Message = dbSpec.Message
+    sSpec.LastError = dbSpec.LastError
+    sSpec.Updated = dbSpec.Updated
+    sSpec.LastRequestId = dbSpec.LastRequestId
+
+    return &sSpec, nil
+}
@@ -0,0 +1,200 @@
+package db
+
+/*
+ * Storage used by instance databases and the plan limits it is measured
+ * against.
+ */
+
+import (
+    "context"
+    "errors"
+    "strconv"
+    "strings"
+    "time"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+)
+
+type dbStats struct {
+    Collections int   `bson:"collections"`
+    Objects     int64 `bson:"objects"`
+    DataSize    int64 `bson:"dataSize"`
+    StorageSize int64 `bson:"storageSize"`
+    IndexSize   int64 `bson:"indexSize"`
+}
+
+func getDbStats(d *mgo.Database) (*dbStats, error) {
+    var stats dbStats
+
+    err := d.Run(bson.D{{Name: "dbStats", Value: 1}}, &stats)
+    return &stats, err
+}
+
+var sizeUnits = []struct {
+    suffix string
+    bytes  int64
+}{
+    {"tb", 1 << 40},
+    {"gb", 1 << 30},
+    {"mb", 1 << 20},
+    {"kb", 1 << 10},
+    {"b", 1},
+}
+
+/*
+ * parseSize reads a plan size such as "100gb".  Unlimited plans, and
+ * plans with no size, return ok false.
+ */
+func parseSize(size string) (int64, bool, error) {
+    s := strings.ToLower(strings.TrimSpace(size))
+    if s == "" || s == "unlimited" {
+        return 0, false, nil
+    }
+
+    for _, u := range sizeUnits {
+        if strings.HasSuffix(s, u.suffix) {
+            n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), 64)
+            if err != nil || n < 0 {
+                break
+            }
+            return int64(n * float64(u.bytes)), true, nil
+        }
+    }
+    return 0, false, errors.New("Invalid plan size " + size)
+}
+
+/*
+ * Users of a database that is over its plan size and has QUOTA_ENFORCE
+ * set can still read their data, but not write until usage drops.
+ */
+var overQuotaRoles = []mgo.Role{
+    mgo.RoleRead,
+}
+
+func StartUsageMonitor() {
+    if usageCheck <= 0 {
+        log.Warnf("USAGE_CHECK_INTERVAL is %s, no usage is recorded and billing reports will be empty", usageCheck)
+    }
+    runEvery("usage monitor", usageCheck, checkUsage)
+}
+
+/*
+ * checkUsage measures every active database against its plan size.  The
+ * databases it could not measure are missing from the billing report for
+ * the time, so they are counted and warned about.
+ */
+func checkUsage(ctx context.Context) {
+    log := logger.FromContext(ctx)
+
+    var dbSpec model.DatabaseSpec
+    var checked, unrecorded int
+
+    uSession := BrokerDB.Session.Copy()
+    defer uSession.Close()
+
+    c := uSession.DB(brokerDbName).C(provisionCollection)
+
+    active := bson.M{"$in": []interface{}{model.StatusActive, "", nil}}
+    iter := c.Find(bson.M{"status": active}).Iter()
+    for iter.Next(&dbSpec) {
+        recorded, err := checkDbUsage(ctx, uSession, &dbSpec)
+        if err != nil {
+            log.Errorf("checking %s: %s", dbSpec.Name, err)
+        }
+        checked++
+        if !recorded {
+            unrecorded++
+        }
+        dbSpec = model.DatabaseSpec{}
+    }
+
+    if err := iter.Close(); err != nil {
+        log.Errorf("%v", err)
+        log.Warnf("usage check stopped after %d databases, the rest have no usage recorded", checked)
+    }
+    if unrecorded > 0 {
+        log.Warnf("no usage recorded for %d of %d databases", unrecorded, checked)
+    }
+}
+
+/*
+ * checkDbUsage measures dbSpec on its cluster and records the result
+ * through s, a session on the broker database.  The snapshot is recorded
+ * before the quota is enforced so billing does not depend on it, and
+ * recorded is false if it could not be.
+ */
+func checkDbUsage(ctx context.Context, s *mgo.Session, dbSpec *model.DatabaseSpec) (bool, error) {
+    ilog := instanceLog(ctx, dbSpec)
+
+    iSession, err := instanceSession(dbSpec)
+    if err != nil {
+        return false, err
+    }
+    defer iSession.Close()
+
+    stats, err := getDbStats(iSession.DB(dbSpec.Name))
+    if err != nil {
+        return false, err
+    }
+
+    now := time.Now()
+    if err = recordUsage(s, dbSpec, stats.DataSize, now); err != nil {
+        return false, err
+    }
+
+    over := false
+    if plan, ok := lookupPlan(dbSpec.Plan); ok {
+        limit, limited, err := parseSize(plan.Size)
+        if err != nil {
+            return true, err
+        }
+        over = limited && stats.DataSize > limit
+    }
+
+    revoke := over && quotaEnforce
+    if revoke != dbSpec.WriteRevoked {
+        err = setWriteRevoked(ctx, iSession, dbSpec, revoke)
+        if err != nil {
+            return true, err
+        }
+    }
+
+    if over != dbSpec.OverQuota {
+        ilog.Infof("%s over quota: %t (%d bytes)", dbSpec.Name, over, stats.DataSize)
+    }
+
+    err = s.DB(brokerDbName).C(provisionCollection).Update(bson.M{"name": dbSpec.Name}, bson.M{
+        "$set": bson.M{
+            "usage":        stats.DataSize,
+            "usagechecked": now,
+            "overquota":    over,
+            "writerevoked": revoke,
+        },
+    })
+    return true, err
+}
+
+/*
+ * Switch every user of the instance, rotated users still in their grace
+ * period and additional credentials included, between its normal roles
+ * and read only.
+ */
+func setWriteRevoked(ctx context.Context, s *mgo.Session, dbSpec *model.DatabaseSpec, revoke bool) error {
+    ilog := instanceLog(ctx, dbSpec)
+
+    rSpec := *dbSpec
+    rSpec.WriteRevoked = revoke
+
+    err := setUserRoles(ctx, s, &rSpec, nil)
+    if err != nil {
+        return err
+    }
+
+    ilog.Infof("%s write revoked: %t", dbSpec.Name, revoke)
+    dbSpec.WriteRevoked = revoke
+    return nil
+}
@@ -4,21 +4,334 @@ package logger
  * Project: oct-mongodb-api
  * Package: logger
  * 
+ * Levelled logging with fields.  Lines are written as text for
+ * development or as one JSON object per line for production, and always
+ * pass through Redact.  The function logging a line is recorded with it,
+ * in place of the (pkg.func) prefixes messages used to carry.
+ *
  * Author:  ned.hanks
  *
  */
 
 import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
     "log"
     "os"
+    "runtime"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+type Level int32
+
+const (
+    LevelDebug Level = iota
+    LevelInfo
+    LevelWarn
+    LevelError
 )
 
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+    if l < LevelDebug || l > LevelError {
+        return fmt.Sprintf("level(%d)", int32(l))
+    }
+    return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+    for i, name := range levelNames {
+        if strings.EqualFold(s, name) {
+            return Level(i), nil
+        }
+    }
+    return LevelInfo, errors.New("Unknown log level " + s)
+}
+
+type Fields map[string]interface{}
+
+/*
+ * output is shared by a Logger and every Logger derived from it with
+ * With, so the level and format apply to all of them.
+ */
+type output struct {
+    mu     sync.Mutex
+    w      io.Writer
+    json   bool
+    prefix string
+    level  int32
+}
+
 type Logger struct {
-    log.Logger
+    out    *output
+    fields Fields
+}
+
+var Log = New(os.Stdout, "[mongodb-api] ")
+
+func New(w io.Writer, prefix string) *Logger {
+    return &Logger{
+        out: &output{
+            w:      w,
+            prefix: prefix,
+            level:  int32(LevelInfo),
+        },
+    }
+}
+
+/*
+ * With returns a logger adding f to every line.
+ */
+func (l *Logger) With(f Fields) *Logger {
+    fields := Fields{}
+    for k, v := range l.fields {
+        fields[k] = v
+    }
+    for k, v := range f {
+        fields[k] = v
+    }
+    return &Logger{out: l.out, fields: fields}
+}
+
+func (l *Logger) SetOutput(w io.Writer) {
+    l.out.mu.Lock()
+    defer l.out.mu.Unlock()
+    l.out.w = w
+}
+
+func (l *Logger) SetPrefix(prefix string) {
+    l.out.mu.Lock()
+    defer l.out.mu.Unlock()
+    l.out.prefix = prefix
+}
+
+func (l *Logger) SetJSON(on bool) {
+    l.out.mu.Lock()
+    defer l.out.mu.Unlock()
+    l.out.json = on
+}
+
+func (l *Logger) SetLevel(level Level) {
+    atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+func (l *Logger) Level() Level {
+    return Level(atomic.LoadInt32(&l.out.level))
+}
+
+func (l *Logger) Enabled(level Level) bool {
+    return level >= l.Level()
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+    l.log(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+    l.log(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+    l.log(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+    l.log(LevelError, fmt.Sprintf(format, args...))
+}
+
+/*
+ * Fatalf logs at error level and exits.
+ */
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+    l.log(LevelError, fmt.Sprintf(format, args...))
+    os.Exit(1)
+}
+
+/*
+ * StdLogger returns a standard library logger writing through l at
+ * level, for libraries that want a *log.Logger.
+ */
+func (l *Logger) StdLogger(level Level) *log.Logger {
+    return log.New(&levelWriter{l: l, level: level}, "", 0)
+}
+
+type levelWriter struct {
+    l     *Logger
+    level Level
 }
 
-var (
-    DevFlags = log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile
-    ProdFlags = log.Ldate|log.Ltime|log.Lshortfile
-    Log = log.New(os.Stdout, "[mongodb-api] ", DevFlags)
+func (w *levelWriter) Write(p []byte) (int, error) {
+    w.l.write(w.level, "", string(p), nil)
+    return len(p), nil
+}
+
+func (l *Logger) log(level Level, msg string) {
+    if !l.Enabled(level) {
+        return
+    }
+    l.write(level, caller(3), msg, nil)
+}
+
+/*
+ * Event writes a line with extra fields, for lines that are mostly
+ * fields such as the access log.
+ */
+func (l *Logger) Event(level Level, msg string, f Fields) {
+    if !l.Enabled(level) {
+        return
+    }
+    l.write(level, caller(2), msg, f)
+}
+
+func (l *Logger) write(level Level, fn string, msg string, extra Fields) {
+    now := time.Now()
+    msg = strings.TrimRight(msg, "\n")
+
+    fields := Fields{}
+    for k, v := range l.fields {
+        fields[k] = v
+    }
+    for k, v := range extra {
+        fields[k] = v
+    }
+
+    l.out.mu.Lock()
+    defer l.out.mu.Unlock()
+
+    var line string
+    if l.out.json {
+        fields["time"] = now.Format(time.RFC3339Nano)
+        fields["level"] = level.String()
+        fields["msg"] = msg
+        if fn != "" {
+            fields["func"] = fn
+        }
+        b, err := json.Marshal(fields)
+        if err != nil {
+            b, _ = json.Marshal(Fields{"time": fields["time"], "level": "error", "msg": "unable to log: " + err.Error()})
+        }
+        line = string(b) + "\n"
+    } else {
+        line = l.out.prefix + now.Format("2006/01/02 15:04:05.000000") + " " + strings.ToUpper(level.String())
+        if fn != "" {
+            line += " (" + fn + ")"
+        }
+        line += " " + msg + formatFields(fields) + "\n"
+    }
+
+    io.WriteString(l.out.w, Redact(line))
+}
+
+func formatFields(fields Fields) string {
+    keys := make([]string, 0, len(fields))
+    for k := range fields {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    s := ""
+    for _, k := range keys {
+        s += fmt.Sprintf(" %s=%v", k, fields[k])
+    }
+    return s
+}
+
+/*
+ * caller names the function skip frames up, as pkg.Func.
+ */
+func caller(skip int) string {
+    pc, _, _, ok := runtime.Caller(skip)
+    if !ok {
+        return ""
+    }
+    f := runtime.FuncForPC(pc)
+    if f == nil {
+        return ""
+    }
+    name := f.Name()
+    if i := strings.LastIndex(name, "/"); i >= 0 {
+        name = name[i+1:]
+    }
+    return name
+}
+
+type contextKey int
+
+const (
+    loggerKey contextKey = iota
+    requestIdKey
 )
+
+/*
+ * NewContext returns a copy of ctx carrying l, for FromContext.
+ */
+func NewContext(ctx context.Context, l *Logger) context.Context {
+    return context.WithValue(ctx, loggerKey, l)
+}
+
+/*
+ * FromContext returns the logger carried by ctx, or Log.
+ */
+func FromContext(ctx context.Context) *Logger {
+    if ctx != nil {
+        if l, ok := ctx.Value(loggerKey).(*Logger); ok {
+            return l
+        }
+    }
+    return Log
+}
+
+/*
+ * WithRequestId returns a copy of ctx carrying id and a logger adding it
+ * to every line as request_id.
+ */
+func WithRequestId(ctx context.Context, id string) context.Context {
+    ctx = context.WithValue(ctx, requestIdKey, id)
+    return NewContext(ctx, FromContext(ctx).With(Fields{"request_id": id}))
+}
+
+func RequestId(ctx context.Context) string {
+    if ctx == nil {
+        return ""
+    }
+    id, _ := ctx.Value(requestIdKey).(string)
+    return id
+}
+
+/*
+ * Detach returns a context carrying the logger and request id of ctx but
+ * none of its deadline, for work that outlives the request.
+ */
+func Detach(ctx context.Context) context.Context {
+    d := context.Background()
+    if id := RequestId(ctx); id != "" {
+        d = context.WithValue(d, requestIdKey, id)
+    }
+    return NewContext(d, FromContext(ctx))
+}
+
+/*
+ * SetOutput sends Log to w.
+ */
+func SetOutput(w io.Writer) {
+    Log.SetOutput(w)
+}
+
+/*
+ * SetLevel and GetLevel change the level of Log while running.
+ */
+func SetLevel(level Level) {
+    Log.SetLevel(level)
+}
+
+func GetLevel() Level {
+    return Log.Level()
+}
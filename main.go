@@ -4,6 +4,7 @@ package main
  * TODO: Add app documentation
  */
 import (
+    "flag"
     "os"
     "net/http"
 
@@ -15,6 +16,7 @@ import (
 var (
     apiPort string
     mongoDbApiRuntime string = "development"
+    encryptPasswords = flag.Bool("encrypt-passwords", false, "encrypt the passwords stored in plaintext and exit")
 )
 
 var log = logger.Log
@@ -28,24 +30,53 @@ func setEnv() {
     if mongoDbApiRuntime == "" {
         mongoDbApiRuntime = "development"
     }
-    if mongoDbApiRuntime == "production" {
-        log.SetFlags(logger.ProdFlags)
+
+    logFormat := os.Getenv("LOG_FORMAT")
+    if logFormat == "" && mongoDbApiRuntime == "production" {
+        logFormat = "json"
+    }
+    log.SetJSON(logFormat == "json")
+
+    if lvl := os.Getenv("LOG_LEVEL"); lvl != "" {
+        level, err := logger.ParseLevel(lvl)
+        if err != nil {
+            log.Warnf("%v, using %s", err, logger.GetLevel())
+        } else {
+            logger.SetLevel(level)
+        }
     }
 }
 
 func main() {
 
-    log.Println("(main) setup env")
+    flag.Parse()
+
+    log.Infof("setup env")
     setEnv()
 
-    log.Println("(main) init db")
+    log.Infof("init db")
     db.Init()
     defer db.Session.Close()
 
-    log.Println("(main) init server routing")
+    if *encryptPasswords {
+        n, err := db.EncryptPasswords()
+        if err != nil {
+            log.Fatalf("encrypting passwords: %v", err)
+        }
+        log.Infof("encrypted %d passwords", n)
+        return
+    }
+
+    log.Infof("start background jobs")
+    db.StartCredentialReaper()
+    db.StartUsageMonitor()
+    db.StartPurger()
+    db.StartDriftCheck()
+
+    log.Infof("init server routing")
     api := server.Server(mongoDbApiRuntime)
     handler := api.MakeHandler()
 
-    log.Printf("(main) Starting on port %s\n", apiPort)
-    log.Println(http.ListenAndServe(":"+apiPort, handler))
+    log.Infof("Starting on port %s", apiPort)
+    log.Fatalf("%v", http.ListenAndServe(":"+apiPort, handler))
 }
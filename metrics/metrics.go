@@ -0,0 +1,406 @@
+package metrics
+
+/*
+ * Project: oct-mongodb-api
+ * Package: metrics
+ *
+ * Counters, histograms and gauges written out in the Prometheus text
+ * format.  Counters and histograms are updated as things happen; gauges,
+ * and counters kept elsewhere, are read by a function each time the
+ * metrics are written.
+ *
+ */
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+/*
+ * DefBuckets suit request latencies, in seconds.
+ */
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+    name() string
+    write(w *bufio.Writer)
+}
+
+var (
+    mu      sync.Mutex
+    metrics = map[string]metric{}
+)
+
+func register(m metric, names ...string) {
+    mu.Lock()
+    defer mu.Unlock()
+
+    if len(names) == 0 {
+        names = []string{m.name()}
+    }
+    for _, n := range names {
+        if _, ok := metrics[n]; ok {
+            panic("metric " + n + " registered twice")
+        }
+    }
+    for _, n := range names {
+        metrics[n] = m
+    }
+}
+
+/*
+ * Unregister forgets the metric name, mainly for tests.
+ */
+func Unregister(name string) {
+    mu.Lock()
+    defer mu.Unlock()
+
+    delete(metrics, name)
+}
+
+/*
+ * WriteText writes every metric, sorted by name, a group of gauges by the
+ * name of its first.
+ */
+func WriteText(w io.Writer) error {
+    mu.Lock()
+    ms := make([]metric, 0, len(metrics))
+    seen := map[metric]bool{}
+    for _, m := range metrics {
+        if !seen[m] {
+            seen[m] = true
+            ms = append(ms, m)
+        }
+    }
+    mu.Unlock()
+
+    sort.Slice(ms, func(i, j int) bool { return ms[i].name() < ms[j].name() })
+
+    bw := bufio.NewWriter(w)
+    for _, m := range ms {
+        m.write(bw)
+    }
+    return bw.Flush()
+}
+
+type desc struct {
+    n      string
+    help   string
+    typ    string
+    labels []string
+}
+
+func (d *desc) name() string {
+    return d.n
+}
+
+func (d *desc) header(w *bufio.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n", d.n, escapeHelp(d.help))
+    fmt.Fprintf(w, "# TYPE %s %s\n", d.n, d.typ)
+}
+
+func (d *desc) check(values []string) {
+    if len(values) != len(d.labels) {
+        panic(fmt.Sprintf("metric %s wants %d label values, got %d", d.n, len(d.labels), len(values)))
+    }
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var valueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+    return helpEscaper.Replace(s)
+}
+
+/*
+ * labelString returns {name="value",...} for the names and values, with
+ * extra appended, or "" when there are none.
+ */
+func labelString(names []string, values []string, extra ...string) string {
+    pairs := []string{}
+    for i, n := range names {
+        pairs = append(pairs, n+`="`+valueEscaper.Replace(values[i])+`"`)
+    }
+    for i := 0; i+1 < len(extra); i += 2 {
+        pairs = append(pairs, extra[i]+`="`+valueEscaper.Replace(extra[i+1])+`"`)
+    }
+    if len(pairs) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+    switch {
+    case math.IsInf(v, 1):
+        return "+Inf"
+    case math.IsInf(v, -1):
+        return "-Inf"
+    case math.IsNaN(v):
+        return "NaN"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+/*
+ * Label values are kept joined by a byte that never appears in UTF-8.
+ */
+const keySep = "\xff"
+
+func splitKey(key string, n int) []string {
+    if n == 0 {
+        return nil
+    }
+    return strings.SplitN(key, keySep, n)
+}
+
+func sortedKeys(m map[string]float64) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+/*
+ * CounterVec counts by label values.
+ */
+type CounterVec struct {
+    desc
+    mu     sync.Mutex
+    values map[string]float64
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+    c := &CounterVec{
+        desc:   desc{n: name, help: help, typ: "counter", labels: labels},
+        values: map[string]float64{},
+    }
+    register(c)
+    return c
+}
+
+func (c *CounterVec) Inc(values ...string) {
+    c.Add(1, values...)
+}
+
+/*
+ * Add adds v, which must not be negative, to the count for values.
+ */
+func (c *CounterVec) Add(v float64, values ...string) {
+    c.check(values)
+    if v < 0 {
+        panic("counter " + c.n + " cannot go down")
+    }
+
+    c.mu.Lock()
+    c.values[strings.Join(values, keySep)] += v
+    c.mu.Unlock()
+}
+
+/*
+ * The values are copied so the scraper, which may be slow to read them,
+ * does not hold up Add.
+ */
+func (c *CounterVec) write(w *bufio.Writer) {
+    c.mu.Lock()
+    values := make(map[string]float64, len(c.values))
+    for k, v := range c.values {
+        values[k] = v
+    }
+    c.mu.Unlock()
+
+    c.header(w)
+    for _, k := range sortedKeys(values) {
+        fmt.Fprintf(w, "%s%s %s\n", c.n, labelString(c.labels, splitKey(k, len(c.labels))), formatValue(values[k]))
+    }
+}
+
+type histogram struct {
+    counts []uint64
+    sum    float64
+    count  uint64
+}
+
+/*
+ * HistogramVec counts observations into buckets by label values.
+ */
+type HistogramVec struct {
+    desc
+    buckets []float64
+    mu      sync.Mutex
+    values  map[string]*histogram
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+    b := append([]float64(nil), buckets...)
+    sort.Float64s(b)
+
+    h := &HistogramVec{
+        desc:    desc{n: name, help: help, typ: "histogram", labels: labels},
+        buckets: b,
+        values:  map[string]*histogram{},
+    }
+    register(h)
+    return h
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+    h.check(values)
+
+    key := strings.Join(values, keySep)
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    hv, ok := h.values[key]
+    if !ok {
+        hv = &histogram{counts: make([]uint64, len(h.buckets))}
+        h.values[key] = hv
+    }
+    for i, le := range h.buckets {
+        if v <= le {
+            hv.counts[i]++
+        }
+    }
+    hv.sum += v
+    hv.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+    h.mu.Lock()
+    values := make(map[string]histogram, len(h.values))
+    keys := make([]string, 0, len(h.values))
+    for k, hv := range h.values {
+        values[k] = histogram{
+            counts: append([]uint64(nil), hv.counts...),
+            sum:    hv.sum,
+            count:  hv.count,
+        }
+        keys = append(keys, k)
+    }
+    h.mu.Unlock()
+
+    sort.Strings(keys)
+
+    h.header(w)
+    for _, k := range keys {
+        hv := values[k]
+        labels := splitKey(k, len(h.labels))
+
+        for i, le := range h.buckets {
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, labelString(h.labels, labels, "le", formatValue(le)), hv.counts[i])
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, labelString(h.labels, labels, "le", "+Inf"), hv.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.n, labelString(h.labels, labels), formatValue(hv.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.n, labelString(h.labels, labels), hv.count)
+    }
+}
+
+/*
+ * Emit reports one value of a function metric, with its label values.
+ */
+type Emit func(v float64, values ...string)
+
+/*
+ * funcMetric is read by calling fn each time the metrics are written.
+ */
+type funcMetric struct {
+    desc
+    fn func(Emit)
+}
+
+/*
+ * NewGaugeFunc registers a gauge whose values fn reports when the metrics
+ * are written.
+ */
+func NewGaugeFunc(name string, help string, fn func(Emit), labels ...string) {
+    register(&funcMetric{desc: desc{n: name, help: help, typ: "gauge", labels: labels}, fn: fn})
+}
+
+/*
+ * NewCounterFunc registers a counter kept elsewhere, which fn reports
+ * when the metrics are written.
+ */
+func NewCounterFunc(name string, help string, fn func(Emit), labels ...string) {
+    register(&funcMetric{desc: desc{n: name, help: help, typ: "counter", labels: labels}, fn: fn})
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+    values := map[string]float64{}
+    f.fn(f.emitTo(values))
+    f.writeValues(w, values)
+}
+
+func (d *desc) emitTo(values map[string]float64) Emit {
+    return func(v float64, lv ...string) {
+        d.check(lv)
+        values[strings.Join(lv, keySep)] = v
+    }
+}
+
+func (d *desc) writeValues(w *bufio.Writer, values map[string]float64) {
+    d.header(w)
+    for _, k := range sortedKeys(values) {
+        fmt.Fprintf(w, "%s%s %s\n", d.n, labelString(d.labels, splitKey(k, len(d.labels))), formatValue(values[k]))
+    }
+}
+
+/*
+ * GaugeDesc names one gauge of a group.
+ */
+type GaugeDesc struct {
+    Name string
+    Help string
+}
+
+/*
+ * gaugeGroup is read by calling fn once for all its gauges.
+ */
+type gaugeGroup struct {
+    descs []desc
+    fn    func([]Emit)
+}
+
+/*
+ * NewGaugeGroup registers gauges with the same labels whose values come
+ * from one costly reading.  fn is called once each time the metrics are
+ * written, with an Emit for each gauge in the order given.
+ */
+func NewGaugeGroup(gauges []GaugeDesc, fn func([]Emit), labels ...string) {
+    g := &gaugeGroup{fn: fn}
+    names := []string{}
+    for _, gd := range gauges {
+        g.descs = append(g.descs, desc{n: gd.Name, help: gd.Help, typ: "gauge", labels: labels})
+        names = append(names, gd.Name)
+    }
+    register(g, names...)
+}
+
+func (g *gaugeGroup) name() string {
+    return g.descs[0].n
+}
+
+func (g *gaugeGroup) write(w *bufio.Writer) {
+    values := make([]map[string]float64, len(g.descs))
+    emits := make([]Emit, len(g.descs))
+    for i := range g.descs {
+        values[i] = map[string]float64{}
+        emits[i] = g.descs[i].emitTo(values[i])
+    }
+
+    g.fn(emits)
+
+    for i := range g.descs {
+        g.descs[i].writeValues(w, values[i])
+    }
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    . "github.com/smartystreets/goconvey/convey"
+)
+
+/*
+ * blockingWriter stands in for a scraper that stops reading.
+ */
+type blockingWriter struct {
+    once    sync.Once
+    started chan struct{}
+    release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+    w.once.Do(func() { close(w.started) })
+    <-w.release
+    return len(p), nil
+}
+
+func TestMetrics(t *testing.T) {
+    Convey("When writing metrics", t, func() {
+        var buf bytes.Buffer
+
+        Convey("Should write counters by label", func() {
+            c := NewCounterVec("test_requests_total", "Requests.\nAll of them.", "method", "path")
+            defer Unregister("test_requests_total")
+
+            c.Inc("GET", "/a")
+            c.Inc("GET", "/a")
+            c.Add(3, "POST", `/"b"`)
+
+            So(WriteText(&buf), ShouldBeNil)
+            So(buf.String(), ShouldContainSubstring, "# HELP test_requests_total Requests.\\nAll of them.\n")
+            So(buf.String(), ShouldContainSubstring, "# TYPE test_requests_total counter\n")
+            So(buf.String(), ShouldContainSubstring, `test_requests_total{method="GET",path="/a"} 2`+"\n")
+            So(buf.String(), ShouldContainSubstring, `test_requests_total{method="POST",path="/\"b\""} 3`+"\n")
+            So(func() { c.Inc("GET") }, ShouldPanic)
+            So(func() { c.Add(-1, "GET", "/a") }, ShouldPanic)
+        })
+        Convey("Should write cumulative histogram buckets", func() {
+            h := NewHistogramVec("test_seconds", "Latency.", []float64{1, 0.1}, "route")
+            defer Unregister("test_seconds")
+
+            h.Observe(0.05, "/a")
+            h.Observe(0.5, "/a")
+            h.Observe(5, "/a")
+
+            So(WriteText(&buf), ShouldBeNil)
+            So(buf.String(), ShouldContainSubstring, `test_seconds_bucket{route="/a",le="0.1"} 1`+"\n")
+            So(buf.String(), ShouldContainSubstring, `test_seconds_bucket{route="/a",le="1"} 2`+"\n")
+            So(buf.String(), ShouldContainSubstring, `test_seconds_bucket{route="/a",le="+Inf"} 3`+"\n")
+            So(buf.String(), ShouldContainSubstring, `test_seconds_sum{route="/a"} 5.55`+"\n")
+            So(buf.String(), ShouldContainSubstring, `test_seconds_count{route="/a"} 3`+"\n")
+        })
+        Convey("Should read gauges when written", func() {
+            n := 1.0
+            NewGaugeFunc("test_up", "Up.", func(emit Emit) {
+                emit(n)
+            })
+            defer Unregister("test_up")
+
+            n = 0
+            So(WriteText(&buf), ShouldBeNil)
+            So(buf.String(), ShouldContainSubstring, "# TYPE test_up gauge\ntest_up 0\n")
+        })
+        Convey("Should keep counting while a slow scraper reads", func() {
+            c := NewCounterVec("test_slow_total", "Slow.", "key")
+            defer Unregister("test_slow_total")
+
+            for i := 0; i < 500; i++ {
+                c.Inc(fmt.Sprintf("key%04d-%s", i, strings.Repeat("x", 20)))
+            }
+
+            w := &blockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+            done := make(chan error, 1)
+            go func() {
+                done <- WriteText(w)
+            }()
+            <-w.started
+
+            counted := make(chan struct{})
+            go func() {
+                c.Inc("other")
+                close(counted)
+            }()
+
+            blocked := false
+            select {
+            case <-counted:
+            case <-time.After(time.Second):
+                blocked = true
+            }
+            close(w.release)
+
+            So(blocked, ShouldBeFalse)
+            So(<-done, ShouldBeNil)
+        })
+        Convey("Should read a group of gauges once", func() {
+            reads := 0
+            NewGaugeGroup([]GaugeDesc{{"test_b_up", "Up."}, {"test_a_seconds", "Seconds."}}, func(emits []Emit) {
+                reads++
+                emits[0](1, "x")
+                emits[1](0.5, "x")
+            }, "cluster")
+            defer Unregister("test_a_seconds")
+            defer Unregister("test_b_up")
+
+            So(WriteText(&buf), ShouldBeNil)
+            So(reads, ShouldEqual, 1)
+            So(buf.String(), ShouldContainSubstring, "# TYPE test_b_up gauge\ntest_b_up{cluster=\"x\"} 1\n")
+            So(buf.String(), ShouldContainSubstring, "# TYPE test_a_seconds gauge\ntest_a_seconds{cluster=\"x\"} 0.5\n")
+            So(func() { NewGaugeFunc("test_a_seconds", "Again.", func(Emit) {}) }, ShouldPanic)
+        })
+        Convey("Should refuse a name twice", func() {
+            NewCounterVec("test_twice_total", "Twice.")
+            defer Unregister("test_twice_total")
+
+            So(func() { NewCounterVec("test_twice_total", "Twice.") }, ShouldPanic)
+        })
+    })
+}
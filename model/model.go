@@ -12,20 +12,100 @@ import (
     "time"
 )
 
+const (
+    StatusProvisioning   = "provisioning"
+    StatusActive         = "active"
+    StatusDeprovisioning = "deprovisioning"
+    StatusUpdating       = "updating"
+    StatusFailed         = "failed"
+    StatusDeleted        = "deleted"
+)
+
+const (
+    BackupRunning   = "running"
+    BackupCompleted = "completed"
+    BackupFailed    = "failed"
+)
+
+const (
+    RestoreRunning   = "running"
+    RestoreCompleted = "completed"
+    RestoreFailed    = "failed"
+)
+
+const (
+    RoleReadOnly  = "read-only"
+    RoleReadWrite = "read-write"
+    RoleAdmin     = "admin"
+)
+
+const (
+    ScopeReadInventory = "read-inventory"
+    ScopeProvision     = "provision"
+    ScopeDelete        = "delete"
+    ScopeAdmin         = "admin"
+)
+
 type CreateTime struct {
     Time time.Time
 }
 
 type DatabaseSpec struct {
-    Name        string    `json:"name"`
-    Username    string    `json:"username"`
-    Password    string    `json:"password"`
-    Created     time.Time `json:"created"`
-    Host        string    `json:"hostname"`
-    Port        string    `json:"port"`
-    Plan        string    `json:"plan"`
-    BillingCode string    `json:"billingcode"`
-    Misc        string    `json:"misc"`
+    Name          string            `json:"name"`
+    Username      string            `json:"username"`
+    Password      string            `json:"password"`
+    Created       time.Time         `json:"created"`
+    Cluster       string            `json:"cluster,omitempty"`
+    Host          string            `json:"hostname"`
+    Port          string            `json:"port"`
+    Plan          string            `json:"plan"`
+    BillingCode   string            `json:"billingcode"`
+    Misc          string            `json:"misc"`
+    InstanceId    string            `json:"instance_id,omitempty" bson:"instanceid,omitempty"`
+    Status        string            `json:"status"`
+    Message       string            `json:"message,omitempty"`
+    LastError     string            `json:"last_error,omitempty"`
+    Updated       time.Time         `json:"updated"`
+    RetiredUsers  []RetiredUser     `json:"retired_users,omitempty"`
+    Usage         int64             `json:"usage"`
+    UsageChecked  time.Time         `json:"usage_checked"`
+    OverQuota     bool              `json:"over_quota"`
+    WriteRevoked  bool              `json:"write_revoked"`
+    LastRequestId string            `json:"last_request_id,omitempty"`
+    Labels        map[string]string `json:"labels,omitempty"`
+    LabelIndex    []string          `json:"-"`
+    PurgeAfter    time.Time         `json:"purge_after"`
+
+    IdempotencyKey string `json:"idempotency_key,omitempty" bson:"idempotencykey,omitempty"`
+    CallerId       string `json:"-" bson:"callerid,omitempty"`
+    RequestHash    string `json:"-"`
+    Replayed       bool   `json:"-" bson:"-"`
+    ChangingTo     string `json:"-" bson:"changingto,omitempty"`
+}
+
+type RetiredUser struct {
+    Username string    `json:"username"`
+    Password string    `json:"-"`
+    Expires  time.Time `json:"expires"`
+}
+
+type CredentialSpec struct {
+    Name     string    `json:"name"`
+    Database string    `json:"database"`
+    Username string    `json:"username"`
+    Password string    `json:"password"`
+    Role     string    `json:"role"`
+    Created  time.Time `json:"created"`
+}
+
+type FullCredentialSpec struct {
+    CredentialSpec
+    DBUrl
+}
+
+type CredentialRequest struct {
+    Name string `json:"name"`
+    Role string `json:"role"`
 }
 
 type DBUrl struct {
@@ -44,17 +124,164 @@ type InfoData struct {
 }
 
 type PlanSpec struct {
-    Name        string `json:"name"`
-    Size        string `json:"size"`
-    Description string `json:"description"`
+    Name            string   `json:"name"`
+    Size            string   `json:"size"`
+    Description     string   `json:"description"`
+    Clusters        []string `json:"clusters,omitempty"`
+    PasswordLength  int      `json:"password_length,omitempty"`
+    PasswordCharset string   `json:"password_charset,omitempty"`
+    Deleting        bool     `json:"-" bson:"deleting,omitempty"`
 }
 
 type ProvisionSpec struct {
-    Plan        string
-    BillingCode string
-    Misc        string
+    Plan           string
+    BillingCode    string
+    Misc           string
+    InstanceId     string
+    Labels         map[string]string
+    IdempotencyKey string
+    CallerId       string
+}
+
+type LabelsSpec struct {
+    Labels map[string]string `json:"labels"`
+}
+
+type ListQuery struct {
+    Plan   string
+    Labels map[string]string
+    Sort   string
+    Limit  int
+    Cursor string
+    Fields []string
+}
+
+type StatusSpec struct {
+    Name          string    `json:"name"`
+    Status        string    `json:"status"`
+    Message       string    `json:"message,omitempty"`
+    LastError     string    `json:"last_error,omitempty"`
+    Updated       time.Time `json:"updated"`
+    LastRequestId string    `json:"last_request_id,omitempty"`
+}
+
+type BackupSpec struct {
+    Id          string     `json:"id"`
+    Database    string     `json:"database"`
+    Status      string     `json:"status"`
+    Created     time.Time  `json:"created"`
+    Finished    *time.Time `json:"finished,omitempty"`
+    Size        int64      `json:"size"`
+    Collections []string   `json:"collections"`
+    Documents   int        `json:"documents"`
+    Error       string     `json:"error,omitempty"`
+    Key         string     `json:"-"`
+    DownloadUrl string     `json:"download_url,omitempty" bson:"-"`
+}
+
+type RestoreRequest struct {
+    Drop        bool   `json:"drop"`
+    NewInstance bool   `json:"new_instance"`
+    Plan        string `json:"plan"`
+    BillingCode string `json:"billingcode"`
+}
+
+type RestoreSpec struct {
+    Id              string     `json:"id"`
+    Backup          string     `json:"backup"`
+    Source          string     `json:"source"`
+    Target          string     `json:"target"`
+    Drop            bool       `json:"drop"`
+    Status          string     `json:"status"`
+    Message         string     `json:"message,omitempty"`
+    Collections     int        `json:"collections"`
+    CollectionsDone int        `json:"collections_done"`
+    Documents       int        `json:"documents"`
+    Error           string     `json:"error,omitempty"`
+    Started         time.Time  `json:"started"`
+    Finished        *time.Time `json:"finished,omitempty"`
+}
+
+type LogQuery struct {
+    From  time.Time
+    To    time.Time
+    Limit int
+}
+
+type LogEntry struct {
+    Time    time.Time `json:"time"`
+    Source  string    `json:"source"`
+    Message string    `json:"message"`
+}
+
+type PlanChangeSpec struct {
+    Plan string `json:"plan"`
+}
+
+type UsageSnapshot struct {
+    Name        string    `json:"name"`
+    BillingCode string    `json:"billingcode"`
+    Plan        string    `json:"plan"`
+    Usage       int64     `json:"usage"`
+    Time        time.Time `json:"time"`
+}
+
+type BillingInstance struct {
+    Name         string `json:"name"`
+    Plan         string `json:"plan"`
+    Usage        int64  `json:"usage"`
+    InstanceDays int    `json:"instance_days"`
+}
+
+type BillingReport struct {
+    BillingCode  string            `json:"billingcode"`
+    Instances    []BillingInstance `json:"instances"`
+    Usage        int64             `json:"usage"`
+    InstanceDays int               `json:"instance_days"`
+}
+
+type ApiKeySpec struct {
+    Id      string    `json:"id"`
+    Name    string    `json:"name"`
+    Scopes  []string  `json:"scopes"`
+    Hash    string    `json:"-"`
+    Created time.Time `json:"created"`
+}
+
+type ApiKeyRequest struct {
+    Name   string   `json:"name"`
+    Scopes []string `json:"scopes"`
+}
+
+type NewApiKeySpec struct {
+    ApiKeySpec
+    Key string `json:"key"`
+}
+
+type DriftItem struct {
+    Cluster  string `json:"cluster"`
+    Database string `json:"database"`
+    Username string `json:"username,omitempty"`
+    Detail   string `json:"detail,omitempty"`
+    Repaired bool   `json:"repaired"`
+    Error    string `json:"error,omitempty"`
+}
+
+type DriftSpec struct {
+    Checked           time.Time   `json:"checked"`
+    Repair            bool        `json:"repair"`
+    OrphanDatabases   []DriftItem `json:"orphan_databases"`
+    OrphanRecords     []DriftItem `json:"orphan_records"`
+    MissingUsers      []DriftItem `json:"missing_users"`
+    RoleMismatches    []DriftItem `json:"role_mismatches"`
+    UncheckedClusters []string    `json:"unchecked_clusters,omitempty"`
+}
+
+type LogLevelSpec struct {
+    Level string `json:"level"`
 }
 
 type MsgSpec struct {
-    Msg string `json:"message"`
+    Msg       string `json:"message"`
+    RequestId string `json:"request_id,omitempty"`
 }
@@ -0,0 +1,66 @@
+package model
+
+/*
+ * Project: oct-mongodb-api
+ * Package: model
+ *
+ * Open Service Broker API v2 request and response bodies.
+ *
+ */
+
+type OSBPlan struct {
+    Id          string                 `json:"id"`
+    Name        string                 `json:"name"`
+    Description string                 `json:"description"`
+    Free        bool                   `json:"free"`
+    Metadata    map[string]interface{} `json:"metadata,omitempty"`
+}
+
+type OSBService struct {
+    Id          string    `json:"id"`
+    Name        string    `json:"name"`
+    Description string    `json:"description"`
+    Bindable    bool      `json:"bindable"`
+    Tags        []string  `json:"tags"`
+    Plans       []OSBPlan `json:"plans"`
+}
+
+type OSBCatalog struct {
+    Services []OSBService `json:"services"`
+}
+
+type OSBProvisionRequest struct {
+    ServiceId        string                 `json:"service_id"`
+    PlanId           string                 `json:"plan_id"`
+    OrganizationGuid string                 `json:"organization_guid"`
+    SpaceGuid        string                 `json:"space_guid"`
+    Parameters       map[string]interface{} `json:"parameters"`
+    Context          map[string]interface{} `json:"context"`
+}
+
+type OSBBindRequest struct {
+    ServiceId  string                 `json:"service_id"`
+    PlanId     string                 `json:"plan_id"`
+    AppGuid    string                 `json:"app_guid"`
+    Parameters map[string]interface{} `json:"parameters"`
+}
+
+type OSBProvisionResponse struct {
+    DashboardUrl string `json:"dashboard_url,omitempty"`
+    Operation    string `json:"operation,omitempty"`
+}
+
+type OSBBindResponse struct {
+    Credentials map[string]string `json:"credentials"`
+}
+
+type OSBLastOperation struct {
+    State       string `json:"state"`
+    Description string `json:"description,omitempty"`
+}
+
+type OSBError struct {
+    Error       string `json:"error,omitempty"`
+    Description string `json:"description"`
+    RequestId   string `json:"request_id,omitempty"`
+}
@@ -0,0 +1,43 @@
+package server
+
+/*
+ * Access log written through the broker logger, so requests come out in
+ * the same format as everything else and pass through the same
+ * redaction.  It reads what TimerMiddleware and RecorderMiddleware leave
+ * in r.Env, so it must come before them, and after requestIdMiddleware so
+ * the line carries the request id.
+ */
+
+import (
+    "time"
+
+    "mongodb-api/logger"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+type accessLogMiddleware struct{}
+
+func (mw *accessLogMiddleware) MiddlewareFunc(h rest.HandlerFunc) rest.HandlerFunc {
+    return func(w rest.ResponseWriter, r *rest.Request) {
+        h(w, r)
+
+        f := logger.Fields{
+            "method":     r.Method,
+            "path":       r.URL.Path,
+            "remote":     r.RemoteAddr,
+            "user_agent": r.UserAgent(),
+        }
+        if status, ok := r.Env["STATUS_CODE"].(int); ok {
+            f["status"] = status
+        }
+        if bytes, ok := r.Env["BYTES_WRITTEN"].(int64); ok {
+            f["bytes"] = bytes
+        }
+        if elapsed, ok := r.Env["ELAPSED_TIME"].(*time.Duration); ok && elapsed != nil {
+            f["duration_ms"] = float64(*elapsed) / float64(time.Millisecond)
+        }
+
+        logger.FromContext(r.Context()).Event(logger.LevelInfo, "request", f)
+    }
+}
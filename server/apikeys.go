@@ -0,0 +1,85 @@
+package server
+
+/*
+ * API key management.  The key is only in the response to its creation.
+ */
+
+import (
+    "net/http"
+
+    "mongodb-api/db"
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+func listApiKeysHandler(w rest.ResponseWriter, r *rest.Request) {
+    var errMsg model.MsgSpec
+
+    keys, err := db.GetApiKeys(r.Context())
+    if err != nil {
+        errMsg.Msg = "error listing API keys"
+        w.WriteHeader(errorStatus(err))
+        w.WriteJson(errMsg)
+        return
+    }
+    w.WriteJson(keys)
+}
+
+func createApiKeyHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+    var in model.ApiKeyRequest
+
+    err := r.DecodeJsonPayload(&in)
+    if err != nil {
+        errMsg.Msg = "Invalid post data"
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    kSpec, err := db.CreateApiKey(r.Context(), in)
+    if err == db.ErrApiKeyExists {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(http.StatusConflict)
+        w.WriteJson(errMsg)
+        return
+    } else if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(errorStatus(err))
+        w.WriteJson(errMsg)
+        return
+    }
+
+    log.Infof("created key %s", kSpec.Name)
+    w.WriteHeader(http.StatusCreated)
+    w.WriteJson(kSpec)
+}
+
+func deleteApiKeyHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+
+    id := r.PathParam("id")
+
+    err := db.DeleteApiKey(r.Context(), id)
+    if err == db.ErrApiKeyNotFound {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+        return
+    } else if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(errorStatus(err))
+        w.WriteJson(errMsg)
+        return
+    }
+
+    log.Infof("deleted key %s", id)
+    errMsg.Msg = "API key removed"
+    w.WriteJson(errMsg)
+}
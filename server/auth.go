@@ -0,0 +1,136 @@
+package server
+
+/*
+ * Authentication for the broker API.  Requests carry an API key either as
+ * "Authorization: Bearer <key>" or, for Open Service Broker platforms, as
+ * the password of HTTP basic auth.  Each route needs one scope; admin
+ * keys may use every route.  BROKER_ADMIN_KEY is an admin key that is
+ * not stored, for creating the first stored keys.
+ *
+ * Only keys that can provision, or admin keys, see passwords and urls;
+ * read-inventory keys, meant for dashboards, get instances without them,
+ * and cannot read backups or server logs.
+ */
+
+import (
+    "crypto/subtle"
+    "net/http"
+    "os"
+    "strings"
+
+    "mongodb-api/db"
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+var adminKey string
+
+const (
+    credentialsEnv = "SEE_CREDENTIALS"
+    callerEnv      = "CALLER_ID"
+)
+
+/*
+ * The caller id of BROKER_ADMIN_KEY, stored keys use their id.
+ */
+const adminCallerId = "admin"
+
+func requestKey(r *rest.Request) string {
+    auth := r.Header.Get("Authorization")
+    if strings.HasPrefix(auth, "Bearer ") {
+        return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+    }
+    if _, password, ok := r.BasicAuth(); ok {
+        return password
+    }
+    return ""
+}
+
+/*
+ * requireScope wraps h so it only runs for requests whose key has scope.
+ */
+func requireScope(scope string, h rest.HandlerFunc) rest.HandlerFunc {
+    return func(w rest.ResponseWriter, r *rest.Request) {
+        var errMsg model.MsgSpec
+
+        key := requestKey(r)
+        if key == "" {
+            errMsg.Msg = "Unauthorized"
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            w.WriteHeader(http.StatusUnauthorized)
+            w.WriteJson(errMsg)
+            return
+        }
+
+        if adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1 {
+            r.Env[credentialsEnv] = true
+            r.Env[callerEnv] = adminCallerId
+            h(w, r)
+            return
+        }
+
+        kSpec, err := db.FindApiKey(r.Context(), key)
+        if err == db.ErrApiKeyNotFound {
+            errMsg.Msg = "Unauthorized"
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            w.WriteHeader(http.StatusUnauthorized)
+            w.WriteJson(errMsg)
+            return
+        } else if err != nil {
+            logger.FromContext(r.Context()).Errorf("finding key: %v", err)
+            errMsg.Msg = "error checking API key"
+            w.WriteHeader(http.StatusInternalServerError)
+            w.WriteJson(errMsg)
+            return
+        }
+
+        if !db.HasScope(kSpec, scope) {
+            logger.FromContext(r.Context()).Warnf("key %s lacks %s for %s %s", kSpec.Name, scope, r.Method, r.URL.Path)
+            errMsg.Msg = "API key does not have the " + scope + " scope"
+            w.WriteHeader(http.StatusForbidden)
+            w.WriteJson(errMsg)
+            return
+        }
+
+        r.Env[credentialsEnv] = db.HasScope(kSpec, model.ScopeProvision)
+        r.Env[callerEnv] = kSpec.Id
+        h(w, r)
+    }
+}
+
+/*
+ * callerId identifies the API key of r.
+ */
+func callerId(r *rest.Request) string {
+    id, _ := r.Env[callerEnv].(string)
+    return id
+}
+
+func canSeeCredentials(r *rest.Request) bool {
+    ok, _ := r.Env[credentialsEnv].(bool)
+    return ok
+}
+
+/*
+ * hideCredentials blanks the password and url of an instance for keys
+ * that may not see them.
+ */
+func hideCredentials(r *rest.Request, fDbSpec *model.FullDatabaseSpec) {
+    if canSeeCredentials(r) {
+        return
+    }
+    fDbSpec.Password = ""
+    fDbSpec.Url = ""
+}
+
+func setAdminKey() {
+    adminKey = os.Getenv("BROKER_ADMIN_KEY")
+    if adminKey == "" {
+        adminKey = os.Getenv("BROKER_ADMIN_TOKEN")
+    }
+    if adminKey == "" {
+        log.Warnf("BROKER_ADMIN_KEY not set, only stored API keys are accepted")
+    }
+}
@@ -0,0 +1,120 @@
+package server
+
+/*
+ * Backup routes for instance databases.
+ */
+
+import (
+    "io"
+    "net/http"
+
+    "mongodb-api/db"
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+func backupUrl(bSpec *model.BackupSpec) string {
+    return "/v1/mongodb/" + bSpec.Database + "/backups/" + bSpec.Id + "?download=true"
+}
+
+func listBackupsHandler(w rest.ResponseWriter, r *rest.Request) {
+    var errMsg model.MsgSpec
+
+    dbName := r.PathParam("name")
+
+    backups, err := db.GetBackups(r.Context(), dbName)
+    if err != nil {
+        errMsg.Msg = "error getting backups for " + dbName
+        w.WriteHeader(http.StatusInternalServerError)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    for i := range *backups {
+        if (*backups)[i].Status == model.BackupCompleted {
+            (*backups)[i].DownloadUrl = backupUrl(&(*backups)[i])
+        }
+    }
+    w.WriteJson(backups)
+}
+
+func createBackupHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+
+    dbName := r.PathParam("name")
+
+    if _, err := db.GetDbInfo(r.Context(), dbName); err != nil {
+        errMsg.Msg = "error finding " + dbName
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    bSpec, err := db.CreateBackup(r.Context(), dbName)
+    if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(errorStatus(err))
+        w.WriteJson(errMsg)
+        return
+    }
+
+    log.Infof("backup %s of %s", bSpec.Id, dbName)
+    bSpec.DownloadUrl = backupUrl(bSpec)
+    w.WriteHeader(http.StatusCreated)
+    w.WriteJson(bSpec)
+}
+
+/*
+ * Returns the backup metadata, or the archive itself with ?download=true.
+ */
+func getBackupHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+
+    dbName := r.PathParam("name")
+    id := r.PathParam("backup")
+
+    bSpec, err := db.GetBackup(r.Context(), dbName, id)
+    if err != nil {
+        errMsg.Msg = "error finding backup " + id
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    if r.URL.Query().Get("download") != "true" {
+        if bSpec.Status == model.BackupCompleted {
+            bSpec.DownloadUrl = backupUrl(bSpec)
+        }
+        w.WriteJson(bSpec)
+        return
+    }
+
+    archive, err := db.OpenBackup(r.Context(), bSpec)
+    if err == db.ErrNoBackupStore {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(http.StatusServiceUnavailable)
+        w.WriteJson(errMsg)
+        return
+    } else if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(http.StatusConflict)
+        w.WriteJson(errMsg)
+        return
+    }
+    defer archive.Close()
+
+    w.Header().Set("Content-Type", "application/gzip")
+    w.Header().Set("Content-Disposition", "attachment; filename=\""+dbName+"-"+bSpec.Id+".tar.gz\"")
+    w.WriteHeader(http.StatusOK)
+
+    _, err = io.Copy(w.(http.ResponseWriter), archive)
+    if err != nil {
+        log.Errorf("streaming %s: %s", id, err)
+    }
+}
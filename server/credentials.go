@@ -0,0 +1,124 @@
+package server
+
+/*
+ * Additional named credentials on an instance.
+ */
+
+import (
+    "net/http"
+
+    "mongodb-api/db"
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+func credentialUrl(dbSpec *model.DatabaseSpec, cSpec *model.CredentialSpec) string {
+    uSpec := *dbSpec
+    uSpec.Username = cSpec.Username
+    uSpec.Password = cSpec.Password
+    return fmtDatabaseUrl(&uSpec)
+}
+
+func copyCredToFullCred(dbSpec *model.DatabaseSpec, cSpec *model.CredentialSpec, fCSpec *model.FullCredentialSpec) {
+    fCSpec.CredentialSpec = *cSpec
+    fCSpec.Url = credentialUrl(dbSpec, cSpec)
+}
+
+func addCredentialHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+    var cReq model.CredentialRequest
+    var fCSpec model.FullCredentialSpec
+
+    dbName := r.PathParam("name")
+
+    err := r.DecodeJsonPayload(&cReq)
+    if err != nil {
+        errMsg.Msg = "Invalid post data"
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    dbSpec, err := db.GetDbInfo(r.Context(), dbName)
+    if err != nil {
+        errMsg.Msg = "error finding " + dbName
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    cSpec, err := db.AddCredential(r.Context(), dbName, cReq)
+    if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(errorStatus(err))
+        w.WriteJson(errMsg)
+        return
+    }
+
+    log.Infof("added %s to %s", cSpec.Name, dbName)
+    copyCredToFullCred(dbSpec, cSpec, &fCSpec)
+    w.WriteHeader(http.StatusCreated)
+    w.WriteJson(fCSpec)
+}
+
+func listCredentialsHandler(w rest.ResponseWriter, r *rest.Request) {
+    var errMsg model.MsgSpec
+
+    dbName := r.PathParam("name")
+
+    dbSpec, err := db.GetDbInfo(r.Context(), dbName)
+    if err != nil {
+        errMsg.Msg = "error finding " + dbName
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    creds, err := db.GetCredentials(r.Context(), dbName)
+    if err != nil {
+        errMsg.Msg = "error getting credentials for " + dbName
+        w.WriteHeader(http.StatusInternalServerError)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    fCreds := []model.FullCredentialSpec{}
+    for i := range *creds {
+        f := model.FullCredentialSpec{}
+        copyCredToFullCred(dbSpec, &(*creds)[i], &f)
+        if !canSeeCredentials(r) {
+            f.Password = ""
+            f.Url = ""
+        }
+        fCreds = append(fCreds, f)
+    }
+    w.WriteJson(fCreds)
+}
+
+func deleteCredentialHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+
+    dbName := r.PathParam("name")
+    credName := r.PathParam("cred")
+
+    err := db.RemoveCredential(r.Context(), dbName, credName)
+    if _, ok := err.(*db.OpError); ok {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(http.StatusInternalServerError)
+        w.WriteJson(errMsg)
+    } else if err != nil {
+        errMsg.Msg = "error finding credential " + credName
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+    } else {
+        log.Infof("removed %s from %s", credName, dbName)
+        errMsg.Msg = "credential removed"
+        w.WriteJson(errMsg)
+    }
+}
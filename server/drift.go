@@ -0,0 +1,42 @@
+package server
+
+/*
+ * Drift between the broker records and the clusters.  GET only reports
+ * it, POST to /repair also fixes what can be fixed, see db/drift.go.
+ */
+
+import (
+    "net/http"
+
+    "mongodb-api/db"
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+func writeDrift(w rest.ResponseWriter, r *rest.Request, repair bool) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+
+    report, err := db.CheckDrift(r.Context(), repair)
+    if err != nil {
+        errMsg.Msg = "error checking drift"
+        w.WriteHeader(http.StatusInternalServerError)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    log.Infof("drift checked, repair %t: %d orphan databases, %d orphan records, %d missing users, %d role mismatches",
+        repair, len(report.OrphanDatabases), len(report.OrphanRecords), len(report.MissingUsers), len(report.RoleMismatches))
+    w.WriteJson(report)
+}
+
+func driftHandler(w rest.ResponseWriter, r *rest.Request) {
+    writeDrift(w, r, false)
+}
+
+func repairDriftHandler(w rest.ResponseWriter, r *rest.Request) {
+    writeDrift(w, r, true)
+}
@@ -0,0 +1,62 @@
+package server
+
+/*
+ * POST /v1/mongodb/instance takes an Idempotency-Key header, or an
+ * IdempotencyKey or InstanceId in the body, so that a caller can retry a
+ * provision that timed out without getting a second database.  A replayed
+ * response carries Idempotent-Replayed: true.  Idempotency keys are only
+ * looked up among the instances of the same API key.
+ */
+
+import (
+    "errors"
+
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+const (
+    idempotencyKeyHeader = "Idempotency-Key"
+    replayedHeader       = "Idempotent-Replayed"
+)
+
+func idempotencyKey(r *rest.Request, pSpec *model.ProvisionSpec) error {
+    pSpec.CallerId = callerId(r)
+
+    key := r.Header.Get(idempotencyKeyHeader)
+    if key == "" {
+        return nil
+    }
+    if pSpec.IdempotencyKey != "" && pSpec.IdempotencyKey != key {
+        return errors.New("Idempotency key in the header and body differ")
+    }
+    pSpec.IdempotencyKey = key
+    return nil
+}
+
+/*
+ * replayFailed returns why the instance a replayed provision found cannot
+ * be given back, "" if it can.  A failed or removed instance stays so, a
+ * new key is needed to provision again.
+ */
+func replayFailed(dbSpec *model.DatabaseSpec) string {
+    if !dbSpec.Replayed {
+        return ""
+    }
+    switch dbSpec.Status {
+    case model.StatusFailed, model.StatusDeleted, model.StatusDeprovisioning:
+        msg := "Instance " + dbSpec.Name + " provisioned with this key is " + dbSpec.Status
+        if dbSpec.LastError != "" {
+            msg += ": " + dbSpec.LastError
+        }
+        return msg
+    }
+    return ""
+}
+
+func replayed(w rest.ResponseWriter, dbSpec *model.DatabaseSpec) {
+    if dbSpec.Replayed {
+        w.Header().Set(replayedHeader, "true")
+    }
+}
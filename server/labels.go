@@ -0,0 +1,90 @@
+package server
+
+/*
+ * Labels on instances.  Filtering the instance list by them is in list.go.
+ */
+
+import (
+    "net/http"
+
+    "mongodb-api/db"
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+func labelError(w rest.ResponseWriter, err error) {
+    var errMsg model.MsgSpec
+
+    errMsg.Msg = err.Error()
+    if err == db.ErrLabelNotFound {
+        w.WriteHeader(http.StatusNotFound)
+    } else {
+        w.WriteHeader(errorStatus(err))
+    }
+    w.WriteJson(errMsg)
+}
+
+func instanceFound(w rest.ResponseWriter, r *rest.Request, dbName string) bool {
+    var errMsg model.MsgSpec
+
+    _, err := db.GetDbInfo(r.Context(), dbName)
+    if err != nil {
+        errMsg.Msg = "error finding " + dbName
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+        return false
+    }
+    return true
+}
+
+func setLabelsHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+    var lSpec model.LabelsSpec
+
+    dbName := r.PathParam("name")
+
+    err := r.DecodeJsonPayload(&lSpec)
+    if err != nil {
+        errMsg.Msg = "Invalid post data"
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    if !instanceFound(w, r, dbName) {
+        return
+    }
+
+    dbSpec, err := db.SetLabels(r.Context(), dbName, lSpec.Labels)
+    if err != nil {
+        labelError(w, err)
+        return
+    }
+
+    log.Infof("labelled %s", dbName)
+    w.WriteJson(model.LabelsSpec{Labels: dbSpec.Labels})
+}
+
+func removeLabelHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    dbName := r.PathParam("name")
+    label := r.PathParam("label")
+
+    if !instanceFound(w, r, dbName) {
+        return
+    }
+
+    dbSpec, err := db.RemoveLabel(r.Context(), dbName, label)
+    if err != nil {
+        labelError(w, err)
+        return
+    }
+
+    log.Infof("removed label %s from %s", label, dbName)
+    w.WriteJson(model.LabelsSpec{Labels: dbSpec.Labels})
+}
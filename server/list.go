@@ -0,0 +1,170 @@
+package server
+
+/*
+ * GET /v1/mongodb, the instance list.  It takes ?plan= and any number of
+ * ?label=key=value, which must all match, ?sort=created, name or plan
+ * (- first for descending), ?limit=, ?cursor= from the previous page and
+ * ?fields= to return only some fields, say without the credentials.
+ * Without ?limit= or ?cursor= every instance is listed.
+ *
+ * The list is written out as it is read from the database.  The cursor of
+ * the next page is looked up first and sent in the X-Next-Cursor and Link
+ * headers.
+ */
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "mongodb-api/db"
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+const nextCursorHeader = "X-Next-Cursor"
+
+func parseListQuery(r *rest.Request) (model.ListQuery, error) {
+    var q model.ListQuery
+    var err error
+
+    v := r.URL.Query()
+    q.Plan = v.Get("plan")
+    q.Sort = v.Get("sort")
+    q.Cursor = v.Get("cursor")
+
+    for _, l := range v["label"] {
+        i := strings.Index(l, "=")
+        if i <= 0 {
+            return q, errors.New("Invalid label " + l + ", use label=key=value")
+        }
+        if q.Labels == nil {
+            q.Labels = map[string]string{}
+        }
+        q.Labels[l[:i]] = l[i+1:]
+    }
+
+    if l := v.Get("limit"); l != "" {
+        q.Limit, err = strconv.Atoi(l)
+        if err != nil || q.Limit <= 0 {
+            return q, errors.New("Invalid limit " + l)
+        }
+    }
+
+    for _, f := range v["fields"] {
+        for _, name := range strings.Split(f, ",") {
+            if name != "" {
+                q.Fields = append(q.Fields, name)
+            }
+        }
+    }
+
+    return q, db.ValidateListQuery(&q)
+}
+
+/*
+ * listItem returns the JSON of one instance with only the fields asked for.
+ */
+func listItem(r *rest.Request, dbSpec *model.DatabaseSpec, fields []string) ([]byte, error) {
+    var fDbSpec model.FullDatabaseSpec
+
+    copyDbToFullDb(dbSpec, &fDbSpec)
+    hideCredentials(r, &fDbSpec)
+    b, err := json.Marshal(fDbSpec)
+    if err != nil || len(fields) == 0 {
+        return b, err
+    }
+
+    var all map[string]json.RawMessage
+    if err = json.Unmarshal(b, &all); err != nil {
+        return nil, err
+    }
+
+    some := map[string]json.RawMessage{}
+    for _, f := range fields {
+        if v, ok := all[f]; ok {
+            some[f] = v
+        }
+    }
+    return json.Marshal(some)
+}
+
+func nextPageUrl(r *rest.Request, cursor string) string {
+    v := r.URL.Query()
+    v.Set("cursor", cursor)
+    return r.UrlFor(r.URL.Path, v).String()
+}
+
+func getAllDbHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+
+    q, err := parseListQuery(r)
+    if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    next, err := db.NextCursor(r.Context(), q)
+    if err != nil {
+        log.Errorf("error getting list of dbs: %s", err)
+        errMsg.Msg = "error getting list of dbs "
+        w.WriteHeader(http.StatusInternalServerError)
+        w.WriteJson(errMsg)
+        return
+    }
+    if next != "" {
+        w.Header().Set(nextCursorHeader, next)
+        w.Header().Set("Link", "<"+nextPageUrl(r, next)+">; rel=\"next\"")
+    }
+
+    hw := w.(http.ResponseWriter)
+    n := 0
+
+    err = db.GetDbList(r.Context(), q, next, func(dbSpec *model.DatabaseSpec) error {
+        b, err := listItem(r, dbSpec, q.Fields)
+        if err != nil {
+            return err
+        }
+
+        sep := ","
+        if n == 0 {
+            sep = "["
+        }
+        n++
+        _, err = hw.Write(append([]byte(sep), b...))
+        return err
+    })
+
+    /*
+     * Once the page has been started the status has gone out, so all that
+     * can be done is to leave the array unterminated.
+     */
+    if err != nil && n > 0 {
+        log.Errorf("error writing list of dbs after %d: %s", n, err)
+        return
+    }
+    if err != nil {
+        log.Errorf("error getting list of dbs: %s", err)
+        w.Header().Del(nextCursorHeader)
+        w.Header().Del("Link")
+        errMsg.Msg = "error getting list of dbs "
+        w.WriteHeader(http.StatusInternalServerError)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    if n == 0 {
+        hw.Write([]byte("["))
+    }
+    hw.Write([]byte("]"))
+
+    log.Debugf("db list cnt %d", n)
+}
@@ -0,0 +1,46 @@
+package server
+
+/*
+ * Changing the log level of a running broker, e.g. to debug a problem
+ * without a restart.  The level goes back to LOG_LEVEL on restart.
+ */
+
+import (
+    "net/http"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+func getLogLevelHandler(w rest.ResponseWriter, r *rest.Request) {
+    w.WriteJson(model.LogLevelSpec{Level: logger.GetLevel().String()})
+}
+
+func setLogLevelHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+    var lSpec model.LogLevelSpec
+
+    err := r.DecodeJsonPayload(&lSpec)
+    if err != nil {
+        errMsg.Msg = "Invalid post data"
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    level, err := logger.ParseLevel(lSpec.Level)
+    if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    logger.SetLevel(level)
+    log.Infof("log level set to %s", level)
+    w.WriteJson(model.LogLevelSpec{Level: level.String()})
+}
@@ -0,0 +1,125 @@
+package server
+
+/*
+ * Log routes for instance databases.  ?from= and ?to= take RFC3339 times,
+ * ?limit= the number of most recent entries (default 100).
+ */
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+
+    "mongodb-api/db"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+const (
+    defaultLogLimit = 100
+    maxLogLimit     = 1000
+)
+
+func parseLogQuery(r *rest.Request) (model.LogQuery, error) {
+    var q model.LogQuery
+    var err error
+
+    v := r.URL.Query()
+
+    if from := v.Get("from"); from != "" {
+        q.From, err = time.Parse(time.RFC3339, from)
+        if err != nil {
+            return q, errors.New("Invalid from " + from)
+        }
+    }
+    if to := v.Get("to"); to != "" {
+        q.To, err = time.Parse(time.RFC3339, to)
+        if err != nil {
+            return q, errors.New("Invalid to " + to)
+        }
+    }
+
+    q.Limit = defaultLogLimit
+    if limit := v.Get("limit"); limit != "" {
+        q.Limit, err = strconv.Atoi(limit)
+        if err != nil || q.Limit < 1 {
+            return q, errors.New("Invalid limit " + limit)
+        }
+    }
+    if q.Limit > maxLogLimit {
+        q.Limit = maxLogLimit
+    }
+
+    return q, nil
+}
+
+func logsHandler(w rest.ResponseWriter, r *rest.Request) {
+    var errMsg model.MsgSpec
+
+    dbName := r.PathParam("name")
+
+    q, err := parseLogQuery(r)
+    if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    if _, err = db.GetDbInfo(r.Context(), dbName); err != nil {
+        errMsg.Msg = "error finding " + dbName
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    entries, err := db.GetLogs(r.Context(), dbName, q)
+    if err != nil {
+        errMsg.Msg = "error getting logs for " + dbName
+        w.WriteHeader(http.StatusInternalServerError)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    w.WriteJson(entries)
+}
+
+func logFileHandler(w rest.ResponseWriter, r *rest.Request) {
+    var errMsg model.MsgSpec
+
+    dbName := r.PathParam("name")
+    dir := r.PathParam("dir")
+    file := r.PathParam("file")
+
+    q, err := parseLogQuery(r)
+    if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    if _, err = db.GetDbInfo(r.Context(), dbName); err != nil {
+        errMsg.Msg = "error finding " + dbName
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    entries, err := db.GetLog(r.Context(), dbName, dir, file, q)
+    if err == db.ErrUnknownLog {
+        errMsg.Msg = "Unknown log " + dir + "/" + file
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+        return
+    } else if err != nil {
+        errMsg.Msg = "error getting logs for " + dbName
+        w.WriteHeader(http.StatusInternalServerError)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    w.WriteJson(entries)
+}
@@ -0,0 +1,78 @@
+package server
+
+/*
+ * GET /metrics in the Prometheus text format.  Requests are counted and
+ * timed by route, the path pattern matched rather than the path, so that
+ * instance names do not each get their own series.  Like the access log
+ * this reads what TimerMiddleware and RecorderMiddleware leave in r.Env.
+ */
+
+import (
+    "net/http"
+    "strconv"
+    "time"
+
+    "mongodb-api/metrics"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+const (
+    routeEnv       = "ROUTE"
+    unmatchedRoute = "unmatched"
+)
+
+var (
+    requestsTotal = metrics.NewCounterVec("mongodb_api_http_requests_total",
+        "Requests by method, route and status.", "method", "route", "status")
+    requestSeconds = metrics.NewHistogramVec("mongodb_api_http_request_duration_seconds",
+        "Time taken by requests, by method and route.", metrics.DefBuckets, "method", "route")
+)
+
+/*
+ * routeNames makes each route record its path pattern in r.Env for
+ * metricsMiddleware.
+ */
+func routeNames(routes ...*rest.Route) []*rest.Route {
+    for _, route := range routes {
+        h := route.Func
+        pathExp := route.PathExp
+        route.Func = func(w rest.ResponseWriter, r *rest.Request) {
+            r.Env[routeEnv] = pathExp
+            h(w, r)
+        }
+    }
+    return routes
+}
+
+type metricsMiddleware struct{}
+
+func (mw *metricsMiddleware) MiddlewareFunc(h rest.HandlerFunc) rest.HandlerFunc {
+    return func(w rest.ResponseWriter, r *rest.Request) {
+        h(w, r)
+
+        route, ok := r.Env[routeEnv].(string)
+        if !ok {
+            route = unmatchedRoute
+        }
+        status := http.StatusOK
+        if s, ok := r.Env["STATUS_CODE"].(int); ok {
+            status = s
+        }
+
+        requestsTotal.Inc(r.Method, route, strconv.Itoa(status))
+        if elapsed, ok := r.Env["ELAPSED_TIME"].(*time.Duration); ok && elapsed != nil {
+            requestSeconds.Observe(elapsed.Seconds(), r.Method, route)
+        }
+    }
+}
+
+func metricsHandler(w rest.ResponseWriter, r *rest.Request) {
+    w.Header().Set("Content-Type", metrics.ContentType)
+    w.WriteHeader(http.StatusOK)
+
+    err := metrics.WriteText(w.(http.ResponseWriter))
+    if err != nil {
+        log.Errorf("writing metrics: %s", err)
+    }
+}
@@ -0,0 +1,319 @@
+package server
+
+/*
+ * Open Service Broker API v2 routes.  These are backed by the same
+ * provision inventory and plans as the /v1/mongodb routes.
+ */
+
+import (
+    "net/http"
+    "os"
+
+    "mongodb-api/db"
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+const (
+    osbVersionHeader   = "X-Broker-API-Version"
+    osbDefaultService  = "akkeris-mongodb"
+    osbServiceName     = "mongodb"
+    osbBillingCodeParm = "billingcode"
+    osbProvisionOp     = "provision"
+)
+
+func osbServiceId() string {
+    id := os.Getenv("OSB_SERVICE_ID")
+    if id == "" {
+        id = osbDefaultService
+    }
+    return id
+}
+
+func osbCredentialName(bindingId string) string {
+    return "osb-" + bindingId
+}
+
+func osbError(w rest.ResponseWriter, code int, errCode string, desc string) {
+    w.WriteHeader(code)
+    w.WriteJson(model.OSBError{
+        Error:       errCode,
+        Description: desc,
+    })
+}
+
+func osbEmpty(w rest.ResponseWriter, code int) {
+    w.WriteHeader(code)
+    w.WriteJson(struct{}{})
+}
+
+/*
+ * Platforms must send the API version they speak on every request.
+ */
+func osbVersionOk(w rest.ResponseWriter, r *rest.Request) bool {
+    if r.Header.Get(osbVersionHeader) == "" {
+        osbError(w, http.StatusPreconditionFailed, "", osbVersionHeader+" header required")
+        return false
+    }
+    return true
+}
+
+func osbCatalogHandler(w rest.ResponseWriter, r *rest.Request) {
+    var err error
+    var plans *[]model.PlanSpec
+
+    if !osbVersionOk(w, r) {
+        return
+    }
+
+    plans, err = db.GetPlans(r.Context())
+
+    if err != nil || plans == nil {
+        osbError(w, http.StatusInternalServerError, "", "Error getting plans list")
+        return
+    }
+
+    service := model.OSBService{
+        Id:          osbServiceId(),
+        Name:        osbServiceName,
+        Description: "MongoDB database on a shared MongoDB server",
+        Bindable:    true,
+        Tags:        []string{"mongodb", "database"},
+        Plans:       []model.OSBPlan{},
+    }
+
+    for _, p := range *plans {
+        service.Plans = append(service.Plans, model.OSBPlan{
+            Id:          p.Name,
+            Name:        p.Name,
+            Description: p.Description,
+            Metadata: map[string]interface{}{
+                "size": p.Size,
+            },
+        })
+    }
+
+    w.WriteJson(model.OSBCatalog{
+        Services: []model.OSBService{service},
+    })
+}
+
+func osbProvisionHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var req model.OSBProvisionRequest
+    var err error
+
+    if !osbVersionOk(w, r) {
+        return
+    }
+
+    instanceId := r.PathParam("id")
+
+    err = r.DecodeJsonPayload(&req)
+    if err != nil {
+        osbError(w, http.StatusBadRequest, "", "Invalid request body")
+        return
+    }
+
+    async := r.URL.Query().Get("accepts_incomplete") == "true"
+
+    existing, err := db.GetDbInfoByInstanceId(r.Context(), instanceId)
+    if err != nil && err != db.ErrNotFound {
+        osbError(w, http.StatusInternalServerError, "", err.Error())
+        return
+    }
+    if err == nil {
+        if existing.Plan != req.PlanId || existing.Status == model.StatusDeleted {
+            osbEmpty(w, http.StatusConflict)
+        } else if existing.Status == model.StatusFailed {
+            osbError(w, http.StatusInternalServerError, "", existing.LastError)
+        } else if existing.Status == model.StatusProvisioning && async {
+            w.WriteHeader(http.StatusAccepted)
+            w.WriteJson(model.OSBProvisionResponse{Operation: osbProvisionOp})
+        } else if existing.Status == model.StatusProvisioning {
+            osbError(w, http.StatusUnprocessableEntity, "AsyncRequired", "Instance is still being provisioned")
+        } else {
+            osbEmpty(w, http.StatusOK)
+        }
+        return
+    }
+
+    billingCode, _ := req.Parameters[osbBillingCodeParm].(string)
+    if billingCode == "" {
+        billingCode = req.OrganizationGuid
+    }
+
+    pSpec := model.ProvisionSpec{
+        Plan:        req.PlanId,
+        BillingCode: billingCode,
+        Misc:        req.SpaceGuid,
+        InstanceId:  instanceId,
+    }
+
+    if async {
+        _, err = db.ProvisionAsync(r.Context(), pSpec)
+    } else {
+        _, err = db.Provision(r.Context(), pSpec)
+    }
+    if err != nil {
+        osbError(w, errorStatus(err), "", err.Error())
+        return
+    }
+
+    log.Infof("provisioned instance %s", instanceId)
+    if async {
+        w.WriteHeader(http.StatusAccepted)
+        w.WriteJson(model.OSBProvisionResponse{Operation: osbProvisionOp})
+    } else {
+        osbEmpty(w, http.StatusCreated)
+    }
+}
+
+func osbDeprovisionHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    if !osbVersionOk(w, r) {
+        return
+    }
+
+    instanceId := r.PathParam("id")
+
+    dbSpec, err := db.GetDbInfoByInstanceId(r.Context(), instanceId)
+    if err != nil && err != db.ErrNotFound {
+        osbError(w, http.StatusInternalServerError, "", err.Error())
+        return
+    }
+    if err != nil || dbSpec.Status == model.StatusDeleted {
+        osbEmpty(w, http.StatusGone)
+        return
+    }
+
+    err = db.RemoveDb(r.Context(), dbSpec.Name)
+    if err != nil {
+        osbError(w, http.StatusInternalServerError, "", err.Error())
+        return
+    }
+
+    log.Infof("removed instance %s", instanceId)
+    osbEmpty(w, http.StatusOK)
+}
+
+func osbBindHandler(w rest.ResponseWriter, r *rest.Request) {
+    var req model.OSBBindRequest
+
+    if !osbVersionOk(w, r) {
+        return
+    }
+
+    instanceId := r.PathParam("id")
+
+    err := r.DecodeJsonPayload(&req)
+    if err != nil {
+        osbError(w, http.StatusBadRequest, "", "Invalid request body")
+        return
+    }
+
+    dbSpec, err := db.GetDbInfoByInstanceId(r.Context(), instanceId)
+    if err == db.ErrNotFound {
+        osbError(w, http.StatusNotFound, "", "error finding instance "+instanceId)
+        return
+    }
+    if err != nil {
+        osbError(w, http.StatusInternalServerError, "", err.Error())
+        return
+    }
+
+    /*
+     * Every binding gets its own user so unbinding one app does not
+     * affect the others.
+     */
+    code := http.StatusOK
+    cSpec, err := db.GetCredential(r.Context(), dbSpec.Name, osbCredentialName(r.PathParam("bid")))
+    if err != nil && err != db.ErrNotFound {
+        osbError(w, http.StatusInternalServerError, "", err.Error())
+        return
+    }
+    if err == db.ErrNotFound {
+        code = http.StatusCreated
+        cSpec, err = db.AddCredential(r.Context(), dbSpec.Name, model.CredentialRequest{
+            Name: osbCredentialName(r.PathParam("bid")),
+            Role: model.RoleReadWrite,
+        })
+        if err != nil {
+            osbError(w, errorStatus(err), "", err.Error())
+            return
+        }
+    }
+
+    w.WriteHeader(code)
+    w.WriteJson(model.OSBBindResponse{
+        Credentials: map[string]string{
+            "MONGODB_URL": credentialUrl(dbSpec, cSpec),
+            "name":        dbSpec.Name,
+            "hostname":    dbSpec.Host,
+            "port":        dbSpec.Port,
+            "username":    cSpec.Username,
+            "password":    cSpec.Password,
+        },
+    })
+}
+
+func osbUnbindHandler(w rest.ResponseWriter, r *rest.Request) {
+    if !osbVersionOk(w, r) {
+        return
+    }
+
+    dbSpec, err := db.GetDbInfoByInstanceId(r.Context(), r.PathParam("id"))
+    if err != nil && err != db.ErrNotFound {
+        osbError(w, http.StatusInternalServerError, "", err.Error())
+        return
+    }
+    if err != nil {
+        osbEmpty(w, http.StatusGone)
+        return
+    }
+
+    err = db.RemoveCredential(r.Context(), dbSpec.Name, osbCredentialName(r.PathParam("bid")))
+    if err == db.ErrNotFound {
+        osbEmpty(w, http.StatusGone)
+    } else if err != nil {
+        osbError(w, http.StatusInternalServerError, "", err.Error())
+    } else {
+        osbEmpty(w, http.StatusOK)
+    }
+}
+
+func osbLastOperationHandler(w rest.ResponseWriter, r *rest.Request) {
+    if !osbVersionOk(w, r) {
+        return
+    }
+
+    dbSpec, err := db.GetDbInfoByInstanceId(r.Context(), r.PathParam("id"))
+    if err != nil && err != db.ErrNotFound {
+        osbError(w, http.StatusInternalServerError, "", err.Error())
+        return
+    }
+    if err != nil || dbSpec.Status == model.StatusDeleted {
+        osbEmpty(w, http.StatusGone)
+        return
+    }
+
+    op := model.OSBLastOperation{
+        Description: dbSpec.Message,
+    }
+
+    switch dbSpec.Status {
+    case model.StatusProvisioning, model.StatusDeprovisioning, model.StatusUpdating:
+        op.State = "in progress"
+    case model.StatusFailed:
+        op.State = "failed"
+        op.Description = dbSpec.LastError
+    default:
+        op.State = "succeeded"
+    }
+
+    w.WriteJson(op)
+}
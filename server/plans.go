@@ -0,0 +1,98 @@
+package server
+
+/*
+ * Plan administration.  These routes change what every other broker user
+ * can provision, so they need the admin scope.
+ */
+
+import (
+    "net/http"
+
+    "mongodb-api/db"
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+func planError(w rest.ResponseWriter, err error) {
+    var errMsg model.MsgSpec
+
+    errMsg.Msg = err.Error()
+    switch err {
+    case db.ErrPlanNotFound:
+        w.WriteHeader(http.StatusNotFound)
+    case db.ErrPlanExists, db.ErrPlanInUse:
+        w.WriteHeader(http.StatusConflict)
+    default:
+        w.WriteHeader(errorStatus(err))
+    }
+    w.WriteJson(errMsg)
+}
+
+func createPlanHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+    var pSpec model.PlanSpec
+
+    err := r.DecodeJsonPayload(&pSpec)
+    if err != nil {
+        errMsg.Msg = "Invalid post data"
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    plan, err := db.CreatePlan(r.Context(), pSpec)
+    if err != nil {
+        planError(w, err)
+        return
+    }
+
+    log.Infof("created plan %s", plan.Name)
+    w.WriteHeader(http.StatusCreated)
+    w.WriteJson(plan)
+}
+
+func updatePlanHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+    var pSpec model.PlanSpec
+
+    err := r.DecodeJsonPayload(&pSpec)
+    if err != nil {
+        errMsg.Msg = "Invalid post data"
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    plan, err := db.UpdatePlan(r.Context(), r.PathParam("plan"), pSpec)
+    if err != nil {
+        planError(w, err)
+        return
+    }
+
+    log.Infof("updated plan %s", plan.Name)
+    w.WriteJson(plan)
+}
+
+func deletePlanHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+
+    name := r.PathParam("plan")
+
+    err := db.DeletePlan(r.Context(), name)
+    if err != nil {
+        planError(w, err)
+        return
+    }
+
+    log.Infof("deleted plan %s", name)
+    errMsg.Msg = "plan removed"
+    w.WriteJson(errMsg)
+}
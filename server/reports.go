@@ -0,0 +1,99 @@
+package server
+
+/*
+ * Reports built from the usage the broker records.  ?from= and ?to= take
+ * RFC3339 times and default to the current calendar month; ?format=csv
+ * returns one row per instance instead of JSON.
+ */
+
+import (
+    "encoding/csv"
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+
+    "mongodb-api/db"
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+func parseReportPeriod(r *rest.Request) (time.Time, time.Time, error) {
+    var err error
+
+    now := time.Now().UTC()
+    from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+    to := now
+
+    v := r.URL.Query()
+
+    if f := v.Get("from"); f != "" {
+        from, err = time.Parse(time.RFC3339, f)
+        if err != nil {
+            return from, to, errors.New("Invalid from " + f)
+        }
+    }
+    if t := v.Get("to"); t != "" {
+        to, err = time.Parse(time.RFC3339, t)
+        if err != nil {
+            return from, to, errors.New("Invalid to " + t)
+        }
+    }
+    if !from.Before(to) {
+        return from, to, errors.New("from must be before to")
+    }
+
+    return from, to, nil
+}
+
+func billingReportHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+
+    from, to, err := parseReportPeriod(r)
+    if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    reports, err := db.GetBillingReport(r.Context(), from, to)
+    if err != nil {
+        errMsg.Msg = "error building billing report"
+        w.WriteHeader(errorStatus(err))
+        w.WriteJson(errMsg)
+        return
+    }
+
+    if r.URL.Query().Get("format") != "csv" {
+        w.WriteJson(reports)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/csv")
+    w.Header().Set("Content-Disposition", "attachment; filename=\"billing.csv\"")
+    w.WriteHeader(http.StatusOK)
+
+    cw := csv.NewWriter(w.(http.ResponseWriter))
+    cw.Write([]string{"billingcode", "name", "plan", "usage", "instance_days"})
+    for _, report := range *reports {
+        for _, i := range report.Instances {
+            cw.Write([]string{
+                report.BillingCode,
+                i.Name,
+                i.Plan,
+                strconv.FormatInt(i.Usage, 10),
+                strconv.Itoa(i.InstanceDays),
+            })
+        }
+    }
+    cw.Flush()
+
+    if err := cw.Error(); err != nil {
+        log.Errorf("writing csv: %v", err)
+    }
+}
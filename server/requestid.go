@@ -0,0 +1,133 @@
+package server
+
+/*
+ * Request ids.  A caller may send its own X-Request-ID, otherwise one is
+ * made up.  It is returned on every response, added to every log line
+ * through the request context and put in the body of error responses.
+ */
+
+import (
+    "bufio"
+    "net"
+    "net/http"
+
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+    "github.com/nu7hatch/gouuid"
+)
+
+const (
+    requestIdHeader = "X-Request-ID"
+    requestIdEnv    = "REQUEST_ID"
+    maxRequestId    = 128
+)
+
+/*
+ * Ids from callers end up in logs and headers, so only plain ones are
+ * accepted.
+ */
+func validRequestId(id string) bool {
+    if id == "" || len(id) > maxRequestId {
+        return false
+    }
+    for _, c := range id {
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+        case c == '-', c == '_', c == '.', c == ':':
+        default:
+            return false
+        }
+    }
+    return true
+}
+
+func newRequestId() string {
+    id, err := uuid.NewV4()
+    if err != nil {
+        log.Errorf("generating request id: %s", err)
+        return "unknown"
+    }
+    return id.String()
+}
+
+/*
+ * requestIdMiddleware goes first so that every response, including those
+ * refused by other middleware, carries the id.
+ */
+type requestIdMiddleware struct{}
+
+func (mw *requestIdMiddleware) MiddlewareFunc(h rest.HandlerFunc) rest.HandlerFunc {
+    return func(w rest.ResponseWriter, r *rest.Request) {
+        id := r.Header.Get(requestIdHeader)
+        if !validRequestId(id) {
+            id = newRequestId()
+        }
+
+        r.Env[requestIdEnv] = id
+        r.Request = r.Request.WithContext(logger.WithRequestId(r.Context(), id))
+        w.Header().Set(requestIdHeader, id)
+
+        h(w, r)
+    }
+}
+
+/*
+ * errorBodyMiddleware goes last, next to the handlers, because each
+ * middleware writer encodes JSON itself and the bodies have to be changed
+ * before that.
+ */
+type errorBodyMiddleware struct{}
+
+func (mw *errorBodyMiddleware) MiddlewareFunc(h rest.HandlerFunc) rest.HandlerFunc {
+    return func(w rest.ResponseWriter, r *rest.Request) {
+        id, _ := r.Env[requestIdEnv].(string)
+        h(&requestIdWriter{ResponseWriter: w, id: id}, r)
+    }
+}
+
+type requestIdWriter struct {
+    rest.ResponseWriter
+    id string
+}
+
+func (w *requestIdWriter) WriteJson(v interface{}) error {
+    switch m := v.(type) {
+    case model.MsgSpec:
+        m.RequestId = w.id
+        v = m
+    case *model.MsgSpec:
+        c := *m
+        c.RequestId = w.id
+        v = &c
+    case model.OSBError:
+        m.RequestId = w.id
+        v = m
+    case map[string]string:
+        if _, ok := m["Error"]; ok {
+            c := map[string]string{"RequestId": w.id}
+            for k, s := range m {
+                c[k] = s
+            }
+            v = c
+        }
+    }
+    return w.ResponseWriter.WriteJson(v)
+}
+
+func (w *requestIdWriter) Write(b []byte) (int, error) {
+    return w.ResponseWriter.(http.ResponseWriter).Write(b)
+}
+
+func (w *requestIdWriter) Flush() {
+    w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (w *requestIdWriter) CloseNotify() <-chan bool {
+    return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func (w *requestIdWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    return w.ResponseWriter.(http.Hijacker).Hijack()
+}
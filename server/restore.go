@@ -0,0 +1,71 @@
+package server
+
+/*
+ * Restore routes.  Restores run in the background, the returned record
+ * is polled through the restores route.
+ */
+
+import (
+    "net/http"
+
+    "mongodb-api/db"
+    "mongodb-api/logger"
+    "mongodb-api/model"
+
+    "github.com/ant0ine/go-json-rest/rest"
+)
+
+func restoreBackupHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+    var in model.RestoreRequest
+
+    dbName := r.PathParam("name")
+    id := r.PathParam("backup")
+
+    err := r.DecodeJsonPayload(&in)
+    if err != nil && err != rest.ErrJsonPayloadEmpty {
+        errMsg.Msg = "Invalid post data"
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    if _, err = db.GetBackup(r.Context(), dbName, id); err != nil {
+        errMsg.Msg = "error finding backup " + id
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    rSpec, err := db.RestoreBackup(r.Context(), dbName, id, in)
+    if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(errorStatus(err))
+        w.WriteJson(errMsg)
+        return
+    }
+
+    log.Infof("restore %s of %s into %s", rSpec.Id, dbName, rSpec.Target)
+    w.Header().Set("Location", "/v1/mongodb/"+rSpec.Target+"/restores/"+rSpec.Id)
+    w.WriteHeader(http.StatusAccepted)
+    w.WriteJson(rSpec)
+}
+
+func restoreStatusHandler(w rest.ResponseWriter, r *rest.Request) {
+    var errMsg model.MsgSpec
+
+    dbName := r.PathParam("name")
+    id := r.PathParam("restore")
+
+    rSpec, err := db.GetRestore(r.Context(), dbName, id)
+    if err != nil {
+        errMsg.Msg = "error finding restore " + id
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    w.WriteJson(rSpec)
+}
@@ -3,6 +3,7 @@ package server
 import (
     "fmt"
     "net/http"
+    "time"
 
     "mongodb-api/db"
     "mongodb-api/logger"
@@ -21,22 +22,24 @@ var (
     log = logger.Log
 )
 
-func octhc(w rest.ResponseWriter, _ *rest.Request) {
+func octhc(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
     var o Octhc
 
     o.Code = http.StatusInternalServerError
     o.OverallStatus = "bad"
 
-    bi, err := db.DbStatus()
+    bi, err := db.DbStatus(r.Context())
 
     if err != nil {
         w.WriteHeader(http.StatusInternalServerError)
-        log.Printf("Octhc: %+v\n", o)
+        log.Debugf("Octhc: %+v", o)
     } else {
         o.MongoVersion = bi.Version
         o.Code = http.StatusOK
         o.OverallStatus = "good"
-        log.Printf("Octhc: %+v\n", o)
+        log.Debugf("Octhc: %+v", o)
     }
     w.WriteJson(o)
 }
@@ -48,14 +51,14 @@ func notSupported(w rest.ResponseWriter, _ *rest.Request) {
     w.WriteJson(message)
 }
 
-func plansHandler(w rest.ResponseWriter, _ *rest.Request) {
+func plansHandler(w rest.ResponseWriter, r *rest.Request) {
     var err error
     var plans *[]model.PlanSpec
     var errMsg model.MsgSpec
 
     retPlans := make(map[string]interface{})
 
-    plans, err = db.GetPlans()
+    plans, err = db.GetPlans(r.Context())
 
     if err != nil || plans == nil {
         errMsg.Msg = "Error getting plans list"
@@ -69,6 +72,24 @@ func plansHandler(w rest.ResponseWriter, _ *rest.Request) {
     }
 }
 
+/*
+ * Requests rejected up front are the caller's problem, failures after the
+ * server was changed are ours.
+ */
+func errorStatus(err error) int {
+    if _, ok := err.(*db.OpError); ok {
+        return http.StatusInternalServerError
+    }
+    if err == db.ErrIdempotencyConflict || err == db.ErrConcurrentRotation || err == db.ErrLabelsChanged ||
+        err == db.ErrInstanceBusy {
+        return http.StatusConflict
+    }
+    if err == db.ErrNoBackupStore {
+        return http.StatusServiceUnavailable
+    }
+    return http.StatusBadRequest
+}
+
 func fmtDatabaseUrl(dbSpec *model.DatabaseSpec) string {
     return fmt.Sprintf("mongodb://%s:%s@%s:%s/%s?ssl=true",
         dbSpec.Username,
@@ -83,22 +104,39 @@ func copyDbToFullDb(dbSpec *model.DatabaseSpec, fDbSpec *model.FullDatabaseSpec)
     fDbSpec.Username = dbSpec.Username
     fDbSpec.Password = dbSpec.Password
     fDbSpec.Created = dbSpec.Created
+    fDbSpec.Cluster = dbSpec.Cluster
     fDbSpec.Host = dbSpec.Host
     fDbSpec.Port = dbSpec.Port
     fDbSpec.Plan = dbSpec.Plan
     fDbSpec.BillingCode = dbSpec.BillingCode
     fDbSpec.Misc = dbSpec.Misc
+    fDbSpec.InstanceId = dbSpec.InstanceId
+    fDbSpec.Status = dbSpec.Status
+    fDbSpec.Message = dbSpec.Message
+    fDbSpec.LastError = dbSpec.LastError
+    fDbSpec.Updated = dbSpec.Updated
+    fDbSpec.RetiredUsers = dbSpec.RetiredUsers
+    fDbSpec.Usage = dbSpec.Usage
+    fDbSpec.UsageChecked = dbSpec.UsageChecked
+    fDbSpec.OverQuota = dbSpec.OverQuota
+    fDbSpec.WriteRevoked = dbSpec.WriteRevoked
+    fDbSpec.LastRequestId = dbSpec.LastRequestId
+    fDbSpec.Labels = dbSpec.Labels
+    fDbSpec.PurgeAfter = dbSpec.PurgeAfter
+    fDbSpec.IdempotencyKey = dbSpec.IdempotencyKey
     fDbSpec.Url = fmtDatabaseUrl(dbSpec)
 }
 
 func provisionHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
     var errMsg model.MsgSpec
     var pSpec model.ProvisionSpec
     var dbSpec *model.DatabaseSpec
     var fDbSpec model.FullDatabaseSpec
     var err error
 
-    log.Printf("(provisionHandler) body %+v", r.Body)
+    log.Debugf("body %+v", r.Body)
     err = r.DecodeJsonPayload(&pSpec)
     if err != nil {
         msg := model.MsgSpec{
@@ -106,23 +144,83 @@ func provisionHandler(w rest.ResponseWriter, r *rest.Request) {
         }
         w.WriteHeader(http.StatusBadRequest)
         w.WriteJson(msg)
+    } else if err = idempotencyKey(r, &pSpec); err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+    } else if r.URL.Query().Get("async") == "true" {
+
+        dbSpec, err = db.ProvisionAsync(r.Context(), pSpec)
+
+        if err != nil {
+            errMsg.Msg = string(err.Error())
+            w.WriteHeader(errorStatus(err))
+            w.WriteJson(errMsg)
+        } else if msg := replayFailed(dbSpec); msg != "" {
+            errMsg.Msg = msg
+            replayed(w, dbSpec)
+            w.WriteHeader(http.StatusConflict)
+            w.WriteJson(errMsg)
+        } else {
+            copyDbToFullDb(dbSpec, &fDbSpec)
+            replayed(w, dbSpec)
+            w.Header().Set("Location", "/v1/mongodb/instance/"+dbSpec.Name+"/status")
+            w.WriteHeader(http.StatusAccepted)
+            w.WriteJson(fDbSpec)
+        }
     } else {
 
-        dbSpec, err = db.Provision(pSpec)
+        dbSpec, err = db.Provision(r.Context(), pSpec)
 
         if err != nil {
             errMsg.Msg = string(err.Error())
-            w.WriteHeader(http.StatusBadRequest)
+            w.WriteHeader(errorStatus(err))
+            w.WriteJson(errMsg)
+        } else if msg := replayFailed(dbSpec); msg != "" {
+            errMsg.Msg = msg
+            replayed(w, dbSpec)
+            w.WriteHeader(http.StatusConflict)
             w.WriteJson(errMsg)
+        } else if dbSpec.Replayed && dbSpec.Status == model.StatusProvisioning {
+            /*
+             * The first request has not finished, the retry is told where
+             * to follow it as an asynchronous provision would be.
+             */
+            copyDbToFullDb(dbSpec, &fDbSpec)
+            replayed(w, dbSpec)
+            w.Header().Set("Location", "/v1/mongodb/instance/"+dbSpec.Name+"/status")
+            w.WriteHeader(http.StatusAccepted)
+            w.WriteJson(fDbSpec)
         } else {
             copyDbToFullDb(dbSpec, &fDbSpec)
+            replayed(w, dbSpec)
             w.WriteHeader(http.StatusCreated)
             w.WriteJson(fDbSpec)
         }
     }
 }
 
+func statusHandler(w rest.ResponseWriter, r *rest.Request) {
+    var errMsg model.MsgSpec
+    var sSpec *model.StatusSpec
+    var err error
+    var dbName string
+
+    dbName = r.PathParam("name")
+
+    sSpec, err = db.GetDbStatus(r.Context(), dbName)
+    if err != nil {
+        errMsg.Msg = "error finding " + dbName
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+    } else {
+        w.WriteJson(sSpec)
+    }
+}
+
 func dbInfoHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
     var errMsg model.MsgSpec
     var dbSpec *model.DatabaseSpec
     var fDbSpec model.FullDatabaseSpec
@@ -130,21 +228,24 @@ func dbInfoHandler(w rest.ResponseWriter, r *rest.Request) {
     var dbName string
 
     dbName = r.PathParam("name")
-    log.Printf("(server.dbInfoHandler) get %s\n", dbName)
+    log.Debugf("get %s", dbName)
 
-    dbSpec, err = db.GetDbInfo(dbName)
+    dbSpec, err = db.GetDbInfo(r.Context(), dbName)
     if err != nil {
         errMsg.Msg = "error finding " + dbName
         w.WriteHeader(http.StatusBadRequest)
         w.WriteJson(errMsg)
     } else {
-        log.Printf("(server.dbInfoHandler): get %s\n", dbSpec.Name)
+        log.Debugf("get %s", dbSpec.Name)
         copyDbToFullDb(dbSpec, &fDbSpec)
+        hideCredentials(r, &fDbSpec)
         w.WriteJson(fDbSpec)
     }
 }
 
 func urlHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
     var errMsg model.MsgSpec
     var dbSpec *model.DatabaseSpec
     var dbUrl model.DBUrl
@@ -153,64 +254,157 @@ func urlHandler(w rest.ResponseWriter, r *rest.Request) {
 
     dbName = r.PathParam("name")
 
-    dbSpec, err = db.GetDbInfo(dbName)
+    if !canSeeCredentials(r) {
+        errMsg.Msg = "API key does not have the " + model.ScopeProvision + " scope"
+        w.WriteHeader(http.StatusForbidden)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    dbSpec, err = db.GetDbInfo(r.Context(), dbName)
     if err != nil {
         errMsg.Msg = "error finding " + dbName
         w.WriteHeader(http.StatusBadRequest)
         w.WriteJson(errMsg)
     } else {
-        log.Printf("dbInfoHandler: get %s\n", dbSpec.Name)
+        log.Debugf("get %s", dbSpec.Name)
         dbUrl.Url = fmtDatabaseUrl(dbSpec)
         w.WriteJson(dbUrl)
     }
 }
 
-func deleteDbHandler(w rest.ResponseWriter, r *rest.Request) {
+func rotateHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
     var errMsg model.MsgSpec
+    var dbSpec *model.DatabaseSpec
+    var fDbSpec model.FullDatabaseSpec
+    var grace time.Duration
     var err error
     var dbName string
 
     dbName = r.PathParam("name")
 
-    err = db.RemoveDb(dbName)
+    if g := r.URL.Query().Get("grace"); g != "" {
+        grace, err = time.ParseDuration(g)
+        if err != nil || grace <= 0 {
+            errMsg.Msg = "Invalid grace period " + g
+            w.WriteHeader(http.StatusBadRequest)
+            w.WriteJson(errMsg)
+            return
+        }
+    }
+
+    dbSpec, err = db.RotateCredentials(r.Context(), dbName, grace)
     if err != nil {
-        errMsg.Msg = "error removing " + dbName
-        w.WriteHeader(http.StatusInternalServerError)
+        errMsg.Msg = err.Error()
+        w.WriteHeader(errorStatus(err))
         w.WriteJson(errMsg)
     } else {
-        errMsg.Msg = "database/user removed"
-        log.Printf("(deleteDHandler): removed %s\n", dbName)
+        log.Infof("rotated %s", dbName)
+        copyDbToFullDb(dbSpec, &fDbSpec)
+        w.WriteJson(fDbSpec)
+    }
+}
+
+func changePlanHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+    var cSpec model.PlanChangeSpec
+    var fDbSpec model.FullDatabaseSpec
+
+    dbName := r.PathParam("name")
+
+    err := r.DecodeJsonPayload(&cSpec)
+    if err != nil {
+        errMsg.Msg = "Invalid post data"
+        w.WriteHeader(http.StatusBadRequest)
+        w.WriteJson(errMsg)
+        return
+    }
+
+    if _, err = db.GetDbInfo(r.Context(), dbName); err != nil {
+        errMsg.Msg = "error finding " + dbName
+        w.WriteHeader(http.StatusNotFound)
         w.WriteJson(errMsg)
+        return
     }
+
+    dbSpec, err := db.ChangePlan(r.Context(), dbName, cSpec.Plan)
+    if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(errorStatus(err))
+        w.WriteJson(errMsg)
+        return
+    }
+
+    log.Infof("%s on plan %s", dbName, dbSpec.Plan)
+    copyDbToFullDb(dbSpec, &fDbSpec)
+    w.WriteJson(fDbSpec)
 }
 
-func getAllDbHandler(w rest.ResponseWriter, _ *rest.Request) {
+func deleteDbHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
     var errMsg model.MsgSpec
     var err error
-    var dbList *[]model.DatabaseSpec
-    var fDbList []model.FullDatabaseSpec
+    var dbName string
 
-    log.Printf("(server.getAllDbHandler) type of dbList %T", dbList)
-    log.Printf("(server.getAllDbHandler) type of fDbList %T", fDbList)
-    dbList, err = db.GetDbList()
-    log.Printf("(server.getAllDbHandler) type of &dbList %T", *dbList)
+    dbName = r.PathParam("name")
 
-    if err != nil {
-        errMsg.Msg = "error getting list of dbs "
+    err = db.RemoveDb(r.Context(), dbName)
+    if _, ok := err.(*db.OpError); ok {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(http.StatusInternalServerError)
+        w.WriteJson(errMsg)
+    } else if err == db.ErrDeleted {
+        errMsg.Msg = dbName + " is already deleted"
+        w.WriteHeader(http.StatusGone)
+        w.WriteJson(errMsg)
+    } else if err == db.ErrNotFound {
+        errMsg.Msg = "error finding " + dbName
+        w.WriteHeader(http.StatusNotFound)
+        w.WriteJson(errMsg)
+    } else if err != nil {
+        log.Errorf("removing %s: %s", dbName, err)
+        errMsg.Msg = err.Error()
         w.WriteHeader(http.StatusInternalServerError)
         w.WriteJson(errMsg)
     } else {
-        //log.Printf("(server.getAllDbHandler) db list %+v", *dbList)
-        log.Printf("(server.getAllDbHandler) db list cnt %d", len(*dbList))
-
-        for _, d := range *dbList {
-            f := model.FullDatabaseSpec{}
-            copyDbToFullDb(&d, &f)
-            fDbList = append(fDbList, f)
+        errMsg.Msg = "database/user removed"
+        if dbSpec, err := db.GetDbInfo(r.Context(), dbName); err == nil {
+            errMsg.Msg = dbSpec.Message
         }
+        log.Infof("removed %s", dbName)
+        w.WriteJson(errMsg)
+    }
+}
 
-        w.WriteJson(fDbList)
+func undeleteHandler(w rest.ResponseWriter, r *rest.Request) {
+    log := logger.FromContext(r.Context())
+
+    var errMsg model.MsgSpec
+    var fDbSpec model.FullDatabaseSpec
+
+    dbName := r.PathParam("name")
+
+    if !instanceFound(w, r, dbName) {
+        return
     }
+
+    dbSpec, err := db.Undelete(r.Context(), dbName)
+    if err != nil {
+        errMsg.Msg = err.Error()
+        w.WriteHeader(errorStatus(err))
+        w.WriteJson(errMsg)
+        return
+    }
+
+    log.Infof("undeleted %s", dbName)
+    copyDbToFullDb(dbSpec, &fDbSpec)
+    hideCredentials(r, &fDbSpec)
+    w.WriteJson(fDbSpec)
 }
 
 func ping(w rest.ResponseWriter, _ *rest.Request) {
@@ -222,33 +416,38 @@ func Server(runtime string) *rest.Api {
     var api *rest.Api
     var r rest.App
     var mwDev = []rest.Middleware{
-        &rest.AccessLogApacheMiddleware{
-            Logger: logger.Log,
-            Format: "%S\033[0m %Dμs \"%r\" \"%{User-Agent}i\"\033[0m",
-        },
+        &requestIdMiddleware{},
+        &accessLogMiddleware{},
+        &metricsMiddleware{},
         &rest.TimerMiddleware{},
         &rest.RecorderMiddleware{},
         &rest.PoweredByMiddleware{},
         &rest.RecoverMiddleware{
+            Logger:                   log.StdLogger(logger.LevelError),
             EnableResponseStackTrace: true,
         },
         &rest.JsonIndentMiddleware{},
         &rest.ContentTypeCheckerMiddleware{},
+        &errorBodyMiddleware{},
     }
     var mwProd = []rest.Middleware{
-        &rest.AccessLogApacheMiddleware{
-            Logger: logger.Log,
-            Format: "%h %u %s \"%r\" %b \"%{Referer}i\" \"%{User-Agent}i\"",
-        },
+        &requestIdMiddleware{},
+        &accessLogMiddleware{},
+        &metricsMiddleware{},
         &rest.TimerMiddleware{},
         &rest.RecorderMiddleware{},
         &rest.PoweredByMiddleware{},
-        &rest.RecoverMiddleware{},
+        &rest.RecoverMiddleware{
+            Logger: log.StdLogger(logger.LevelError),
+        },
         &rest.GzipMiddleware{},
         &rest.ContentTypeCheckerMiddleware{},
+        &errorBodyMiddleware{},
     }
 
-    log.Println("(server.Server) new api")
+    log.Infof("new api")
+
+    setAdminKey()
 
     api = rest.NewApi()
 
@@ -258,34 +457,66 @@ func Server(runtime string) *rest.Api {
         api.Use(mwDev...)
     }
 
-    log.Println("(server.server) setup routing")
-    r, err := rest.MakeRouter(
+    log.Infof("setup routing")
+    r, err := rest.MakeRouter(routeNames(
         rest.Get("/", notSupported),
         rest.Get("/ping", ping),
         rest.Get("/octhc", octhc),
-
-        rest.Get("/v1/mongodb/plans", plansHandler),
-
-        rest.Post("/v1/mongodb/instance", provisionHandler),
-        rest.Get("/v1/mongodb/instance/:name", dbInfoHandler),
-        rest.Delete("/v1/mongodb/instance/:name", deleteDbHandler),
-        rest.Get("/v1/mongodb/url/:name", urlHandler),
-
-        rest.Get("/v1/mongodb", getAllDbHandler),
-        rest.Get("/v1/mongodb/:name", dbInfoHandler),
-
-        rest.Get("/v1/mongodb/:name/backups", notSupported),
-        rest.Put("/v1/mongodb/:name/backups", notSupported),
-        rest.Get("/v1/mongodb/:name/backups/:backup", notSupported),
-        rest.Get("/v1/mongodb/:name/logs", notSupported),
-        rest.Get("/v1/mongodb/:name/logs/:dir/:file", notSupported),
-        rest.Put("/v1/mongodb/:name", notSupported),
-    )
-
-    log.Println("(server.Server) routes configured")
+        rest.Get("/metrics", requireScope(model.ScopeReadInventory, metricsHandler)),
+
+        rest.Get("/v1/mongodb/plans", requireScope(model.ScopeReadInventory, plansHandler)),
+        rest.Post("/v1/mongodb/plans", requireScope(model.ScopeAdmin, createPlanHandler)),
+        rest.Put("/v1/mongodb/plans/:plan", requireScope(model.ScopeAdmin, updatePlanHandler)),
+        rest.Delete("/v1/mongodb/plans/:plan", requireScope(model.ScopeAdmin, deletePlanHandler)),
+
+        rest.Get("/v1/mongodb/apikeys", requireScope(model.ScopeAdmin, listApiKeysHandler)),
+        rest.Post("/v1/mongodb/apikeys", requireScope(model.ScopeAdmin, createApiKeyHandler)),
+        rest.Delete("/v1/mongodb/apikeys/:id", requireScope(model.ScopeAdmin, deleteApiKeyHandler)),
+
+        rest.Get("/v1/mongodb/reports/billing", requireScope(model.ScopeReadInventory, billingReportHandler)),
+
+        rest.Get("/v1/mongodb/admin/loglevel", requireScope(model.ScopeAdmin, getLogLevelHandler)),
+        rest.Put("/v1/mongodb/admin/loglevel", requireScope(model.ScopeAdmin, setLogLevelHandler)),
+        rest.Get("/v1/mongodb/admin/drift", requireScope(model.ScopeAdmin, driftHandler)),
+        rest.Post("/v1/mongodb/admin/drift/repair", requireScope(model.ScopeAdmin, repairDriftHandler)),
+
+        rest.Post("/v1/mongodb/instance", requireScope(model.ScopeProvision, provisionHandler)),
+        rest.Get("/v1/mongodb/instance/:name", requireScope(model.ScopeReadInventory, dbInfoHandler)),
+        rest.Get("/v1/mongodb/instance/:name/status", requireScope(model.ScopeReadInventory, statusHandler)),
+        rest.Post("/v1/mongodb/instance/:name/rotate", requireScope(model.ScopeProvision, rotateHandler)),
+        rest.Post("/v1/mongodb/instance/:name/credentials", requireScope(model.ScopeProvision, addCredentialHandler)),
+        rest.Get("/v1/mongodb/instance/:name/credentials", requireScope(model.ScopeReadInventory, listCredentialsHandler)),
+        rest.Delete("/v1/mongodb/instance/:name/credentials/:cred", requireScope(model.ScopeDelete, deleteCredentialHandler)),
+        rest.Post("/v1/mongodb/instance/:name/labels", requireScope(model.ScopeProvision, setLabelsHandler)),
+        rest.Delete("/v1/mongodb/instance/:name/labels/:label", requireScope(model.ScopeProvision, removeLabelHandler)),
+        rest.Delete("/v1/mongodb/instance/:name", requireScope(model.ScopeDelete, deleteDbHandler)),
+        rest.Post("/v1/mongodb/instance/:name/undelete", requireScope(model.ScopeDelete, undeleteHandler)),
+        rest.Get("/v1/mongodb/url/:name", requireScope(model.ScopeReadInventory, urlHandler)),
+
+        rest.Get("/v1/mongodb", requireScope(model.ScopeReadInventory, getAllDbHandler)),
+        rest.Get("/v1/mongodb/:name", requireScope(model.ScopeReadInventory, dbInfoHandler)),
+
+        rest.Get("/v1/mongodb/:name/backups", requireScope(model.ScopeReadInventory, listBackupsHandler)),
+        rest.Put("/v1/mongodb/:name/backups", requireScope(model.ScopeProvision, createBackupHandler)),
+        rest.Get("/v1/mongodb/:name/backups/:backup", requireScope(model.ScopeProvision, getBackupHandler)),
+        rest.Post("/v1/mongodb/:name/backups/:backup/restore", requireScope(model.ScopeProvision, restoreBackupHandler)),
+        rest.Get("/v1/mongodb/:name/restores/:restore", requireScope(model.ScopeReadInventory, restoreStatusHandler)),
+        rest.Get("/v1/mongodb/:name/logs", requireScope(model.ScopeProvision, logsHandler)),
+        rest.Get("/v1/mongodb/:name/logs/:dir/:file", requireScope(model.ScopeProvision, logFileHandler)),
+        rest.Put("/v1/mongodb/:name", requireScope(model.ScopeProvision, changePlanHandler)),
+
+        rest.Get("/v2/catalog", requireScope(model.ScopeReadInventory, osbCatalogHandler)),
+        rest.Put("/v2/service_instances/:id", requireScope(model.ScopeProvision, osbProvisionHandler)),
+        rest.Delete("/v2/service_instances/:id", requireScope(model.ScopeDelete, osbDeprovisionHandler)),
+        rest.Get("/v2/service_instances/:id/last_operation", requireScope(model.ScopeReadInventory, osbLastOperationHandler)),
+        rest.Put("/v2/service_instances/:id/service_bindings/:bid", requireScope(model.ScopeProvision, osbBindHandler)),
+        rest.Delete("/v2/service_instances/:id/service_bindings/:bid", requireScope(model.ScopeDelete, osbUnbindHandler)),
+    )...)
+
+    log.Infof("routes configured")
 
     if err != nil {
-        log.Fatal(err)
+        log.Fatalf("%v", err)
     }
 
     api.SetApp(r)
@@ -2,22 +2,30 @@ package server
 
 import (
     "bytes"
+    "context"
     "encoding/json"
+    "fmt"
     "io/ioutil"
     "net/http"
     "net/http/httptest"
+    "os"
     "testing"
+    "time"
 
     "mongodb-api/db"
     "mongodb-api/model"
 
     "github.com/ant0ine/go-json-rest/rest"
     . "github.com/smartystreets/goconvey/convey"
+    "gopkg.in/mgo.v2/bson"
 )
 
 const (
     tURL = "http://1.2.3.4"
     v1 = "/v1/mongodb"
+    v2 = "/v2"
+    osbVersion = "2.13"
+    testAdminKey = "test-admin-key"
     )
 
 func TestServer(t *testing.T) {
@@ -27,6 +35,7 @@ func TestServer(t *testing.T) {
 
     log.SetPrefix("[TestServer] ")
 
+    os.Setenv("BROKER_ADMIN_KEY", testAdminKey)
     a = Server("development")
     h := a.MakeHandler()
 
@@ -43,7 +52,7 @@ func TestServer(t *testing.T) {
         req := httptest.NewRequest(http.MethodGet, tURL+"/ping", nil)
         rec := httptest.NewRecorder()
         h.ServeHTTP(rec, req)
-        log.Printf("ping %+v\n", rec.Body)
+        log.Infof("ping %+v", rec.Body)
         body, _ := ioutil.ReadAll(rec.Body)
 
         Convey("should return pong", func() {
@@ -60,8 +69,8 @@ func TestServer(t *testing.T) {
         h.ServeHTTP(rec, req)
         json.NewDecoder(rec.Body).Decode(&o)
 
-        log.Printf("octhc rec.Body: %+v\n", rec.Body)
-        log.Printf("octhc body: %+v\n", o)
+        log.Infof("octhc rec.Body: %+v", rec.Body)
+        log.Infof("octhc body: %+v", o)
 
         Convey("Should get healthy response", func() {
             So(rec.Code, ShouldEqual, http.StatusOK)
@@ -75,9 +84,9 @@ func TestServer(t *testing.T) {
         req := httptest.NewRequest("GET", tURL+"/", nil)
         rec := httptest.NewRecorder()
         h.ServeHTTP(rec, req)
-        log.Printf("get / w.Body: %+v\n", rec.Body)
+        log.Infof("get / w.Body: %+v", rec.Body)
         json.NewDecoder(rec.Body).Decode(&ns)
-        log.Printf("get / body: %+v\n", ns)
+        log.Infof("get / body: %+v", ns)
 
         Convey("Should be not supported", func() {
             So(rec.Code, ShouldEqual, http.StatusNotImplemented)
@@ -85,15 +94,206 @@ func TestServer(t *testing.T) {
         })
     })
 
+    Convey("On request ids", t, func() {
+        Convey("Should return the id sent by the caller", func() {
+            req := httptest.NewRequest(http.MethodGet, tURL+"/ping", nil)
+            req.Header.Set("X-Request-ID", "test-req-1")
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Header().Get("X-Request-ID"), ShouldEqual, "test-req-1")
+        })
+        Convey("Should make one up when none or a bad one is sent", func() {
+            req := httptest.NewRequest(http.MethodGet, tURL+"/ping", nil)
+            req.Header.Set("X-Request-ID", "bad id\n")
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Header().Get("X-Request-ID"), ShouldNotBeBlank)
+            So(rec.Header().Get("X-Request-ID"), ShouldNotEqual, "bad id\n")
+        })
+        Convey("Should put the id in error bodies", func() {
+            var errMsg model.MsgSpec
+
+            req := httptest.NewRequest(http.MethodGet, tURL+v1+"/plans", nil)
+            req.Header.Set("X-Request-ID", "test-req-2")
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&errMsg)
+            So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+            So(errMsg.RequestId, ShouldEqual, "test-req-2")
+        })
+        Convey("Should record the id of the request that provisioned", func() {
+            var pSpec model.FullDatabaseSpec
+            var sSpec model.StatusSpec
+
+            jTestDb, _ := json.Marshal(model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+            req := httptest.NewRequest(http.MethodPost, tURL+v1+"/instance", bytes.NewBuffer(jTestDb))
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("X-Request-ID", "test-req-3")
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&pSpec)
+            So(rec.Code, ShouldEqual, http.StatusCreated)
+
+            req = httptest.NewRequest(http.MethodGet, tURL+v1+"/instance/"+pSpec.Name+"/status", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&sSpec)
+            So(sSpec.LastRequestId, ShouldEqual, "test-req-3")
+
+            So(db.RemoveDb(context.Background(), pSpec.Name), ShouldBeNil)
+        })
+
+        Convey("Should replay a provision with the same idempotency key", func() {
+            var first, again model.FullDatabaseSpec
+            key := fmt.Sprintf("test-key-%d", time.Now().UnixNano())
+
+            body, _ := json.Marshal(model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+            req := httptest.NewRequest(http.MethodPost, tURL+v1+"/instance", bytes.NewBuffer(body))
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Idempotency-Key", key)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&first)
+            So(rec.Code, ShouldEqual, http.StatusCreated)
+            So(rec.Header().Get("Idempotent-Replayed"), ShouldEqual, "")
+
+            req = httptest.NewRequest(http.MethodPost, tURL+v1+"/instance", bytes.NewBuffer(body))
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Idempotency-Key", key)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&again)
+            So(rec.Code, ShouldEqual, http.StatusCreated)
+            So(rec.Header().Get("Idempotent-Replayed"), ShouldEqual, "true")
+            So(again.Name, ShouldEqual, first.Name)
+            So(again.Url, ShouldEqual, first.Url)
+
+            body, _ = json.Marshal(model.ProvisionSpec{Plan: "ha", BillingCode: "testOps"})
+            req = httptest.NewRequest(http.MethodPost, tURL+v1+"/instance", bytes.NewBuffer(body))
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Idempotency-Key", key)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusConflict)
+
+            err := db.Session.DB("broker").C("provision").Update(bson.M{"name": first.Name}, bson.M{
+                "$set": bson.M{"status": model.StatusFailed, "lasterror": "user refused"},
+            })
+            So(err, ShouldBeNil)
+
+            body, _ = json.Marshal(model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+            req = httptest.NewRequest(http.MethodPost, tURL+v1+"/instance", bytes.NewBuffer(body))
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Idempotency-Key", key)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusConflict)
+            So(rec.Body.String(), ShouldContainSubstring, "user refused")
+
+            So(db.RemoveDb(context.Background(), first.Name), ShouldBeNil)
+        })
+
+        Convey("Should delete, undelete and delete again", func() {
+            var uDB model.FullDatabaseSpec
+
+            pSpec, err := db.Provision(context.Background(), model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+            So(err, ShouldBeNil)
+
+            req := httptest.NewRequest(http.MethodDelete, tURL+v1+"/instance/"+pSpec.Name, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+
+            req = httptest.NewRequest(http.MethodPost, tURL+v1+"/instance/"+pSpec.Name+"/undelete", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&uDB)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(uDB.Status, ShouldEqual, model.StatusActive)
+
+            req = httptest.NewRequest(http.MethodPost, tURL+v1+"/instance/"+pSpec.Name+"/undelete", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusBadRequest)
+
+            req = httptest.NewRequest(http.MethodDelete, tURL+v1+"/instance/"+pSpec.Name, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+
+            req = httptest.NewRequest(http.MethodDelete, tURL+v1+"/instance/"+pSpec.Name, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusGone)
+        })
+    })
+
+    Convey("On request for metrics", t, func() {
+        req := httptest.NewRequest(http.MethodGet, tURL+"/ping", nil)
+        h.ServeHTTP(httptest.NewRecorder(), req)
+
+        req = httptest.NewRequest(http.MethodGet, tURL+"/metrics", nil)
+        req.Header.Set("Authorization", "Bearer "+testAdminKey)
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+
+        Convey("Should count requests by route", func() {
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(rec.Header().Get("Content-Type"), ShouldStartWith, "text/plain")
+            So(rec.Body.String(), ShouldContainSubstring, `mongodb_api_http_requests_total{method="GET",route="/ping",status="200"}`)
+            So(rec.Body.String(), ShouldContainSubstring, `mongodb_api_http_request_duration_seconds_bucket{method="GET",route="/ping",le="+Inf"}`)
+        })
+        Convey("Should report the backend", func() {
+            So(rec.Body.String(), ShouldContainSubstring, `mongodb_api_backend_up{cluster="default"} 1`)
+            So(rec.Body.String(), ShouldContainSubstring, "# TYPE mongodb_api_instances gauge")
+            So(rec.Body.String(), ShouldContainSubstring, "# TYPE mongodb_api_mgo_sockets_alive gauge")
+            So(rec.Body.String(), ShouldContainSubstring, "# TYPE mongodb_api_provisions_total counter")
+        })
+        Convey("Should need a key", func() {
+            req := httptest.NewRequest(http.MethodGet, tURL+"/metrics", nil)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+        })
+    })
+
+    Convey("On request for the drift report", t, func() {
+        var report model.DriftSpec
+
+        req := httptest.NewRequest(http.MethodGet, tURL+v1+"/admin/drift", nil)
+        req.Header.Set("Authorization", "Bearer "+testAdminKey)
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        json.NewDecoder(rec.Body).Decode(&report)
+
+        Convey("Should report without repairing", func() {
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(report.Repair, ShouldBeFalse)
+            So(report.OrphanDatabases, ShouldNotBeNil)
+        })
+    })
+
     Convey("On request for plans list", t, func() {
         ps := make(map[string]interface{})
 
         req := httptest.NewRequest(http.MethodGet, tURL+v1+"/plans", nil)
+        req.Header.Set("Authorization", "Bearer "+testAdminKey)
         rec := httptest.NewRecorder()
         h.ServeHTTP(rec, req)
-        log.Printf("plans w.Body: %+v\n", rec.Body)
+        log.Infof("plans w.Body: %+v", rec.Body)
         json.NewDecoder(rec.Body).Decode(&ps)
-        log.Printf("plans list body: %+v\n ", ps)
+        log.Infof("plans list body: %+v", ps)
 
         Convey("Should return a list of plans", func() {
             So(rec.Code, ShouldEqual, http.StatusOK)
@@ -102,6 +302,222 @@ func TestServer(t *testing.T) {
         })
     })
 
+    Convey("On request for the billing report", t, func() {
+        Convey("Should return reports per billing code", func() {
+            var reports []model.BillingReport
+
+            req := httptest.NewRequest(http.MethodGet, tURL+v1+"/reports/billing", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(json.NewDecoder(rec.Body).Decode(&reports), ShouldBeNil)
+        })
+        Convey("Should return csv", func() {
+            req := httptest.NewRequest(http.MethodGet, tURL+v1+"/reports/billing?format=csv", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(rec.Header().Get("Content-Type"), ShouldEqual, "text/csv")
+            So(rec.Body.String(), ShouldStartWith, "billingcode,name,plan,usage,instance_days")
+        })
+        Convey("Should reject a reversed period", func() {
+            req := httptest.NewRequest(http.MethodGet, tURL+v1+"/reports/billing?from=2020-02-01T00:00:00Z&to=2020-01-01T00:00:00Z", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusBadRequest)
+        })
+    })
+
+    Convey("On API key management", t, func() {
+        var kSpec model.NewApiKeySpec
+
+        keyName := fmt.Sprintf("dashboard%d", time.Now().UnixNano())
+        body, _ := json.Marshal(model.ApiKeyRequest{Name: keyName, Scopes: []string{model.ScopeReadInventory}})
+
+        req := httptest.NewRequest(http.MethodPost, tURL+v1+"/apikeys", bytes.NewBuffer(body))
+        req.Header.Set("Authorization", "Bearer "+testAdminKey)
+        req.Header.Set("Content-Type", "application/json")
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        json.NewDecoder(rec.Body).Decode(&kSpec)
+
+        Convey("Should create a key limited to its scopes", func() {
+            So(rec.Code, ShouldEqual, http.StatusCreated)
+            So(kSpec.Key, ShouldNotBeBlank)
+
+            req := httptest.NewRequest(http.MethodGet, tURL+v1, nil)
+            req.Header.Set("Authorization", "Bearer "+kSpec.Key)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+
+            req = httptest.NewRequest(http.MethodDelete, tURL+v1+"/instance/nosuchdb", nil)
+            req.Header.Set("Authorization", "Bearer "+kSpec.Key)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusForbidden)
+
+            req = httptest.NewRequest(http.MethodGet, tURL+v2+"/catalog", nil)
+            req.Header.Set(osbVersionHeader, osbVersion)
+            req.SetBasicAuth("akkeris", kSpec.Key)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+        })
+
+        Convey("Should keep data and logs from a read-inventory key", func() {
+            for _, path := range []string{"/somedb/backups/somebackup", "/somedb/logs", "/somedb/logs/dir/file"} {
+                req := httptest.NewRequest(http.MethodGet, tURL+v1+path, nil)
+                req.Header.Set("Authorization", "Bearer "+kSpec.Key)
+                rec := httptest.NewRecorder()
+                h.ServeHTTP(rec, req)
+                So(rec.Code, ShouldEqual, http.StatusForbidden)
+            }
+        })
+
+        Convey("Should never show passwords to a read-inventory key", func() {
+            var pSpec model.FullDatabaseSpec
+            var fSpec model.FullDatabaseSpec
+            var fCreds []model.FullCredentialSpec
+
+            jTestDb, _ := json.Marshal(model.ProvisionSpec{Plan: "shared", BillingCode: "testOps"})
+            req := httptest.NewRequest(http.MethodPost, tURL+v1+"/instance", bytes.NewBuffer(jTestDb))
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&pSpec)
+            So(rec.Code, ShouldEqual, http.StatusCreated)
+            So(pSpec.Password, ShouldNotBeBlank)
+            defer db.RemoveDb(context.Background(), pSpec.Name)
+
+            body, _ := json.Marshal(model.CredentialRequest{Name: "app"})
+            req = httptest.NewRequest(http.MethodPost, tURL+v1+"/instance/"+pSpec.Name+"/credentials", bytes.NewBuffer(body))
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusCreated)
+
+            for _, path := range []string{v1, v1 + "/" + pSpec.Name, v1 + "/instance/" + pSpec.Name,
+                v1 + "/instance/" + pSpec.Name + "/credentials", v1 + "/url/" + pSpec.Name} {
+
+                req = httptest.NewRequest(http.MethodGet, tURL+path, nil)
+                req.Header.Set("Authorization", "Bearer "+kSpec.Key)
+                rec = httptest.NewRecorder()
+                h.ServeHTTP(rec, req)
+                So(rec.Body.String(), ShouldNotContainSubstring, pSpec.Password)
+            }
+
+            req = httptest.NewRequest(http.MethodGet, tURL+v1+"/instance/"+pSpec.Name, nil)
+            req.Header.Set("Authorization", "Bearer "+kSpec.Key)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&fSpec)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(fSpec.Name, ShouldEqual, pSpec.Name)
+            So(fSpec.Password, ShouldBeBlank)
+            So(fSpec.Url, ShouldBeBlank)
+
+            req = httptest.NewRequest(http.MethodGet, tURL+v1+"/instance/"+pSpec.Name+"/credentials", nil)
+            req.Header.Set("Authorization", "Bearer "+kSpec.Key)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&fCreds)
+            So(len(fCreds), ShouldEqual, 1)
+            So(fCreds[0].Password, ShouldBeBlank)
+            So(fCreds[0].Url, ShouldBeBlank)
+
+            req = httptest.NewRequest(http.MethodGet, tURL+v1+"/url/"+pSpec.Name, nil)
+            req.Header.Set("Authorization", "Bearer "+kSpec.Key)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusForbidden)
+        })
+
+        Convey("Should list keys without the key itself", func() {
+            req := httptest.NewRequest(http.MethodGet, tURL+v1+"/apikeys", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(rec.Body.String(), ShouldContainSubstring, keyName)
+            So(rec.Body.String(), ShouldNotContainSubstring, kSpec.Key)
+        })
+
+        Convey("Should reject unknown keys", func() {
+            req := httptest.NewRequest(http.MethodGet, tURL+v1, nil)
+            req.Header.Set("Authorization", "Bearer not-a-key")
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+        })
+
+        Convey("Should not accept a deleted key", func() {
+            req := httptest.NewRequest(http.MethodDelete, tURL+v1+"/apikeys/"+kSpec.Id, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+
+            req = httptest.NewRequest(http.MethodGet, tURL+v1, nil)
+            req.Header.Set("Authorization", "Bearer "+kSpec.Key)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+        })
+
+        Reset(func() {
+            req := httptest.NewRequest(http.MethodDelete, tURL+v1+"/apikeys/"+kSpec.Id, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            h.ServeHTTP(httptest.NewRecorder(), req)
+        })
+    })
+
+    Convey("On plan administration", t, func() {
+        var plan model.PlanSpec
+
+        planName := fmt.Sprintf("test%d", time.Now().UnixNano())
+        body, _ := json.Marshal(model.PlanSpec{Name: planName, Size: "1gb", Description: "Test Plan"})
+
+        Convey("Should require an API key", func() {
+            req := httptest.NewRequest(http.MethodPost, tURL+v1+"/plans", bytes.NewBuffer(body))
+            req.Header.Set("Content-Type", "application/json")
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+
+            So(rec.Code, ShouldEqual, http.StatusUnauthorized)
+        })
+
+        Convey("Should create, update and delete a plan", func() {
+            req := httptest.NewRequest(http.MethodPost, tURL+v1+"/plans", bytes.NewBuffer(body))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Content-Type", "application/json")
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusCreated)
+
+            uBody, _ := json.Marshal(model.PlanSpec{Size: "2gb", Description: "Bigger Test Plan"})
+            req = httptest.NewRequest(http.MethodPut, tURL+v1+"/plans/"+planName, bytes.NewBuffer(uBody))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Content-Type", "application/json")
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&plan)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(plan.Size, ShouldEqual, "2gb")
+
+            req = httptest.NewRequest(http.MethodDelete, tURL+v1+"/plans/"+planName, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+        })
+    })
+
     Convey("On provision with bad post data", t, func() {
         testDb := model.ProvisionSpec{
             Plan:        "",
@@ -112,6 +528,7 @@ func TestServer(t *testing.T) {
 
         Convey("Should return bad request", func() {
             req := httptest.NewRequest(http.MethodPost, tURL+v1+"/instance", bytes.NewBuffer(jTestDb))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
             req.Header.Set("Content-Type", "application/json")
             rec := httptest.NewRecorder()
             h.ServeHTTP(rec, req)
@@ -129,12 +546,13 @@ func TestServer(t *testing.T) {
 
         Convey("Should return provisioned db info\n", func() {
             req := httptest.NewRequest(http.MethodPost, tURL+v1+"/instance", bytes.NewBuffer(jTestDb))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
             req.Header.Set("Content-Type", "application/json")
             rec := httptest.NewRecorder()
             h.ServeHTTP(rec, req)
-            log.Printf("prov rec.Body: %+v\n", rec.Body)
+            log.Infof("prov rec.Body: %+v", rec.Body)
             json.NewDecoder(rec.Body).Decode(&pDB)
-            log.Printf("prov db.name: %s\n", pDB.Name)
+            log.Infof("prov db.name: %s", pDB.Name)
             pName = pDB.Name
 
             So(rec.Code, ShouldEqual, http.StatusCreated)
@@ -143,23 +561,39 @@ func TestServer(t *testing.T) {
         })
 
         Convey("Should get db info from /instance/:name\n", func() {
-            log.Printf("find db.name: %s\n", pName)
+            log.Infof("find db.name: %s", pName)
             req := httptest.NewRequest(http.MethodGet, tURL+v1+"/instance/"+pName, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
             rec := httptest.NewRecorder()
             h.ServeHTTP(rec, req)
-            log.Printf("get db rec.Body: %+v\n", rec.Body)
+            log.Infof("get db rec.Body: %+v", rec.Body)
             json.NewDecoder(rec.Body).Decode(&pDB)
 
             So(rec.Code, ShouldEqual, http.StatusOK)
             So(pDB.Name, ShouldEqual, pName)
         })
 
+        Convey("Should report active status\n", func() {
+            var sSpec model.StatusSpec
+
+            req := httptest.NewRequest(http.MethodGet, tURL+v1+"/instance/"+pName+"/status", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&sSpec)
+
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(sSpec.Name, ShouldEqual, pName)
+            So(sSpec.Status, ShouldEqual, model.StatusActive)
+        })
+
         Convey("Should get db info from /:name\n", func() {
-            log.Printf("find db.name: %s\n", pName)
+            log.Infof("find db.name: %s", pName)
             req := httptest.NewRequest(http.MethodGet, tURL+v1+"/"+pName, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
             rec := httptest.NewRecorder()
             h.ServeHTTP(rec, req)
-            log.Printf("get db rec.Body: %+v\n", rec.Body)
+            log.Infof("get db rec.Body: %+v", rec.Body)
             json.NewDecoder(rec.Body).Decode(&pDB)
 
             So(rec.Code, ShouldEqual, http.StatusOK)
@@ -169,25 +603,185 @@ func TestServer(t *testing.T) {
         Convey("Should get db connection url", func() {
             var dbUrl model.DBUrl
 
-            log.Printf("url db.name: %s", pName)
+            log.Infof("url db.name: %s", pName)
             req := httptest.NewRequest(http.MethodGet, tURL+v1+"/url/"+pName, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
             rec := httptest.NewRecorder()
             h.ServeHTTP(rec, req)
-            log.Printf("get db w.Body: %+v\n", rec.Body)
+            log.Infof("get db w.Body: %+v", rec.Body)
             json.NewDecoder(rec.Body).Decode(&dbUrl)
 
             So(rec.Code, ShouldEqual, http.StatusOK)
             So(dbUrl.Url, ShouldContainSubstring, pName)
         })
 
+        Convey("Should add, list and remove named credentials", func() {
+            var cred model.FullCredentialSpec
+            var creds []model.FullCredentialSpec
+
+            body, _ := json.Marshal(model.CredentialRequest{Name: "analysts", Role: model.RoleReadOnly})
+            req := httptest.NewRequest(http.MethodPost, tURL+v1+"/instance/"+pName+"/credentials", bytes.NewBuffer(body))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Content-Type", "application/json")
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&cred)
+
+            So(rec.Code, ShouldEqual, http.StatusCreated)
+            So(cred.Role, ShouldEqual, model.RoleReadOnly)
+            So(cred.Url, ShouldContainSubstring, cred.Username)
+
+            req = httptest.NewRequest(http.MethodGet, tURL+v1+"/instance/"+pName+"/credentials", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&creds)
+
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(len(creds), ShouldEqual, 1)
+
+            req = httptest.NewRequest(http.MethodDelete, tURL+v1+"/instance/"+pName+"/credentials/analysts", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+
+            So(rec.Code, ShouldEqual, http.StatusOK)
+        })
+
+        Convey("Should label and list by label", func() {
+            var lSpec model.LabelsSpec
+            var dbs []model.FullDatabaseSpec
+
+            body, _ := json.Marshal(model.LabelsSpec{Labels: map[string]string{"team": "payments", "app": "api"}})
+            req := httptest.NewRequest(http.MethodPost, tURL+v1+"/instance/"+pName+"/labels", bytes.NewBuffer(body))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Content-Type", "application/json")
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&lSpec)
+
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(lSpec.Labels["team"], ShouldEqual, "payments")
+
+            req = httptest.NewRequest(http.MethodGet, tURL+v1+"?label=team=payments&label=app=api", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&dbs)
+
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(len(dbs), ShouldBeGreaterThan, 0)
+            for _, d := range dbs {
+                So(d.Labels["team"], ShouldEqual, "payments")
+            }
+
+            req = httptest.NewRequest(http.MethodDelete, tURL+v1+"/instance/"+pName+"/labels/app", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+
+            So(rec.Code, ShouldEqual, http.StatusOK)
+
+            req = httptest.NewRequest(http.MethodGet, tURL+v1+"?label=team", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+
+            So(rec.Code, ShouldEqual, http.StatusBadRequest)
+        })
+
+        Convey("Should page and select fields of the list", func() {
+            var dbs []map[string]interface{}
+
+            req := httptest.NewRequest(http.MethodGet, tURL+v1+"?limit=1&sort=-created&fields=name,plan", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&dbs)
+
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(len(dbs), ShouldEqual, 1)
+            So(dbs[0], ShouldContainKey, "plan")
+            So(dbs[0], ShouldNotContainKey, "password")
+            So(dbs[0], ShouldNotContainKey, "MONGODB_URL")
+
+            next := rec.Header().Get("X-Next-Cursor")
+            if next != "" {
+                So(rec.Header().Get("Link"), ShouldContainSubstring, "cursor="+next)
+
+                req = httptest.NewRequest(http.MethodGet, tURL+v1+"?limit=1&sort=-created&fields=name,plan&cursor="+next, nil)
+                req.Header.Set("Authorization", "Bearer "+testAdminKey)
+                rec = httptest.NewRecorder()
+                h.ServeHTTP(rec, req)
+
+                So(rec.Code, ShouldEqual, http.StatusOK)
+                So(rec.Body.String(), ShouldNotContainSubstring, dbs[0]["name"])
+            }
+
+            for _, bad := range []string{"?limit=0", "?sort=password", "?fields=secret", "?cursor=junk"} {
+                req = httptest.NewRequest(http.MethodGet, tURL+v1+bad, nil)
+                req.Header.Set("Authorization", "Bearer "+testAdminKey)
+                rec = httptest.NewRecorder()
+                h.ServeHTTP(rec, req)
+
+                So(rec.Code, ShouldEqual, http.StatusBadRequest)
+            }
+        })
+
+        Convey("Should change plan", func() {
+            var cDB model.FullDatabaseSpec
+
+            body, _ := json.Marshal(model.PlanChangeSpec{Plan: "ha"})
+            req := httptest.NewRequest(http.MethodPut, tURL+v1+"/"+pName, bytes.NewBuffer(body))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Content-Type", "application/json")
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&cDB)
+
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(cDB.Plan, ShouldEqual, "ha")
+
+            body, _ = json.Marshal(model.PlanChangeSpec{Plan: "junk"})
+            req = httptest.NewRequest(http.MethodPut, tURL+v1+"/"+pName, bytes.NewBuffer(body))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Content-Type", "application/json")
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+
+            So(rec.Code, ShouldEqual, http.StatusBadRequest)
+        })
+
+        Convey("Should rotate credentials", func() {
+            var before, after model.FullDatabaseSpec
+
+            req := httptest.NewRequest(http.MethodGet, tURL+v1+"/instance/"+pName, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&before)
+
+            req = httptest.NewRequest(http.MethodPost, tURL+v1+"/instance/"+pName+"/rotate?grace=1m", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&after)
+
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(after.Username, ShouldNotEqual, before.Username)
+            So(after.Url, ShouldNotEqual, before.Url)
+            So(len(after.RetiredUsers), ShouldBeGreaterThan, 0)
+        })
+
         Convey("On request for db list", func() {
             var dbs []model.FullDatabaseSpec
 
             req := httptest.NewRequest(http.MethodGet, tURL+v1, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
             rec := httptest.NewRecorder()
             h.ServeHTTP(rec, req)
             json.NewDecoder(rec.Body).Decode(&dbs)
-            log.Printf("dbs list cnt: %d\n ", len(dbs))
+            log.Infof("dbs list cnt: %d", len(dbs))
 
             Convey("Should return a list of dbs", func() {
                 So(rec.Code, ShouldEqual, http.StatusOK)
@@ -197,44 +791,369 @@ func TestServer(t *testing.T) {
             })
         })
 
-        Convey("On get to /:dbName/backups", func() {
-            var ns model.MsgSpec
+        Convey("On backups of /:dbName", func() {
+            var bSpec model.BackupSpec
+            var backups []model.BackupSpec
 
-            req := httptest.NewRequest("GET", tURL+v1+"/"+pName+"/backups", nil)
+            req := httptest.NewRequest(http.MethodPut, tURL+v1+"/"+pName+"/backups", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
             rec := httptest.NewRecorder()
             h.ServeHTTP(rec, req)
-            log.Printf("get /v1/:name/backups Body: %+v\n", rec.Body)
-            json.NewDecoder(rec.Body).Decode(&ns)
+            log.Infof("put /v1/:name/backups Body: %+v", rec.Body)
+            json.NewDecoder(rec.Body).Decode(&bSpec)
+
+            Convey("Should create a backup", func() {
+                So(rec.Code, ShouldEqual, http.StatusCreated)
+                So(bSpec.Status, ShouldEqual, model.BackupCompleted)
+                So(bSpec.Size, ShouldBeGreaterThan, 0)
+            })
+
+            Convey("Should list backups", func() {
+                req := httptest.NewRequest(http.MethodGet, tURL+v1+"/"+pName+"/backups", nil)
+                req.Header.Set("Authorization", "Bearer "+testAdminKey)
+                rec := httptest.NewRecorder()
+                h.ServeHTTP(rec, req)
+                json.NewDecoder(rec.Body).Decode(&backups)
+
+                So(rec.Code, ShouldEqual, http.StatusOK)
+                So(len(backups), ShouldBeGreaterThan, 0)
+            })
+
+            Convey("Should restore a backup", func() {
+                var rSpec model.RestoreSpec
+
+                body, _ := json.Marshal(model.RestoreRequest{Drop: true})
+                req := httptest.NewRequest(http.MethodPost, tURL+v1+"/"+pName+"/backups/"+bSpec.Id+"/restore", bytes.NewBuffer(body))
+                req.Header.Set("Authorization", "Bearer "+testAdminKey)
+                req.Header.Set("Content-Type", "application/json")
+                rec := httptest.NewRecorder()
+                h.ServeHTTP(rec, req)
+                json.NewDecoder(rec.Body).Decode(&rSpec)
+
+                So(rec.Code, ShouldEqual, http.StatusAccepted)
+                So(rSpec.Target, ShouldEqual, pName)
+
+                for i := 0; i < 30 && rSpec.Status == model.RestoreRunning; i++ {
+                    time.Sleep(100 * time.Millisecond)
+                    req := httptest.NewRequest(http.MethodGet, tURL+v1+"/"+pName+"/restores/"+rSpec.Id, nil)
+                    req.Header.Set("Authorization", "Bearer "+testAdminKey)
+                    rec := httptest.NewRecorder()
+                    h.ServeHTTP(rec, req)
+                    json.NewDecoder(rec.Body).Decode(&rSpec)
+                }
 
-            Convey("Should be not supported", func() {
-                So(rec.Code, ShouldEqual, http.StatusNotImplemented)
-                So(ns.Msg, ShouldContainSubstring, "available")
+                So(rSpec.Status, ShouldEqual, model.RestoreCompleted)
+            })
+
+            Convey("Should download a backup", func() {
+                req := httptest.NewRequest(http.MethodGet, tURL+v1+"/"+pName+"/backups/"+bSpec.Id+"?download=true", nil)
+                req.Header.Set("Authorization", "Bearer "+testAdminKey)
+                rec := httptest.NewRecorder()
+                h.ServeHTTP(rec, req)
+
+                So(rec.Code, ShouldEqual, http.StatusOK)
+                So(int64(rec.Body.Len()), ShouldEqual, bSpec.Size)
             })
         })
 
         Convey("On get to /:dbName/logs", func() {
-            var ns model.MsgSpec
+            var entries []model.LogEntry
+
+            req := httptest.NewRequest("GET", tURL+v1+"/"+pName+"/logs?limit=10", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            log.Infof("get /v1/:dbname/logs Body: %+v", rec.Body)
+            json.NewDecoder(rec.Body).Decode(&entries)
+
+            Convey("Should return log entries", func() {
+                So(rec.Code, ShouldEqual, http.StatusOK)
+                So(len(entries), ShouldBeLessThanOrEqualTo, 10)
+            })
+        })
 
-            req := httptest.NewRequest("GET", tURL+v1+"/"+pName+"/logs", nil)
+        Convey("On get to /:dbName/logs with a bad time range", func() {
+            req := httptest.NewRequest("GET", tURL+v1+"/"+pName+"/logs?from=yesterday", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
             rec := httptest.NewRecorder()
             h.ServeHTTP(rec, req)
-            log.Printf("get /v1/:dbname/logs Body: %+v\n", rec.Body)
-            json.NewDecoder(rec.Body).Decode(&ns)
 
-            Convey("Should be not supported", func() {
-                So(rec.Code, ShouldEqual, http.StatusNotImplemented)
-                So(ns.Msg, ShouldContainSubstring, "available")
+            Convey("Should be a bad request", func() {
+                So(rec.Code, ShouldEqual, http.StatusBadRequest)
+            })
+        })
+
+        Convey("On get to an unknown log file", func() {
+            req := httptest.NewRequest("GET", tURL+v1+"/"+pName+"/logs/mongod/nothere", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+
+            Convey("Should not be found", func() {
+                So(rec.Code, ShouldEqual, http.StatusNotFound)
             })
         })
 
         Convey("Should remove db", func() {
-            log.Printf("remove db.name: %s", pName)
+            log.Infof("remove db.name: %s", pName)
             req := httptest.NewRequest("DELETE", tURL+v1+"/instance/"+pName, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            log.Infof("remove db w.Body: %+v", rec.Body)
+
+            So(rec.Code, ShouldEqual, http.StatusOK)
+        })
+    })
+    Convey("On asynchronous provision of new db", t, func() {
+        var aDB model.FullDatabaseSpec
+        var sSpec model.StatusSpec
+
+        testDb := model.ProvisionSpec{
+            Plan:        "shared",
+            BillingCode: "testOps",
+            Misc:        "testAsyncDb",
+        }
+        jTestDb, _ := json.Marshal(testDb)
+
+        Convey("Should accept the request and become active", func() {
+            req := httptest.NewRequest(http.MethodPost, tURL+v1+"/instance?async=true", bytes.NewBuffer(jTestDb))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Content-Type", "application/json")
             rec := httptest.NewRecorder()
             h.ServeHTTP(rec, req)
-            log.Printf("remove db w.Body: %+v\n", rec.Body)
+            json.NewDecoder(rec.Body).Decode(&aDB)
+
+            So(rec.Code, ShouldEqual, http.StatusAccepted)
+            So(aDB.Status, ShouldEqual, model.StatusProvisioning)
+
+            for i := 0; i < 30; i++ {
+                req := httptest.NewRequest(http.MethodGet, tURL+v1+"/instance/"+aDB.Name+"/status", nil)
+                req.Header.Set("Authorization", "Bearer "+testAdminKey)
+                rec := httptest.NewRecorder()
+                h.ServeHTTP(rec, req)
+                json.NewDecoder(rec.Body).Decode(&sSpec)
+                if sSpec.Status != model.StatusProvisioning {
+                    break
+                }
+                time.Sleep(100 * time.Millisecond)
+            }
+
+            So(sSpec.Status, ShouldEqual, model.StatusActive)
+            So(db.RemoveDb(context.Background(), aDB.Name), ShouldBeNil)
+        })
+    })
+
+    Convey("On Open Service Broker requests", t, func() {
+        instanceId := fmt.Sprintf("osb-test-%d", time.Now().UnixNano())
+        iURL := tURL + v2 + "/service_instances/" + instanceId
+
+        Convey("Should require the broker api version header", func() {
+            req := httptest.NewRequest(http.MethodGet, tURL+v2+"/catalog", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+
+            So(rec.Code, ShouldEqual, http.StatusPreconditionFailed)
+        })
+
+        Convey("Should return the catalog", func() {
+            var catalog model.OSBCatalog
+
+            req := httptest.NewRequest(http.MethodGet, tURL+v2+"/catalog", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set(osbVersionHeader, osbVersion)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&catalog)
+
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(len(catalog.Services), ShouldEqual, 1)
+            So(len(catalog.Services[0].Plans), ShouldBeGreaterThan, 0)
+        })
+
+        Convey("Should provision, bind, unbind and deprovision", func() {
+            var bind model.OSBBindResponse
+            var op model.OSBLastOperation
+
+            body, _ := json.Marshal(model.OSBProvisionRequest{
+                ServiceId:        osbServiceId(),
+                PlanId:           "shared",
+                OrganizationGuid: "testOps",
+                SpaceGuid:        "testSpace",
+            })
+
+            req := httptest.NewRequest(http.MethodPut, iURL, bytes.NewBuffer(body))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set(osbVersionHeader, osbVersion)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusCreated)
+
+            req = httptest.NewRequest(http.MethodPut, iURL, bytes.NewBuffer(body))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set(osbVersionHeader, osbVersion)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+
+            req = httptest.NewRequest(http.MethodGet, iURL+"/last_operation", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set(osbVersionHeader, osbVersion)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&op)
+            So(rec.Code, ShouldEqual, http.StatusOK)
+            So(op.State, ShouldEqual, "succeeded")
+
+            req = httptest.NewRequest(http.MethodPut, iURL+"/service_bindings/b1", bytes.NewBufferString("{}"))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set(osbVersionHeader, osbVersion)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            json.NewDecoder(rec.Body).Decode(&bind)
+            So(rec.Code, ShouldEqual, http.StatusCreated)
+            So(bind.Credentials["MONGODB_URL"], ShouldStartWith, "mongodb://")
+
+            req = httptest.NewRequest(http.MethodDelete, iURL+"/service_bindings/b1", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set(osbVersionHeader, osbVersion)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusOK)
 
+            req = httptest.NewRequest(http.MethodDelete, iURL, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set(osbVersionHeader, osbVersion)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
             So(rec.Code, ShouldEqual, http.StatusOK)
+
+            req = httptest.NewRequest(http.MethodDelete, iURL, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set(osbVersionHeader, osbVersion)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusGone)
+        })
+
+        Convey("Should not treat an unreadable instance as missing", func() {
+            c := db.Session.DB("broker").C("provision")
+            err := c.Insert(&model.DatabaseSpec{
+                Name:       instanceId,
+                InstanceId: instanceId,
+                Plan:       "shared",
+                Password:   "enc:v1:unreadable",
+                Status:     model.StatusActive,
+            })
+            So(err, ShouldBeNil)
+            defer c.Remove(bson.M{"instanceid": instanceId})
+
+            body, _ := json.Marshal(model.OSBProvisionRequest{
+                ServiceId:        osbServiceId(),
+                PlanId:           "shared",
+                OrganizationGuid: "testOps",
+            })
+
+            req := httptest.NewRequest(http.MethodPut, iURL, bytes.NewBuffer(body))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set(osbVersionHeader, osbVersion)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusInternalServerError)
+
+            req = httptest.NewRequest(http.MethodDelete, iURL, nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set(osbVersionHeader, osbVersion)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusInternalServerError)
+
+            n, err := c.Find(bson.M{"instanceid": instanceId}).Count()
+            So(err, ShouldBeNil)
+            So(n, ShouldEqual, 1)
+        })
+
+        Convey("Should not report a failed or unfinished instance as provisioned", func() {
+            c := db.Session.DB("broker").C("provision")
+            err := c.Insert(&model.DatabaseSpec{
+                Name:       instanceId,
+                InstanceId: instanceId,
+                Plan:       "shared",
+                Status:     model.StatusProvisioning,
+            })
+            So(err, ShouldBeNil)
+            defer c.Remove(bson.M{"instanceid": instanceId})
+
+            body, _ := json.Marshal(model.OSBProvisionRequest{
+                ServiceId:        osbServiceId(),
+                PlanId:           "shared",
+                OrganizationGuid: "testOps",
+            })
+            put := func() *httptest.ResponseRecorder {
+                req := httptest.NewRequest(http.MethodPut, iURL, bytes.NewBuffer(body))
+                req.Header.Set("Authorization", "Bearer "+testAdminKey)
+                req.Header.Set("Content-Type", "application/json")
+                req.Header.Set(osbVersionHeader, osbVersion)
+                rec := httptest.NewRecorder()
+                h.ServeHTTP(rec, req)
+                return rec
+            }
+
+            rec := put()
+            So(rec.Code, ShouldEqual, http.StatusUnprocessableEntity)
+            So(rec.Body.String(), ShouldContainSubstring, "AsyncRequired")
+
+            So(c.Update(bson.M{"instanceid": instanceId}, bson.M{
+                "$set": bson.M{"status": model.StatusFailed, "lasterror": "user refused"},
+            }), ShouldBeNil)
+            rec = put()
+            So(rec.Code, ShouldEqual, http.StatusInternalServerError)
+            So(rec.Body.String(), ShouldContainSubstring, "user refused")
+        })
+
+        Convey("Should not treat an unreadable binding as missing", func() {
+            pSpec, err := db.Provision(context.Background(), model.ProvisionSpec{
+                Plan:        "shared",
+                BillingCode: "testOps",
+                InstanceId:  instanceId,
+            })
+            So(err, ShouldBeNil)
+            defer db.RemoveDb(context.Background(), pSpec.Name)
+
+            creds := db.Session.DB("broker").C("credentials")
+            err = creds.Insert(&model.CredentialSpec{
+                Name:     osbCredentialName("b2"),
+                Database: pSpec.Name,
+                Username: "unreadable",
+                Password: "enc:v1:unreadable",
+                Role:     model.RoleReadWrite,
+            })
+            So(err, ShouldBeNil)
+            defer creds.Remove(bson.M{"database": pSpec.Name, "name": osbCredentialName("b2")})
+
+            req := httptest.NewRequest(http.MethodPut, iURL+"/service_bindings/b2", bytes.NewBufferString("{}"))
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set(osbVersionHeader, osbVersion)
+            rec := httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusInternalServerError)
+
+            req = httptest.NewRequest(http.MethodDelete, iURL+"/service_bindings/b2", nil)
+            req.Header.Set("Authorization", "Bearer "+testAdminKey)
+            req.Header.Set(osbVersionHeader, osbVersion)
+            rec = httptest.NewRecorder()
+            h.ServeHTTP(rec, req)
+            So(rec.Code, ShouldEqual, http.StatusInternalServerError)
+
+            n, err := creds.Find(bson.M{"database": pSpec.Name}).Count()
+            So(err, ShouldBeNil)
+            So(n, ShouldEqual, 1)
         })
     })
 }
@@ -0,0 +1,95 @@
+package storage
+
+/*
+ * Local filesystem store, for development and single node deployments.
+ */
+
+import (
+    "errors"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+type Local struct {
+    Dir string
+}
+
+func NewLocal(dir string) (*Local, error) {
+    if dir == "" {
+        dir = "backups"
+    }
+    err := os.MkdirAll(dir, 0700)
+    if err != nil {
+        return nil, err
+    }
+    return &Local{Dir: dir}, nil
+}
+
+func (l *Local) path(key string) (string, error) {
+    clean := filepath.Clean("/" + key)
+    if key == "" || strings.Contains(key, "..") || clean == "/" {
+        return "", errors.New("invalid key " + key)
+    }
+    return filepath.Join(l.Dir, filepath.FromSlash(clean)), nil
+}
+
+/*
+ * Put writes to a temporary file first so a failed write never leaves a
+ * partial object behind under key.
+ */
+func (l *Local) Put(key string, r io.Reader) (int64, error) {
+    p, err := l.path(key)
+    if err != nil {
+        return 0, err
+    }
+
+    err = os.MkdirAll(filepath.Dir(p), 0700)
+    if err != nil {
+        return 0, err
+    }
+
+    tmp, err := ioutil.TempFile(filepath.Dir(p), ".put-")
+    if err != nil {
+        return 0, err
+    }
+    defer os.Remove(tmp.Name())
+
+    n, err := io.Copy(tmp, r)
+    if cErr := tmp.Close(); err == nil {
+        err = cErr
+    }
+    if err != nil {
+        return n, err
+    }
+
+    return n, os.Rename(tmp.Name(), p)
+}
+
+func (l *Local) Get(key string) (io.ReadCloser, error) {
+    p, err := l.path(key)
+    if err != nil {
+        return nil, err
+    }
+
+    f, err := os.Open(p)
+    if os.IsNotExist(err) {
+        return nil, ErrNotFound
+    }
+    return f, err
+}
+
+func (l *Local) Delete(key string) error {
+    p, err := l.path(key)
+    if err != nil {
+        return err
+    }
+
+    err = os.Remove(p)
+    if os.IsNotExist(err) {
+        return ErrNotFound
+    }
+    return err
+}
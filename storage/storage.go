@@ -0,0 +1,36 @@
+package storage
+
+/*
+ * Project: oct-mongodb-api
+ * Package: storage
+ *
+ * Pluggable object storage for backup archives.
+ *
+ */
+
+import (
+    "errors"
+    "io"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+/*
+ * A Store keeps opaque objects by key.  Keys are slash separated paths.
+ */
+type Store interface {
+    Put(key string, r io.Reader) (int64, error)
+    Get(key string) (io.ReadCloser, error)
+    Delete(key string) error
+}
+
+/*
+ * New returns the store named by kind, configured with location.
+ */
+func New(kind string, location string) (Store, error) {
+    switch kind {
+    case "", "local":
+        return NewLocal(location)
+    }
+    return nil, errors.New("unknown storage backend " + kind)
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "testing"
+
+    . "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLocal(t *testing.T) {
+    dir, _ := ioutil.TempDir("", "storage-test")
+    defer os.RemoveAll(dir)
+
+    Convey("With a local store", t, func() {
+        s, err := New("local", dir)
+
+        So(err, ShouldBeNil)
+
+        Convey("Should store and read back an object", func() {
+            n, err := s.Put("db1/b1.tar.gz", bytes.NewBufferString("archive"))
+            So(err, ShouldBeNil)
+            So(n, ShouldEqual, 7)
+
+            r, err := s.Get("db1/b1.tar.gz")
+            So(err, ShouldBeNil)
+            b, _ := ioutil.ReadAll(r)
+            r.Close()
+            So(string(b), ShouldEqual, "archive")
+
+            So(s.Delete("db1/b1.tar.gz"), ShouldBeNil)
+            _, err = s.Get("db1/b1.tar.gz")
+            So(err, ShouldEqual, ErrNotFound)
+        })
+
+        Convey("Should reject keys outside the store", func() {
+            _, err := s.Put("../escape", bytes.NewBufferString("x"))
+            So(err, ShouldNotBeNil)
+        })
+    })
+
+    Convey("With an unknown backend", t, func() {
+        _, err := New("tape", dir)
+
+        Convey("Should return an error", func() {
+            So(err, ShouldNotBeNil)
+        })
+    })
+}